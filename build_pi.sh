@@ -16,4 +16,5 @@ mkdir -p deployment/producer/
 cd producer && env GOOS=linux GOARCH=arm GOARM=5 go build && mv producer ../deployment/producer/producer && cd ../
 cp producer/wpwconfig.json deployment/producer/wpwconfig.json
 cp producer/wpwconfig.json deployment/producer/wpwconfig.json
+cp producer/catalog.json deployment/producer/catalog.json
 mkdir -p deployment/producer/logs
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// checkAvailable returns an error with the producer's reason if the service cannot be bought right now
+func checkAvailable(svc *wpwtypes.ServiceDetails) error {
+
+	i := strings.LastIndex(svc.ServiceDescription, unavailableMarker)
+
+	if i < 0 {
+
+		return nil
+	}
+
+	reason := strings.TrimSuffix(svc.ServiceDescription[i+len(unavailableMarker):], "]")
+
+	return fmt.Errorf("service %d is unavailable: %s", svc.ServiceID, reason)
+}
+
+// quoteStatus is the producer's view of a quote, from its status port
+type quoteStatus struct {
+	Reference string `json:"reference"`
+	Paid      bool   `json:"paid"`
+	Refused   string `json:"refused"`
+}
+
+// checkQuote asks the producer whether a quote can be paid for. The SDK sends a quote even when the
+// producer refuses it, e.g. the service closed after it was discovered, so the refusal is only on the
+// producer's status port. A producer which cannot be asked is not treated as refusing.
+func checkQuote(device *wpwtypes.BroadcastMessage, reference string) error {
+
+	if flagStatusPort <= 0 {
+
+		return nil
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s:%d/quotes/%s", device.Hostname, flagStatusPort, url.PathEscape(reference)))
+
+	if err != nil {
+
+		fmt.Printf("Could not check quote %s with the producer: %s\n", reference, err.Error())
+		return nil
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+
+		fmt.Printf("Could not check quote %s with the producer: %s\n", reference, resp.Status)
+		return nil
+	}
+
+	var status quoteStatus
+
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+
+		fmt.Printf("Could not check quote %s with the producer: %s\n", reference, err.Error())
+		return nil
+	}
+
+	if status.Refused != "" {
+
+		return fmt.Errorf("producer refused quote %s: %s", reference, status.Refused)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// Colour mix prices are described as "<name> (<r>,<g>,<b>)", e.g. "Purple (255,0,255)"
+
+// parseRGB parses "r,g,b" with each value 0-255
+func parseRGB(s string) ([3]int, bool) {
+
+	var rgb [3]int
+
+	parts := strings.Split(strings.Trim(strings.TrimSpace(s), "()"), ",")
+
+	if len(parts) != 3 {
+
+		return rgb, false
+	}
+
+	for i, part := range parts {
+
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+
+		if err != nil || v < 0 || v > 255 {
+
+			return rgb, false
+		}
+
+		rgb[i] = v
+	}
+
+	return rgb, true
+}
+
+// colourOf splits a colour mix price description into its name and RGB triple
+func colourOf(description string) (string, [3]int, bool) {
+
+	description, _, _ = splitLimits(description)
+
+	open := strings.LastIndex(description, "(")
+
+	if open < 0 || !strings.HasSuffix(description, ")") {
+
+		return "", [3]int{}, false
+	}
+
+	rgb, ok := parseRGB(description[open:])
+
+	return strings.TrimSpace(description[:open]), rgb, ok
+}
+
+// findColourPrice returns the price for a named colour (e.g. purple) or an RGB triple (e.g. 255,0,255)
+func findColourPrice(prices []wpwtypes.Price, colour string) (*wpwtypes.Price, error) {
+
+	wantRGB, isRGB := parseRGB(colour)
+
+	var available []string
+
+	for _, price := range prices {
+
+		name, rgb, ok := colourOf(price.Description)
+
+		if !ok {
+
+			continue
+		}
+
+		if (isRGB && rgb == wantRGB) || (!isRGB && strings.EqualFold(name, colour)) {
+
+			fmt.Printf("Found required colour %s - price %d @%s %dp per %s\n", price.Description, price.ID, price.PricePerUnit.CurrencyCode, price.PricePerUnit.Amount, price.UnitDescription)
+			return &price, nil
+		}
+
+		available = append(available, price.Description)
+	}
+
+	if len(available) == 0 {
+
+		return nil, fmt.Errorf("service has no colour prices")
+	}
+
+	return nil, fmt.Errorf("colour %s is not offered, choose from: %s", colour, strings.Join(available, ", "))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression: minute hour day-of-month month day-of-week.
+// Each field accepts *, single values, ranges (a-b), steps (*/n, a-b/n) and comma separated lists.
+type cronSchedule struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+
+	// As with cron, when both day fields are restricted a time matching either one is due
+	daysRestricted     bool
+	weekdaysRestricted bool
+}
+
+// cronSearchLimit bounds the search for the next run so an expression such as "0 0 31 2 *" cannot loop forever
+const cronSearchLimit = 366 * 24 * time.Hour * 5
+
+func parseCron(expr string) (*cronSchedule, error) {
+
+	fields := strings.Fields(expr)
+
+	if len(fields) != 5 {
+
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	var err error
+	schedule := &cronSchedule{}
+
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+
+		return nil, fmt.Errorf("minute field: %s", err.Error())
+	}
+
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+
+		return nil, fmt.Errorf("hour field: %s", err.Error())
+	}
+
+	if schedule.days, err = parseCronField(fields[2], 1, 31); err != nil {
+
+		return nil, fmt.Errorf("day of month field: %s", err.Error())
+	}
+
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+
+		return nil, fmt.Errorf("month field: %s", err.Error())
+	}
+
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+
+		return nil, fmt.Errorf("day of week field: %s", err.Error())
+	}
+
+	// 7 is an alias for Sunday
+	if schedule.weekdays[7] {
+
+		schedule.weekdays[0] = true
+		delete(schedule.weekdays, 7)
+	}
+
+	// As in cron, a field starting with * (including steps such as */2) does not restrict the day
+	schedule.daysRestricted = !strings.HasPrefix(fields[2], "*")
+	schedule.weekdaysRestricted = !strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+
+	values := make(map[int]bool, 0)
+
+	for _, part := range strings.Split(field, ",") {
+
+		step := 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+
+			n, err := strconv.Atoi(part[i+1:])
+
+			if err != nil || n <= 0 {
+
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+
+		if part != "*" {
+
+			bounds := strings.SplitN(part, "-", 2)
+
+			n, err := strconv.Atoi(bounds[0])
+
+			if err != nil {
+
+				return nil, fmt.Errorf("invalid value in %q", part)
+			}
+
+			lo, hi = n, n
+
+			if len(bounds) == 2 {
+
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+
+					return nil, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if step > 1 {
+
+				// "5/15" means from 5 to the end of the range in steps of 15
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+
+			values[v] = true
+		}
+	}
+
+	if len(values) == 0 {
+
+		return nil, errors.New("no values")
+	}
+
+	return values, nil
+}
+
+func (schedule *cronSchedule) matches(t time.Time) bool {
+
+	return schedule.minutes[t.Minute()] && schedule.hours[t.Hour()] && schedule.months[int(t.Month())] && schedule.dayMatches(t)
+}
+
+// dayMatches checks the day of month and day of week fields
+func (schedule *cronSchedule) dayMatches(t time.Time) bool {
+
+	dayMatch := schedule.days[t.Day()]
+	weekdayMatch := schedule.weekdays[int(t.Weekday())]
+
+	if schedule.daysRestricted && schedule.weekdaysRestricted {
+
+		return dayMatch || weekdayMatch
+	}
+
+	return dayMatch && weekdayMatch
+}
+
+// next returns the first time strictly after t at which the schedule is due,
+// or the zero time if it is never due within the search limit.
+// A field which does not match skips straight to the start of the next month, day or hour,
+// so a schedule that is never due is given up on after a few thousand steps.
+func (schedule *cronSchedule) next(t time.Time) time.Time {
+
+	candidate := t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+	loc := candidate.Location()
+
+	for candidate.Before(limit) {
+
+		year, month, day := candidate.Date()
+
+		switch {
+
+		case !schedule.months[int(month)]:
+			candidate = time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+		case !schedule.dayMatches(candidate):
+			candidate = time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+		case !schedule.hours[candidate.Hour()]:
+			candidate = time.Date(year, month, day, candidate.Hour()+1, 0, 0, 0, loc)
+		case !schedule.minutes[candidate.Minute()]:
+			candidate = candidate.Add(time.Minute)
+		default:
+			return candidate
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// minute returns a local time on 2026-10-19, a Monday, plus days
+func minute(days int, clock string) time.Time {
+
+	t, err := time.Parse("15:04", clock)
+
+	if err != nil {
+
+		panic(err)
+	}
+
+	return time.Date(2026, 10, 19+days, t.Hour(), t.Minute(), 0, 0, time.Local)
+}
+
+func TestCronMatches(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"* * * * *", minute(0, "13:37"), true},
+		{"30 9 * * *", minute(0, "09:30"), true},
+		{"30 9 * * *", minute(0, "09:31"), false},
+		{"*/15 * * * *", minute(0, "10:45"), true},
+		{"*/15 * * * *", minute(0, "10:50"), false},
+		{"5/15 * * * *", minute(0, "10:50"), true},
+		{"0 8-18/2 * * *", minute(0, "14:00"), true},
+		{"0 8-18/2 * * *", minute(0, "15:00"), false},
+		{"0 8,12,17 * * *", minute(0, "12:00"), true},
+		{"0 9 * * 1-5", minute(0, "09:00"), true},  // Monday
+		{"0 9 * * 1-5", minute(5, "09:00"), false}, // Saturday
+		{"0 9 * * 0", minute(6, "09:00"), true},    // Sunday
+		{"0 9 * * 7", minute(6, "09:00"), true},    // Sunday as 7
+		{"0 9 19 * *", minute(0, "09:00"), true},
+		{"0 9 20 * *", minute(0, "09:00"), false},
+		{"0 9 * 11 *", minute(0, "09:00"), false},
+		{"0 9 * 10 *", minute(0, "09:00"), true},
+
+		// Both day fields restricted, either one matching is due
+		{"0 9 1 * 1", minute(0, "09:00"), true},  // Monday, not the 1st
+		{"0 9 19 * 0", minute(0, "09:00"), true}, // The 19th, not Sunday
+		{"0 9 1 * 0", minute(0, "09:00"), false},
+
+		// A day field starting with * does not restrict, so both must match. */2 is the odd days.
+		{"0 9 */2 * 1", minute(0, "09:00"), true},  // Monday the 19th
+		{"0 9 */2 * 1", minute(7, "09:00"), false}, // Monday the 26th
+		{"0 9 */2 * 3", minute(2, "09:00"), true},  // Wednesday the 21st
+		{"0 9 */2 * 2", minute(1, "09:00"), false}, // Tuesday the 20th
+	}
+
+	for _, test := range tests {
+
+		schedule, err := parseCron(test.expr)
+
+		if err != nil {
+
+			t.Errorf("%q: %s", test.expr, err.Error())
+			continue
+		}
+
+		if got := schedule.matches(test.at); got != test.want {
+
+			t.Errorf("%q at %s: got %t, want %t", test.expr, test.at.Format("Mon 2 Jan 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"30 9 * * *", minute(0, "09:00"), minute(0, "09:30")},
+		{"30 9 * * *", minute(0, "09:30"), minute(1, "09:30")},  // Strictly after
+		{"0 9 * * 1-5", minute(4, "10:00"), minute(7, "09:00")}, // Friday to Monday
+		{"*/20 * * * *", minute(0, "23:50"), minute(1, "00:00")},
+		{"0 0 1 * *", minute(0, "12:00"), time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)},
+		{"0 0 29 2 *", minute(0, "12:00"), time.Date(2028, 2, 29, 0, 0, 0, 0, time.Local)},
+		{"0 0 31 2 *", minute(0, "12:00"), time.Time{}}, // Never due
+	}
+
+	for _, test := range tests {
+
+		schedule, err := parseCron(test.expr)
+
+		if err != nil {
+
+			t.Errorf("%q: %s", test.expr, err.Error())
+			continue
+		}
+
+		if got := schedule.next(test.from); !got.Equal(test.want) {
+
+			t.Errorf("%q after %s: got %s, want %s", test.expr, test.from.Format(time.RFC1123), got.Format(time.RFC1123), test.want.Format(time.RFC1123))
+		}
+	}
+}
+
+func TestParseCronRejects(t *testing.T) {
+
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+	} {
+
+		if _, err := parseCron(expr); err == nil {
+
+			t.Errorf("%q: parsed, want an error", expr)
+		}
+	}
+}
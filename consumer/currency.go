@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// Producers offer the same price in several currencies as separate prices, each with its own ID,
+// sharing a description and unit.
+
+// pricesInCurrency returns the prices in a currency, or every price if currency is empty
+func pricesInCurrency(prices []wpwtypes.Price, currency string) []wpwtypes.Price {
+
+	if currency == "" {
+
+		return prices
+	}
+
+	var matching []wpwtypes.Price
+
+	for _, price := range prices {
+
+		if price.PricePerUnit != nil && strings.EqualFold(price.PricePerUnit.CurrencyCode, currency) {
+
+			matching = append(matching, price)
+		}
+	}
+
+	return matching
+}
+
+// currenciesOf lists the currencies prices are offered in
+func currenciesOf(prices []wpwtypes.Price) []string {
+
+	seen := make(map[string]bool, 0)
+	var currencies []string
+
+	for _, price := range prices {
+
+		if price.PricePerUnit == nil || seen[price.PricePerUnit.CurrencyCode] {
+
+			continue
+		}
+
+		seen[price.PricePerUnit.CurrencyCode] = true
+		currencies = append(currencies, price.PricePerUnit.CurrencyCode)
+	}
+
+	sort.Strings(currencies)
+
+	return currencies
+}
+
+// findPrice returns the price with the given ID. If that price is in another currency, the same
+// price offered in the preferred currency is returned instead.
+func findPrice(prices []wpwtypes.Price, priceID int, currency string) (*wpwtypes.Price, error) {
+
+	var found *wpwtypes.Price
+
+	for i := range prices {
+
+		if prices[i].ID == priceID {
+
+			found = &prices[i]
+			break
+		}
+	}
+
+	if found == nil {
+
+		return nil, fmt.Errorf("specified price not found (%d)", priceID)
+	}
+
+	if currency == "" || strings.EqualFold(found.PricePerUnit.CurrencyCode, currency) {
+
+		return found, nil
+	}
+
+	for _, price := range pricesInCurrency(prices, currency) {
+
+		if price.Description == found.Description && price.UnitID == found.UnitID {
+
+			fmt.Printf("Price %d is in %s, using price %d in %s\n", priceID, found.PricePerUnit.CurrencyCode, price.ID, price.PricePerUnit.CurrencyCode)
+			return &price, nil
+		}
+	}
+
+	return nil, fmt.Errorf("price %d (%s) is not offered in %s, available currencies: %s", priceID, found.Description, strings.ToUpper(currency), strings.Join(currenciesOf(prices), ", "))
+}
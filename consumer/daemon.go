@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// scheduleConfig is the schedule file used by daemon mode
+type scheduleConfig struct {
+	DailySpendLimit int           `json:"dailySpendLimit"` // Minor units of each currency across all jobs, 0 = no limit
+	Jobs            []scheduleJob `json:"jobs"`
+}
+
+// scheduleJob is a purchase repeated on a cron schedule. A job either names a producer,
+// price and unit quantity, or sets cheapest with a duration to buy the cheapest offer.
+type scheduleJob struct {
+	Name         string `json:"name"`
+	Schedule     string `json:"schedule"`
+	ProducerUUID string `json:"producerUUID"`
+	ServiceID    int    `json:"serviceId"`
+	PriceID      int    `json:"priceId"`
+	UnitQuantity int    `json:"unitQuantity"`
+	Cheapest     bool   `json:"cheapest"`
+	Duration     int    `json:"duration"`
+	Colour       string `json:"colour"`
+	Currency     string `json:"currency"`
+
+	cron *cronSchedule
+}
+
+func loadSchedule(path string) (*scheduleConfig, error) {
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	var config scheduleConfig
+
+	if err := json.Unmarshal(data, &config); err != nil {
+
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	if len(config.Jobs) == 0 {
+
+		return nil, fmt.Errorf("%s has no jobs", path)
+	}
+
+	if config.DailySpendLimit < 0 {
+
+		return nil, errors.New("dailySpendLimit must not be negative")
+	}
+
+	names := make(map[string]bool, 0)
+
+	for i := range config.Jobs {
+
+		job := &config.Jobs[i]
+
+		if job.Name == "" {
+
+			return nil, fmt.Errorf("job %d has no name", i+1)
+		}
+
+		if names[job.Name] {
+
+			return nil, fmt.Errorf("duplicate job name %s", job.Name)
+		}
+
+		names[job.Name] = true
+
+		if job.cron, err = parseCron(job.Schedule); err != nil {
+
+			return nil, fmt.Errorf("job %s: %s", job.Name, err.Error())
+		}
+
+		if job.Cheapest {
+
+			if job.Duration <= 0 {
+
+				return nil, fmt.Errorf("job %s: cheapest jobs need a duration", job.Name)
+			}
+		} else if job.ProducerUUID == "" || (job.PriceID == 0 && job.Colour == "") || job.UnitQuantity <= 0 {
+
+			return nil, fmt.Errorf("job %s: producerUUID, priceId (or colour) and unitQuantity are required", job.Name)
+		}
+	}
+
+	return &config, nil
+}
+
+func (job *scheduleJob) order() *order {
+
+	return &order{
+		producerUUID: job.ProducerUUID,
+		serviceID:    job.ServiceID,
+		priceID:      job.PriceID,
+		unitQuantity: job.UnitQuantity,
+		cheapest:     job.Cheapest,
+		duration:     job.Duration,
+		reuseTokens:  flagReuseTokens,
+		colour:       job.Colour,
+		currency:     job.Currency,
+	}
+}
+
+// nextRun returns the earliest time after t at which any job is due, along with the jobs due then
+func (config *scheduleConfig) nextRun(t time.Time) (time.Time, []*scheduleJob) {
+
+	var next time.Time
+	var due []*scheduleJob
+
+	for i := range config.Jobs {
+
+		job := &config.Jobs[i]
+		jobNext := job.cron.next(t)
+
+		if jobNext.IsZero() {
+
+			continue
+		}
+
+		if next.IsZero() || jobNext.Before(next) {
+
+			next = jobNext
+			due = []*scheduleJob{job}
+		} else if jobNext.Equal(next) {
+
+			due = append(due, job)
+		}
+	}
+
+	return next, due
+}
+
+// runDaemon repeats the purchase flow for each job on its schedule until interrupted
+func runDaemon(schedulePath string, historyPath string) error {
+
+	config, err := loadSchedule(schedulePath)
+
+	if err != nil {
+
+		return err
+	}
+
+	history, err := loadPurchaseHistory(historyPath)
+
+	if err != nil {
+
+		return err
+	}
+
+	fmt.Printf("Daemon mode: %d jobs from %s, daily spend limit %dp\n", len(config.Jobs), schedulePath, config.DailySpendLimit)
+	for _, job := range config.Jobs {
+
+		fmt.Printf("\t%s: %s\n", job.Name, job.Schedule)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	for {
+
+		next, due := config.nextRun(time.Now())
+
+		if next.IsZero() {
+
+			return errors.New("no job in the schedule is ever due")
+		}
+
+		fmt.Printf("Next run at %s (%d jobs)\n", next.Format(time.RFC1123), len(due))
+
+		select {
+
+		case <-time.After(time.Until(next)):
+		case sig := <-stop:
+			fmt.Printf("Received %s, stopping daemon\n", sig)
+			return nil
+		}
+
+		for _, job := range due {
+
+			runJob(config, job, history)
+		}
+	}
+}
+
+// spendLimitReached reports whether what has been spent today leaves nothing of the daily spend limit
+func (config *scheduleConfig) spendLimitReached(spent int) bool {
+
+	return config.DailySpendLimit > 0 && spent >= config.DailySpendLimit
+}
+
+// checkQuote refuses a quote which would take the day's spending in its currency over the daily spend limit
+func (config *scheduleConfig) checkQuote(history *purchaseHistory, quote wpwtypes.TotalPriceResponse, now time.Time) error {
+
+	spent := history.spentOn(now, quote.CurrencyCode)
+
+	if config.DailySpendLimit > 0 && spent+quote.TotalPrice > config.DailySpendLimit {
+
+		return fmt.Errorf("quote of %d %s would exceed the daily spend limit of %d (spent %d %s)", quote.TotalPrice, quote.CurrencyCode, config.DailySpendLimit, spent, quote.CurrencyCode)
+	}
+
+	return nil
+}
+
+// runJob performs one scheduled purchase and records the outcome in the purchase history
+func runJob(config *scheduleConfig, job *scheduleJob, history *purchaseHistory) {
+
+	fmt.Printf("\n\n------------------------------------------\n")
+	fmt.Printf("Running job %s at %s\n", job.Name, time.Now().Format(time.RFC1123))
+
+	entry := historyEntry{
+		Time:         time.Now(),
+		Job:          job.Name,
+		ProducerUUID: job.ProducerUUID,
+		ServiceID:    job.ServiceID,
+		PriceID:      job.PriceID,
+		Units:        job.UnitQuantity,
+	}
+
+	// Until the quote is known, a job without a currency counts spending in every currency
+	spent := history.spentOn(time.Now(), job.Currency)
+	limitReached := false
+
+	if unresolved := payments.unresolved(); len(unresolved) > 0 {
+
+		entry.Outcome = historySkipped
+		entry.Error = fmt.Sprintf("payment %s has an unknown outcome, resolve it with -resolvepayment", unresolved[0].Reference)
+	} else if config.spendLimitReached(spent) {
+
+		entry.Outcome = historySkipped
+		entry.Error = fmt.Sprintf("daily spend limit of %dp reached (spent %dp)", config.DailySpendLimit, spent)
+	} else {
+
+		o := job.order()
+		o.approve = func(quote wpwtypes.TotalPriceResponse) error {
+
+			err := config.checkQuote(history, quote, time.Now())
+			limitReached = err != nil
+
+			return err
+		}
+
+		p, err := placeOrder(o)
+
+		if p != nil {
+
+			entry.ProducerUUID = p.device.ServerID
+			entry.PriceID = p.price.ID
+			entry.Units = p.units
+			entry.TotalPaid = p.payment.TotalPaid
+			entry.Currency = p.quote.CurrencyCode
+			entry.Reference = p.quote.PaymentReferenceID
+
+			if p.reused != nil {
+
+				entry.Reference = p.reused.Reference
+			}
+		}
+
+		if err != nil {
+
+			entry.Outcome = historyFailed
+			entry.Error = err.Error()
+
+			if limitReached {
+
+				entry.Outcome = historySkipped
+			}
+		} else {
+
+			entry.Outcome = historyDelivered
+		}
+	}
+
+	fmt.Printf("Job %s %s", job.Name, entry.Outcome)
+	if entry.Error != "" {
+
+		fmt.Printf(": %s", entry.Error)
+	}
+	fmt.Println()
+
+	log.WithFields(log.Fields{"job": job.Name, "outcome": entry.Outcome, "paid": entry.TotalPaid}).Info(entry.Error)
+
+	if err := history.append(entry); err != nil {
+
+		fmt.Printf("Failed to record purchase history: %s\n", err.Error())
+	}
+}
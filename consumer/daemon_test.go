@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+func TestDailySpendLimit(t *testing.T) {
+
+	now := minute(0, "12:00")
+
+	// 60 GBP and 500 EUR paid today, 900 GBP yesterday
+	history := &purchaseHistory{entries: []historyEntry{
+		{Time: minute(0, "08:00"), TotalPaid: 40, Currency: "GBP"},
+		{Time: minute(0, "11:59"), TotalPaid: 20, Currency: "gbp"},
+		{Time: minute(0, "09:00"), TotalPaid: 500, Currency: "EUR"},
+		{Time: minute(-1, "23:59"), TotalPaid: 900, Currency: "GBP"},
+	}}
+
+	tests := []struct {
+		name     string
+		limit    int
+		currency string
+		total    int
+		reached  bool
+		approved bool
+	}{
+		{"under the limit", 100, "GBP", 39, false, true},
+		{"up to the limit", 100, "GBP", 40, false, true},
+		{"over the limit", 100, "GBP", 41, false, false},
+		{"limit in another currency", 100, "EUR", 1, true, false},
+		{"currency not yet spent in", 100, "USD", 100, false, true},
+		{"no limit", 0, "EUR", 10000, false, true},
+	}
+
+	for _, test := range tests {
+
+		config := &scheduleConfig{DailySpendLimit: test.limit}
+		quote := wpwtypes.TotalPriceResponse{TotalPrice: test.total, CurrencyCode: test.currency}
+
+		if reached := config.spendLimitReached(history.spentOn(now, test.currency)); reached != test.reached {
+
+			t.Errorf("%s: limit reached %t, want %t", test.name, reached, test.reached)
+		}
+
+		if err := config.checkQuote(history, quote, now); (err == nil) != test.approved {
+
+			t.Errorf("%s: quote of %d %s refused with %v, want approved %t", test.name, test.total, test.currency, err, test.approved)
+		}
+	}
+
+	// Before the quote is known, spending in every currency counts against the limit
+	config := &scheduleConfig{DailySpendLimit: 560}
+
+	if !config.spendLimitReached(history.spentOn(now, "")) {
+
+		t.Errorf("spent %d today in all currencies, want the limit of 560 reached", history.spentOn(now, ""))
+	}
+
+	// Yesterday's spending does not count today
+	if spent := history.spentOn(now.Add(-24*time.Hour), "GBP"); spent != 900 {
+
+		t.Errorf("spent yesterday: got %d, want 900", spent)
+	}
+}
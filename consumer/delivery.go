@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// Delivery states reported by the producer
+const (
+	deliveryCompleted string = "completed"
+	deliveryAborted   string = "aborted"
+)
+
+// statusGrace is how long to wait for a delivery to show up, and past its end for it to finish
+const statusGrace = 30 * time.Second
+
+// statusPollInterval is how often the producer is asked for the delivery status
+const statusPollInterval = time.Second
+
+// deliveryStatus is the producer's view of a delivery, from its status port
+type deliveryStatus struct {
+	TokenKey       string    `json:"tokenKey"`
+	Delivery       int       `json:"delivery"` // Counts the deliveries begun on the token, 0 from producers which do not count
+	ServiceID      int       `json:"serviceId"`
+	PriceID        int       `json:"priceId"`
+	State          string    `json:"state"` // started, running, completed or aborted
+	UnitsRequested int       `json:"unitsRequested"`
+	UnitsDelivered int       `json:"unitsDelivered"`
+	Started        time.Time `json:"started"`
+	Ends           time.Time `json:"ends"`
+	Ended          time.Time `json:"ended"`
+	Reason         string    `json:"reason"`
+}
+
+func (status *deliveryStatus) finished() bool {
+
+	return status.State == deliveryCompleted || status.State == deliveryAborted
+}
+
+// short reports whether fewer units were delivered than were asked for
+func (status *deliveryStatus) short(units int) bool {
+
+	return status.State == deliveryAborted || status.UnitsDelivered < units
+}
+
+// lastDelivery returns the number of the latest delivery the producer knows of on the token, 0 if none.
+// Asked before beginning a delivery, so the status of an earlier delivery on a reused token is not
+// taken for the new one's.
+func lastDelivery(device wpwtypes.BroadcastMessage, tokenKey string) int {
+
+	if flagStatusPort <= 0 {
+
+		return 0
+	}
+
+	statusURL := fmt.Sprintf("http://%s:%d/deliveries/%s", device.Hostname, flagStatusPort, url.PathEscape(tokenKey))
+	status, err := getDeliveryStatus(&http.Client{Timeout: 5 * time.Second}, statusURL)
+
+	if err != nil || status == nil {
+
+		return 0
+	}
+
+	return status.Delivery
+}
+
+// confirmDelivery follows a delivery on the producer's status port until it ends, ignoring deliveries on
+// the token up to number after. A delivery short of the units asked for is recorded as a dispute on the
+// receipt for the payment. Not hearing from the producer is reported as an error, but is not a dispute,
+// as nothing is known about the delivery.
+func confirmDelivery(device wpwtypes.BroadcastMessage, reference string, tokenKey string, units int, after int) (*deliveryStatus, error) {
+
+	statusURL := fmt.Sprintf("http://%s:%d/deliveries/%s", device.Hostname, flagStatusPort, url.PathEscape(tokenKey))
+	client := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(statusGrace)
+	state := ""
+
+	var status *deliveryStatus
+	var lastErr error
+
+	for time.Now().Before(deadline) {
+
+		status, lastErr = getDeliveryStatus(client, statusURL)
+
+		// Still the earlier delivery, this one has not shown up yet
+		if status != nil && status.Delivery != 0 && status.Delivery <= after {
+
+			status, lastErr = nil, fmt.Errorf("producer has not begun delivery %d on the token", after+1)
+		}
+
+		if status != nil {
+
+			if status.State != state {
+
+				state = status.State
+				fmt.Printf("Delivery %s: %d of %d units delivered\n", state, status.UnitsDelivered, status.UnitsRequested)
+			}
+
+			if status.finished() {
+
+				break
+			}
+
+			if !status.Ends.IsZero() {
+
+				deadline = status.Ends.Add(statusGrace)
+			}
+		}
+
+		time.Sleep(statusPollInterval)
+	}
+
+	if status == nil || !status.finished() {
+
+		if lastErr == nil {
+
+			lastErr = fmt.Errorf("delivery did not finish by %s", deadline.Format(time.RFC3339))
+		}
+
+		return status, fmt.Errorf("delivery status for token %s: %s", tokenKey, lastErr.Error())
+	}
+
+	if !status.short(units) {
+
+		return status, nil
+	}
+
+	d := dispute{
+		Time:           time.Now(),
+		TokenKey:       tokenKey,
+		State:          status.State,
+		UnitsRequested: units,
+		UnitsDelivered: status.UnitsDelivered,
+		Reason:         status.Reason,
+	}
+
+	fmt.Printf("Delivery was short, %d of %d units delivered (%s). Recording a dispute on receipt %s\n", status.UnitsDelivered, units, status.Reason, reference)
+
+	if err := receipts.dispute(reference, d); err != nil {
+
+		return status, fmt.Errorf("record dispute for %s: %s", reference, err.Error())
+	}
+
+	return status, nil
+}
+
+// getDeliveryStatus returns the delivery status, or nil while the producer does not know of the delivery
+func getDeliveryStatus(client *http.Client, statusURL string) (*deliveryStatus, error) {
+
+	resp, err := client.Get(statusURL)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+
+		return nil, fmt.Errorf("producer has no delivery for the token")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+
+		return nil, fmt.Errorf("producer answered %s", resp.Status)
+	}
+
+	var status deliveryStatus
+
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// reportDelivery tells the user how the delivery went, following it on the producer's status port
+// unless -statusport is 0. after is lastDelivery from before the delivery began.
+func reportDelivery(device wpwtypes.BroadcastMessage, reference string, tokenKey string, after int, serviceName string, units int, unitDescription string) {
+
+	if flagStatusPort <= 0 {
+
+		fmt.Printf("%s should be powered on for %d * %s\n", serviceName, units, unitDescription)
+		return
+	}
+
+	fmt.Printf("Following delivery of %s for %d * %s\n", serviceName, units, unitDescription)
+
+	status, err := confirmDelivery(device, reference, tokenKey, units, after)
+
+	if err != nil {
+
+		fmt.Printf("Could not confirm delivery: %s\n", err.Error())
+		return
+	}
+
+	if status.short(units) {
+
+		fmt.Printf("%s delivered %d of %d * %s, dispute recorded\n", serviceName, status.UnitsDelivered, units, unitDescription)
+		return
+	}
+
+	fmt.Printf("%s delivered all %d * %s\n", serviceName, units, unitDescription)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// Purchase history outcomes
+const (
+	historyDelivered string = "delivered"
+	historyFailed    string = "failed"
+	historySkipped   string = "skipped" // not attempted, e.g. the daily spend limit was reached
+)
+
+// historyEntry records one scheduled run of the consumer
+type historyEntry struct {
+	Time         time.Time `json:"time"`
+	Job          string    `json:"job"`
+	ProducerUUID string    `json:"producerUuid,omitempty"`
+	ServiceID    int       `json:"serviceId"`
+	PriceID      int       `json:"priceId,omitempty"`
+	Units        int       `json:"units,omitempty"`
+	TotalPaid    int       `json:"totalPaid"`
+	Currency     string    `json:"currency,omitempty"`
+	Reference    string    `json:"reference,omitempty"`
+	Outcome      string    `json:"outcome"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// purchaseHistory is an append only JSON lines file of scheduled runs
+type purchaseHistory struct {
+	path    string
+	entries []historyEntry
+}
+
+func loadPurchaseHistory(path string) (*purchaseHistory, error) {
+
+	history := &purchaseHistory{path: path}
+
+	f, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+
+		return history, nil
+	} else if err != nil {
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+
+		if len(scanner.Bytes()) == 0 {
+
+			continue
+		}
+
+		var entry historyEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+
+			return nil, err
+		}
+
+		history.entries = append(history.entries, entry)
+	}
+
+	return history, scanner.Err()
+}
+
+func (history *purchaseHistory) append(entry historyEntry) error {
+
+	data, err := json.Marshal(entry)
+
+	if err != nil {
+
+		return err
+	}
+
+	f, err := os.OpenFile(history.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+
+		return err
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+
+		return err
+	}
+
+	history.entries = append(history.entries, entry)
+
+	return nil
+}
+
+// spentOn totals the amount paid in a currency on the local calendar day of t. An empty currency
+// totals every currency.
+func (history *purchaseHistory) spentOn(t time.Time, currency string) int {
+
+	year, month, day := t.Date()
+	total := 0
+
+	for _, entry := range history.entries {
+
+		y, m, d := entry.Time.Local().Date()
+
+		if y == year && m == month && d == day && (currency == "" || strings.EqualFold(entry.Currency, currency)) {
+
+			total += entry.TotalPaid
+		}
+	}
+
+	return total
+}
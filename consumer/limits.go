@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// splitLimits returns a price description without its limits, and the fewest and most units
+// that can be bought. max is 0 when there is no maximum.
+func splitLimits(description string) (string, int, int) {
+
+	i := strings.LastIndex(description, unitsMarker)
+
+	if i < 0 || !strings.HasSuffix(description, "]") {
+
+		return description, 0, 0
+	}
+
+	limits := description[i+len(unitsMarker) : len(description)-1]
+	base := description[:i]
+
+	if strings.HasSuffix(limits, "+") {
+
+		min, err := strconv.Atoi(strings.TrimSuffix(limits, "+"))
+
+		if err != nil {
+
+			return description, 0, 0
+		}
+
+		return base, min, 0
+	}
+
+	parts := strings.Split(limits, "-")
+
+	if len(parts) != 2 {
+
+		return description, 0, 0
+	}
+
+	min, err := strconv.Atoi(parts[0])
+
+	if err != nil {
+
+		return description, 0, 0
+	}
+
+	max, err := strconv.Atoi(parts[1])
+
+	if err != nil {
+
+		return description, 0, 0
+	}
+
+	return base, min, max
+}
+
+// checkUnitLimits returns an error if units is outside the limits the producer set for the price
+func checkUnitLimits(price *wpwtypes.Price, units int) error {
+
+	_, min, max := splitLimits(price.Description)
+
+	if units < min {
+
+		return fmt.Errorf("price %d needs at least %d %s units, not %d", price.ID, min, price.UnitDescription, units)
+	}
+
+	if max > 0 && units > max {
+
+		return fmt.Errorf("price %d allows at most %d %s units, not %d", price.ID, max, price.UnitDescription, units)
+	}
+
+	return nil
+}
+
+// volumePrice returns the price to buy units at. Producers sell volume discounts as prices of their own,
+// with the same description and unit as the price they discount but limits covering larger quantities,
+// so the cheapest of those which allows the quantity is used. The chosen price is returned if none does.
+func volumePrice(prices []wpwtypes.Price, chosen *wpwtypes.Price, units int) *wpwtypes.Price {
+
+	description, _, _ := splitLimits(chosen.Description)
+	best := chosen
+
+	for i := range prices {
+
+		price := &prices[i]
+
+		if base, _, _ := splitLimits(price.Description); base != description || price.UnitID != chosen.UnitID || price.PricePerUnit == nil {
+
+			continue
+		}
+
+		if !strings.EqualFold(price.PricePerUnit.CurrencyCode, chosen.PricePerUnit.CurrencyCode) || checkUnitLimits(price, units) != nil {
+
+			continue
+		}
+
+		if checkUnitLimits(best, units) != nil || price.PricePerUnit.Amount < best.PricePerUnit.Amount {
+
+			best = price
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// The descriptions here are the ones producer/catalog_test.go expects producers to send
+func TestSplitLimits(t *testing.T) {
+
+	tests := []struct {
+		description string
+		base        string
+		min         int
+		max         int
+	}{
+		{"Turn on the red LED", "Turn on the red LED", 0, 0},
+		{"Turn on the red LED [units: 1-600]", "Turn on the red LED", 1, 600},
+		{"Turn on the red LED [units: 5-120]", "Turn on the red LED", 5, 120},
+		{"Turn on the red LED [units: 5+]", "Turn on the red LED", 5, 0},
+		{"Turn on the red LED [units: 30-30]", "Turn on the red LED", 30, 30},
+		{"Purple (255,0,255) [units: 1-600]", "Purple (255,0,255)", 1, 600},
+		{"Odd [units: 1-600] description", "Odd [units: 1-600] description", 0, 0},
+		{"Broken [units: x-600]", "Broken [units: x-600]", 0, 0},
+		{"Broken [units: 5]", "Broken [units: 5]", 0, 0},
+	}
+
+	for _, test := range tests {
+
+		base, min, max := splitLimits(test.description)
+
+		if base != test.base || min != test.min || max != test.max {
+
+			t.Errorf("%q: got %q %d-%d, want %q %d-%d", test.description, base, min, max, test.base, test.min, test.max)
+		}
+	}
+}
+
+func TestColourOfIgnoresLimits(t *testing.T) {
+
+	tests := []struct {
+		description string
+		name        string
+		rgb         [3]int
+	}{
+		{"Purple (255,0,255)", "Purple", [3]int{255, 0, 255}},
+		{"Purple (255,0,255) [units: 1-600]", "Purple", [3]int{255, 0, 255}},
+		{"White (255, 255, 255) [units: 5+]", "White", [3]int{255, 255, 255}},
+	}
+
+	for _, test := range tests {
+
+		name, rgb, ok := colourOf(test.description)
+
+		if !ok || name != test.name || rgb != test.rgb {
+
+			t.Errorf("%q: got %q %v %t, want %q %v", test.description, name, rgb, ok, test.name, test.rgb)
+		}
+	}
+}
+
+func priceWithLimits(id int, description string, amount int) wpwtypes.Price {
+
+	return wpwtypes.Price{
+		ID:              id,
+		Description:     description,
+		UnitID:          1,
+		UnitDescription: "Second",
+		PricePerUnit:    &wpwtypes.PricePerUnit{Amount: amount, CurrencyCode: "GBP"},
+	}
+}
+
+func TestCheckUnitLimits(t *testing.T) {
+
+	price := priceWithLimits(1, "Turn on the red LED [units: 5-120]", 10)
+
+	tests := []struct {
+		units int
+		ok    bool
+	}{
+		{4, false},
+		{5, true},
+		{120, true},
+		{121, false},
+	}
+
+	for _, test := range tests {
+
+		if err := checkUnitLimits(&price, test.units); (err == nil) != test.ok {
+
+			t.Errorf("%d units: got %v, want ok %t", test.units, err, test.ok)
+		}
+	}
+}
+
+func TestVolumePrice(t *testing.T) {
+
+	// Price 1 with two volume tiers, as a producer with volume rules at 30 and 120 units sells it
+	prices := []wpwtypes.Price{
+		priceWithLimits(1, "Turn on the red LED [units: 1-29]", 100),
+		priceWithLimits(1001, "Turn on the red LED [units: 30-119]", 95),
+		priceWithLimits(1002, "Turn on the red LED [units: 120-600]", 85),
+		priceWithLimits(2, "Turn on the blue LED", 50),
+	}
+
+	tests := []struct {
+		units int
+		want  int
+	}{
+		{10, 1},
+		{29, 1},
+		{30, 1001},
+		{119, 1001},
+		{120, 1002},
+		{601, 1}, // Nothing allows it, so the chosen price is kept and its limits refuse the order
+	}
+
+	for _, test := range tests {
+
+		if got := volumePrice(prices, &prices[0], test.units); got.ID != test.want {
+
+			t.Errorf("%d units: got price %d, want %d", test.units, got.ID, test.want)
+		}
+	}
+}
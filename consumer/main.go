@@ -5,12 +5,11 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rifflock/lfshook"
 	log "github.com/sirupsen/logrus"
 	"github.com/wptechinnovation/wpw-sdk-go/wpwithin"
-	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/psp"
-	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/psp/onlineworldpay"
 	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
 )
 
@@ -21,10 +20,30 @@ var flagPriceID int
 var flagUnitQuantity int
 var flagDiscoveryTimeout int
 var flagInteractive bool
+var flagCheapest bool
+var flagDuration int
+var flagStepTimeout int
+var flagRetries int
+var flagRetryBackoff int
+var flagRetryConfig string
+var flagPaymentJournal string
+var flagResolvePayment string
+var flagSchedule string
+var flagHistory string
+var flagReceipts string
+var flagTokens string
+var flagReuseTokens bool
+var flagDeliverUnits int
+var flagColour string
+var flagCurrency string
+var flagStatusPort int
 
 // Application Vars
 var wpw wpwithin.WPWithin
 var hceCard *wpwtypes.HCECard
+var payments *paymentJournal
+var receipts *receiptStore
+var tokens *tokenStore
 
 func init() {
 
@@ -34,6 +53,23 @@ func init() {
 	flag.IntVar(&flagUnitQuantity, "unitquantity", 2, "Unit quantity")
 	flag.IntVar(&flagDiscoveryTimeout, "discoverytimeout", 20000, "Device discovery timeout (millis)")
 	flag.BoolVar(&flagInteractive, "interactive", false, "Interactive mode - prompt for carriage return between steps")
+	flag.BoolVar(&flagCheapest, "cheapest", false, "Query all discovered producers and buy the cheapest offer for -duration")
+	flag.IntVar(&flagDuration, "duration", 30, "Requested service duration in seconds (used with -cheapest)")
+	flag.IntVar(&flagStepTimeout, "steptimeout", 30000, "Timeout for each SDK step attempt (millis), 0 = no timeout")
+	flag.IntVar(&flagRetries, "retries", 2, "Number of retries for a failed SDK step (payments are never retried)")
+	flag.IntVar(&flagRetryBackoff, "retrybackoff", 1000, "Initial backoff between retries (millis), doubled on each retry")
+	flag.StringVar(&flagRetryConfig, "retryconfig", "", "JSON file of per step timeout/retry/backoff overrides")
+	flag.StringVar(&flagPaymentJournal, "paymentjournal", "payments.json", "File recording every payment attempt")
+	flag.StringVar(&flagResolvePayment, "resolvepayment", "", "Mark a payment with an unknown outcome as checked, by reference")
+	flag.StringVar(&flagSchedule, "schedule", "", "Run as a daemon, repeating the purchases in this schedule file")
+	flag.StringVar(&flagHistory, "history", "history.jsonl", "Purchase history file used by daemon mode")
+	flag.StringVar(&flagReceipts, "receipts", "receipts.json", "File holding the receipts of successful payments")
+	flag.StringVar(&flagTokens, "tokens", "tokens.json", "File holding delivery tokens from earlier payments")
+	flag.BoolVar(&flagReuseTokens, "reusetokens", true, "Deliver using an unexpired held token with enough units left instead of paying again")
+	flag.IntVar(&flagDeliverUnits, "deliverunits", 0, "Units to deliver now, leaving the rest on the token for later (0 = all)")
+	flag.StringVar(&flagColour, "colour", "", "Colour mix services: colour name (e.g. purple) or r,g,b triple, used instead of -priceid")
+	flag.IntVar(&flagStatusPort, "statusport", 8089, "Producer status port, to check quotes before paying and follow deliveries, recording a dispute when one is short (0 = do not use)")
+	flag.StringVar(&flagCurrency, "currency", "", "Only buy prices in this currency, e.g. EUR, choosing the same price in this currency when -priceid is in another")
 }
 
 func main() {
@@ -43,160 +79,112 @@ func main() {
 
 	flag.Parse()
 
-	if strings.EqualFold(flagProducerUUID, "") {
+	// Subcommands follow the flags, e.g. consumer -receipts r.json receipts list
+	if flag.NArg() > 0 {
 
-		fmt.Println("Producer UUID is not set")
-		fmt.Println("Please specify -produceruuid <....>")
-		os.Exit(1)
-	}
-
-	err = performSetup()
-	errCheck(err, "performSetup()")
-
-	_wpw, err := wpwithin.Initialise("pi-led-consumer", "Worldpay Within Pi LED Demo - Consumer", "")
-	wpw = _wpw
-
-	errCheck(err, "WorldpayWithin Initialise")
-
-	printConsumerOverview()
-	promptContinue()
-	doConsumeService()
-}
+		switch flag.Arg(0) {
 
-func doConsumeService() {
+		case "receipts":
+			err = runReceiptsCommand(flag.Args()[1:])
+			errCheck(err, "receipts")
+		case "tokens":
+			err = runTokensCommand(flag.Args()[1:])
+			errCheck(err, "tokens")
+		default:
+			fmt.Printf("Unknown command %s\n", flag.Arg(0))
+			os.Exit(1)
+		}
 
-	// Device discovery
-	fmt.Printf("Performing device discovery with timeout %dms\n", flagDiscoveryTimeout)
-	bm, err := wpw.DeviceDiscovery(flagDiscoveryTimeout)
-	errCheck(err, "wpw.DeviceDiscovery()")
+		return
+	}
 
-	fmt.Printf("Found %d devices, filtering on device with UUID = %s\n", len(bm), flagProducerUUID)
+	receipts, err = loadReceipts(flagReceipts)
+	errCheck(err, "loadReceipts()")
 
-	var selectedBM *wpwtypes.BroadcastMessage
-	for _, bm := range bm {
+	tokens, err = loadTokens(flagTokens)
+	errCheck(err, "loadTokens()")
 
-		if strings.EqualFold(bm.ServerID, flagProducerUUID) {
+	payments, err = loadPaymentJournal(flagPaymentJournal)
+	errCheck(err, "loadPaymentJournal()")
 
-			fmt.Printf("Found required device %s - %s\n", bm.DeviceDescription, bm.ServerID)
+	if !strings.EqualFold(flagResolvePayment, "") {
 
-			selectedBM = &bm
-			break
-		}
+		err = payments.resolve(flagResolvePayment)
+		errCheck(err, "resolve payment")
+		fmt.Printf("Payment %s marked as resolved\n", flagResolvePayment)
+		os.Exit(0)
 	}
 
-	if selectedBM == nil {
+	daemon := !strings.EqualFold(flagSchedule, "")
 
-		fmt.Printf("Specified producer not found (%s)\n", flagProducerUUID)
+	if daemon && flagInteractive {
+
+		fmt.Println("-interactive cannot be used with -schedule")
 		os.Exit(1)
 	}
 
-	var pspConfig = make(map[string]string, 0)
-	pspConfig[psp.CfgPSPName] = onlineworldpay.PSPName
-	pspConfig[onlineworldpay.CfgAPIEndpoint] = "https://api.worldpay.com/v1"
-
-	fmt.Printf("Setting up connection with %s\n", selectedBM.DeviceDescription)
-	fmt.Printf("\n\n")
-
-	err = wpw.InitConsumer(selectedBM.Scheme, selectedBM.Hostname, selectedBM.PortNumber, selectedBM.URLPrefix, "123", hceCard, pspConfig)
-	errCheck(err, "wpw.InitConsumer()")
-	fmt.Println("Requesting services..")
-	// Service discovery
-	svcs, err := wpw.RequestServices()
-	errCheck(err, "wpw.RequestServices()")
-
-	var selectedSVC *wpwtypes.ServiceDetails
-	for _, svc := range svcs {
+	if unresolved := payments.unresolved(); len(unresolved) > 0 && !daemon {
 
-		if svc.ServiceID == flagServiceID {
+		fmt.Println("Refusing to make new purchases while earlier payments have an unknown outcome:")
+		for _, attempt := range unresolved {
 
-			fmt.Printf("Found required service %d - %s\n", flagServiceID, svc.ServiceName)
-			selectedSVC = &svc
-			break
+			fmt.Printf("\t%s - %s %dp at %s (%s)\n", attempt.Reference, attempt.Currency, attempt.TotalPrice, attempt.Updated.Format(time.RFC3339), attempt.Error)
 		}
-	}
-
-	if selectedSVC == nil {
-
-		fmt.Printf("Specified service not found (%d)\n", flagServiceID)
+		fmt.Println("Check these payments with Worldpay, then run with -resolvepayment <reference>")
 		os.Exit(1)
 	}
 
-	fmt.Printf("\n\n")
+	if !strings.EqualFold(flagRetryConfig, "") {
 
-	// Price discovery
-	fmt.Println("Requesting service prices..")
-	svcPrices, err := wpw.GetServicePrices(selectedSVC.ServiceID)
-	errCheck(err, "wpw.GetServicePrices()")
-
-	var selectedPrice *wpwtypes.Price
-	for _, price := range svcPrices {
-
-		if price.ID == flagPriceID {
-
-			fmt.Printf("Found required price %d - %s @%s %dp per %s\n", flagServiceID, price.Description, price.PricePerUnit.CurrencyCode, price.PricePerUnit.Amount, price.UnitDescription)
-			selectedPrice = &price
-			break
-		}
+		err = loadStepPolicies(flagRetryConfig)
+		errCheck(err, "loadStepPolicies()")
 	}
 
-	if selectedPrice == nil {
+	if !daemon && !flagCheapest && strings.EqualFold(flagProducerUUID, "") {
 
-		fmt.Printf("Specified price not found (%d)\n", flagPriceID)
+		fmt.Println("Producer UUID is not set")
+		fmt.Println("Please specify -produceruuid <....>")
 		os.Exit(1)
 	}
 
-	promptContinue()
-	fmt.Printf("\n\n")
-
-	// Service + price selection
-	fmt.Println("Selecting service and price.. Getting quote for:")
-	fmt.Printf("%s - %d units of %s @ %s %dp per unit\n", selectedPrice.Description, flagUnitQuantity, selectedPrice.UnitDescription, selectedPrice.PricePerUnit.CurrencyCode, selectedPrice.PricePerUnit.Amount)
-	fmt.Println()
-	totalPriceResponse, err := wpw.SelectService(selectedSVC.ServiceID, flagUnitQuantity, selectedPrice.ID)
-	errCheck(err, "wpw.SelectService()")
-
-	fmt.Println("TotalPriceResponse:")
-	fmt.Printf("Total price %dp\n", totalPriceResponse.TotalPrice)
-	fmt.Printf("Merchant Public Key: %s\n", totalPriceResponse.MerchantClientKey)
-	fmt.Printf("Currency: %s\n", totalPriceResponse.CurrencyCode)
-	fmt.Printf("Reference: %s\n", totalPriceResponse.PaymentReferenceID)
-	fmt.Printf("Units to supply: %d\n", totalPriceResponse.UnitsToSupply)
-
-	promptContinue()
-	fmt.Printf("\n\n")
+	err = performSetup()
+	errCheck(err, "performSetup()")
 
-	// Payment request
-	fmt.Printf("Proceed to make payment of %dp\n", totalPriceResponse.TotalPrice)
-	fmt.Printf("Payment card for %s %s, number %s, with expiry %d/%d\n", hceCard.FirstName, hceCard.LastName, hceCard.CardNumber, hceCard.ExpMonth, hceCard.ExpYear)
-	paymentResponse, err := wpw.MakePayment(totalPriceResponse)
-	errCheck(err, "wpw.MakePayment()")
+	_wpw, err := wpwithin.Initialise("pi-led-consumer", "Worldpay Within Pi LED Demo - Consumer", "")
+	wpw = _wpw
 
-	fmt.Println("Worldpay Within payment successful")
+	errCheck(err, "WorldpayWithin Initialise")
 
-	fmt.Printf("\n\n")
+	if daemon {
 
-	fmt.Println("PaymentResponse:")
-	fmt.Printf("Total paid: %dp\n", paymentResponse.TotalPaid)
-	fmt.Printf("DeliveryToken - Key: %s\n", paymentResponse.ServiceDeliveryToken.Key)
-	fmt.Printf("DeliveryToken - Issued: %s\n", paymentResponse.ServiceDeliveryToken.Issued)
-	fmt.Printf("DeliveryToken - Expiry: %s\n", paymentResponse.ServiceDeliveryToken.Expiry)
-	fmt.Printf("DeliveryToken - Refund on expiry: %t\n", paymentResponse.ServiceDeliveryToken.RefundOnExpiry)
+		err = runDaemon(flagSchedule, flagHistory)
+		errCheck(err, "runDaemon()")
+		return
+	}
 
+	printConsumerOverview()
 	promptContinue()
-	fmt.Printf("\n\n")
 
-	// Begin service delivery
+	doConsumeService()
+}
 
-	fmt.Println("Proceed to begin service delivery (Turn on the LED)")
+func doConsumeService() {
 
-	promptContinue()
-	fmt.Printf("\n\n")
+	o := &order{
+		producerUUID: flagProducerUUID,
+		serviceID:    flagServiceID,
+		priceID:      flagPriceID,
+		unitQuantity: flagUnitQuantity,
+		cheapest:     flagCheapest,
+		duration:     flagDuration,
+		deliverUnits: flagDeliverUnits,
+		reuseTokens:  flagReuseTokens,
+		colour:       flagColour,
+		currency:     flagCurrency,
+	}
 
-	_, err = wpw.BeginServiceDelivery(selectedSVC.ServiceID, *paymentResponse.ServiceDeliveryToken, flagUnitQuantity)
-	errCheck(err, "wpw.BeginServiceDelivery()")
-	fmt.Printf("\n\n")
-	fmt.Printf("%s should be powered on for %d * %s\n", selectedSVC.ServiceName, flagUnitQuantity, selectedPrice.UnitDescription)
-	fmt.Printf("\n\n")
+	_, err := placeOrder(o)
+	errCheck(err, "placeOrder()")
 }
 
 func performSetup() error {
@@ -248,10 +236,22 @@ func initLog() error {
 func printConsumerOverview() {
 
 	fmt.Printf("Device discovery timeout: %dms\n", flagDiscoveryTimeout)
-	fmt.Printf("Device UUID filter: %s\n", flagProducerUUID)
 	fmt.Printf("Service ID filter: %d\n", flagServiceID)
-	fmt.Printf("Price ID filter %d\n", flagPriceID)
-	fmt.Printf("Order quantity: %d\n", flagUnitQuantity)
+
+	if flagCurrency != "" {
+
+		fmt.Printf("Currency filter: %s\n", strings.ToUpper(flagCurrency))
+	}
+
+	if flagCheapest {
+
+		fmt.Printf("Cheapest offer for duration: %ds\n", flagDuration)
+	} else {
+
+		fmt.Printf("Device UUID filter: %s\n", flagProducerUUID)
+		fmt.Printf("Price ID filter %d\n", flagPriceID)
+		fmt.Printf("Order quantity: %d\n", flagUnitQuantity)
+	}
 
 	fmt.Printf("------------------------------------------\n\n\n")
 }
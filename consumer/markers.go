@@ -0,0 +1,14 @@
+package main
+
+// The SDK's services and prices only carry names, descriptions and amounts, so producers add what
+// consumers need to know before asking for a quote to the end of a description as a marker:
+//   - "Turn on the red LED [unavailable: maintenance]" on a service which cannot be bought right now,
+//     read by checkAvailable
+//   - "Turn on the red LED [units: 1-600]" or "[units: 5+]" on a price with purchase limits, read by
+//     splitLimits and stripped before a description is shown or matched, e.g. by colourOf
+//
+// The producer writes them in producer/sdk.go.
+const (
+	unavailableMarker = " [unavailable: "
+	unitsMarker       = " [units: "
+)
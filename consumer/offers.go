@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// unitSeconds maps the price unit descriptions used by the producers onto seconds
+var unitSeconds = map[string]int{
+	"second": 1,
+	"minute": 60,
+}
+
+// offer is a single price from a single producer, costed against the requested duration
+type offer struct {
+	device    wpwtypes.BroadcastMessage
+	service   wpwtypes.ServiceDetails
+	price     wpwtypes.Price
+	units     int
+	totalCost int
+}
+
+// newOffer costs a price against a duration in seconds, rounding the number of units up
+// so that at least the requested duration is bought.
+func newOffer(device wpwtypes.BroadcastMessage, svc wpwtypes.ServiceDetails, price wpwtypes.Price, durationSeconds int) (*offer, error) {
+
+	secs, ok := unitSeconds[strings.ToLower(price.UnitDescription)]
+
+	if !ok {
+
+		return nil, fmt.Errorf("unsupported price unit %q", price.UnitDescription)
+	}
+
+	if price.PricePerUnit == nil {
+
+		return nil, errors.New("price has no price per unit")
+	}
+
+	units := (durationSeconds + secs - 1) / secs
+	_, min, max := splitLimits(price.Description)
+
+	if max > 0 && units > max {
+
+		return nil, fmt.Errorf("%d units needed, at most %d can be bought", units, max)
+	}
+
+	// Buying the minimum still covers the duration
+	if units < min {
+
+		units = min
+	}
+
+	return &offer{
+		device:    device,
+		service:   svc,
+		price:     price,
+		units:     units,
+		totalCost: units * price.PricePerUnit.Amount,
+	}, nil
+}
+
+// placeCheapestOrder collects offers from every discovered producer and buys the cheapest
+func placeCheapestOrder(o *order) (*purchase, error) {
+
+	if o.duration <= 0 {
+
+		return nil, errors.New("duration must be greater than zero")
+	}
+
+	devices, err := discoverDevices()
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	fmt.Printf("Found %d devices, collecting offers for service %d\n", len(devices), o.serviceID)
+
+	offers := collectOffers(devices, o.serviceID, o.duration, o.currency)
+
+	if len(offers) == 0 && o.currency != "" {
+
+		return nil, fmt.Errorf("no producer offers service %d in %s", o.serviceID, strings.ToUpper(o.currency))
+	} else if len(offers) == 0 {
+
+		return nil, fmt.Errorf("no producer offers service %d", o.serviceID)
+	}
+
+	// Offers can only be compared in a single currency
+	if currencies := offerCurrencies(offers); len(currencies) > 1 {
+
+		printOffers(offers, o)
+		return nil, fmt.Errorf("offers are in %s, choose one with -currency", strings.Join(currencies, ", "))
+	}
+
+	sortCheapest(offers)
+	printOffers(offers, o)
+
+	cheapest := offers[0]
+
+	fmt.Printf("Cheapest offer is %s - price %d (%s) for %dp\n", cheapest.device.DeviceDescription, cheapest.price.ID, cheapest.price.Description, cheapest.totalCost)
+
+	promptContinue()
+	fmt.Printf("\n\n")
+
+	// The SDK holds one connection at a time, so reconnect to the winning producer
+	if err := connectDevice(&cheapest.device); err != nil {
+
+		return nil, fmt.Errorf("wpw.InitConsumer(): %s", err.Error())
+	}
+
+	return purchaseService(o, &cheapest.device, &cheapest.service, &cheapest.price, cheapest.units)
+}
+
+// collectOffers queries every discovered producer for the service and costs each of its prices
+// in the currency, or every currency if empty. Producers which fail to respond are reported and skipped.
+func collectOffers(devices []wpwtypes.BroadcastMessage, serviceID int, durationSeconds int, currency string) []*offer {
+
+	var offers []*offer
+
+	for _, device := range devices {
+
+		if err := connectDevice(&device); err != nil {
+
+			fmt.Printf("Skipping %s (%s): %s\n", device.DeviceDescription, device.ServerID, err.Error())
+			continue
+		}
+
+		svcs, err := requestServices()
+
+		if err != nil {
+
+			fmt.Printf("Skipping %s (%s): %s\n", device.DeviceDescription, device.ServerID, err.Error())
+			continue
+		}
+
+		svc := findService(svcs, serviceID)
+
+		if svc == nil {
+
+			fmt.Printf("%s (%s) does not offer service %d\n", device.DeviceDescription, device.ServerID, serviceID)
+			continue
+		}
+
+		if err := checkAvailable(svc); err != nil {
+
+			fmt.Printf("Skipping %s (%s): %s\n", device.DeviceDescription, device.ServerID, err.Error())
+			continue
+		}
+
+		prices, err := getServicePrices(svc.ServiceID)
+
+		if err != nil {
+
+			fmt.Printf("Skipping %s (%s): %s\n", device.DeviceDescription, device.ServerID, err.Error())
+			continue
+		}
+
+		for _, price := range pricesInCurrency(prices, currency) {
+
+			o, err := newOffer(device, *svc, price, durationSeconds)
+
+			if err != nil {
+
+				fmt.Printf("Ignoring price %d from %s: %s\n", price.ID, device.ServerID, err.Error())
+				continue
+			}
+
+			offers = append(offers, o)
+		}
+	}
+
+	return offers
+}
+
+// sortCheapest orders offers by total cost, cheapest first. Offers costing the same keep the order
+// the producers were discovered in.
+func sortCheapest(offers []*offer) {
+
+	sort.SliceStable(offers, func(i, j int) bool {
+
+		return offers[i].totalCost < offers[j].totalCost
+	})
+}
+
+func offerCurrencies(offers []*offer) []string {
+
+	prices := make([]wpwtypes.Price, 0, len(offers))
+
+	for _, o := range offers {
+
+		prices = append(prices, o.price)
+	}
+
+	return currenciesOf(prices)
+}
+
+func printOffers(offers []*offer, o *order) {
+
+	fmt.Printf("\n\nOffer comparison for %ds of service %d:\n", o.duration, o.serviceID)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PRODUCER\tUUID\tPRICE ID\tDESCRIPTION\tPER UNIT\tUNITS\tTOTAL")
+
+	for _, o := range offers {
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s %dp/%s\t%d\t%s %dp\n",
+			o.device.DeviceDescription, o.device.ServerID, o.price.ID, o.price.Description,
+			o.price.PricePerUnit.CurrencyCode, o.price.PricePerUnit.Amount, o.price.UnitDescription,
+			o.units, o.price.PricePerUnit.CurrencyCode, o.totalCost)
+	}
+
+	w.Flush()
+	fmt.Println()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+func priceInUnit(id int, description string, unit string, amount int) wpwtypes.Price {
+
+	price := priceWithLimits(id, description, amount)
+	price.UnitDescription = unit
+
+	return price
+}
+
+func TestNewOfferUnits(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		price    wpwtypes.Price
+		duration int
+		units    int
+		cost     int
+	}{
+		{"seconds", priceInUnit(1, "Red", "Second", 5), 30, 30, 150},
+		{"unit in lower case", priceInUnit(1, "Red", "second", 5), 30, 30, 150},
+		{"whole minutes", priceInUnit(2, "Red", "Minute", 20), 120, 2, 40},
+		{"part of a minute rounds up", priceInUnit(2, "Red", "Minute", 20), 61, 2, 40},
+		{"less than a minute buys one", priceInUnit(2, "Red", "Minute", 20), 1, 1, 20},
+		{"raised to the minimum", priceInUnit(1, "Red [units: 5-120]", "Second", 10), 3, 5, 50},
+		{"at the maximum", priceInUnit(1, "Red [units: 5-120]", "Second", 10), 120, 120, 1200},
+		{"minutes at the maximum", priceInUnit(2, "Red [units: 1-2]", "Minute", 20), 119, 2, 40},
+	}
+
+	for _, test := range tests {
+
+		o, err := newOffer(wpwtypes.BroadcastMessage{}, wpwtypes.ServiceDetails{}, test.price, test.duration)
+
+		if err != nil {
+
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		if o.units != test.units || o.totalCost != test.cost {
+
+			t.Errorf("%s: got %d units for %dp, want %d units for %dp", test.name, o.units, o.totalCost, test.units, test.cost)
+		}
+	}
+}
+
+func TestNewOfferRefused(t *testing.T) {
+
+	noAmount := priceInUnit(1, "Red", "Second", 5)
+	noAmount.PricePerUnit = nil
+
+	tests := []struct {
+		name     string
+		price    wpwtypes.Price
+		duration int
+	}{
+		{"unsupported unit", priceInUnit(1, "Red", "Blink", 1), 10},
+		{"no price per unit", noAmount, 10},
+		{"over the maximum", priceInUnit(1, "Red [units: 5-120]", "Second", 10), 121},
+		{"part of a minute over the maximum", priceInUnit(2, "Red [units: 1-2]", "Minute", 20), 121},
+	}
+
+	for _, test := range tests {
+
+		if o, err := newOffer(wpwtypes.BroadcastMessage{}, wpwtypes.ServiceDetails{}, test.price, test.duration); err == nil {
+
+			t.Errorf("%s: got %d units, want it refused", test.name, o.units)
+		}
+	}
+}
+
+func TestSortCheapest(t *testing.T) {
+
+	offerFrom := func(producer string, cost int) *offer {
+
+		return &offer{device: wpwtypes.BroadcastMessage{ServerID: producer}, totalCost: cost}
+	}
+
+	offers := []*offer{
+		offerFrom("a", 40),
+		offerFrom("b", 15),
+		offerFrom("c", 40),
+		offerFrom("d", 15),
+		offerFrom("e", 90),
+	}
+
+	sortCheapest(offers)
+
+	// Equal costs stay in the order the producers were found
+	want := []string{"b", "d", "a", "c", "e"}
+
+	for i, o := range offers {
+
+		if o.device.ServerID != want[i] {
+
+			t.Fatalf("offer %d: got %s, want %s", i, o.device.ServerID, want[i])
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/psp"
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/psp/onlineworldpay"
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// order describes a purchase, either from a named producer or from the cheapest producer on the network
+type order struct {
+	producerUUID string
+	serviceID    int
+	priceID      int
+	unitQuantity int
+	cheapest     bool
+	duration     int    // Seconds, only used by cheapest orders
+	deliverUnits int    // Units to deliver straight away, 0 = all of them. The rest stay on the held token.
+	colour       string // Colour mix services: a colour name or r,g,b triple, chosen instead of priceID
+	currency     string // Only buy prices in this currency, empty for any
+	reuseTokens  bool
+
+	// approve is shown the quote before payment, returning an error cancels the purchase
+	approve func(quote wpwtypes.TotalPriceResponse) error
+}
+
+// purchase is the result of a successfully paid and delivered order
+type purchase struct {
+	device  wpwtypes.BroadcastMessage
+	service wpwtypes.ServiceDetails
+	price   wpwtypes.Price
+	units   int
+	quote   wpwtypes.TotalPriceResponse
+	payment wpwtypes.PaymentResponse
+	reused  *heldToken // Set when delivery used a token from an earlier payment instead of paying
+}
+
+// unitsToDeliver returns how many of the bought units to deliver now
+func (o *order) unitsToDeliver(bought int) int {
+
+	if o.deliverUnits <= 0 || o.deliverUnits > bought {
+
+		return bought
+	}
+
+	return o.deliverUnits
+}
+
+// placeOrder runs the full discovery, quote, payment and delivery flow for an order
+func placeOrder(o *order) (*purchase, error) {
+
+	if o.cheapest {
+
+		return placeCheapestOrder(o)
+	}
+
+	devices, err := discoverDevices()
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	fmt.Printf("Found %d devices, filtering on device with UUID = %s\n", len(devices), o.producerUUID)
+
+	var selectedBM *wpwtypes.BroadcastMessage
+	for _, bm := range devices {
+
+		if strings.EqualFold(bm.ServerID, o.producerUUID) {
+
+			fmt.Printf("Found required device %s - %s\n", bm.DeviceDescription, bm.ServerID)
+
+			selectedBM = &bm
+			break
+		}
+	}
+
+	if selectedBM == nil {
+
+		return nil, fmt.Errorf("specified producer not found (%s)", o.producerUUID)
+	}
+
+	err = connectDevice(selectedBM)
+
+	if err != nil {
+
+		return nil, fmt.Errorf("wpw.InitConsumer(): %s", err.Error())
+	}
+
+	fmt.Println("Requesting services..")
+	// Service discovery
+	svcs, err := requestServices()
+
+	if err != nil {
+
+		return nil, fmt.Errorf("wpw.RequestServices(): %s", err.Error())
+	}
+
+	selectedSVC := findService(svcs, o.serviceID)
+
+	if selectedSVC == nil {
+
+		return nil, fmt.Errorf("specified service not found (%d)", o.serviceID)
+	}
+
+	if err := checkAvailable(selectedSVC); err != nil {
+
+		return nil, err
+	}
+
+	fmt.Printf("\n\n")
+
+	// Price discovery
+	fmt.Println("Requesting service prices..")
+	svcPrices, err := getServicePrices(selectedSVC.ServiceID)
+
+	if err != nil {
+
+		return nil, fmt.Errorf("wpw.GetServicePrices(): %s", err.Error())
+	}
+
+	var selectedPrice *wpwtypes.Price
+
+	if o.colour != "" {
+
+		if selectedPrice, err = findColourPrice(pricesInCurrency(svcPrices, o.currency), o.colour); err != nil {
+
+			return nil, err
+		}
+	} else {
+
+		if selectedPrice, err = findPrice(svcPrices, o.priceID, o.currency); err != nil {
+
+			return nil, err
+		}
+
+		fmt.Printf("Found required price %d - %s @%s %dp per %s\n", o.serviceID, selectedPrice.Description, selectedPrice.PricePerUnit.CurrencyCode, selectedPrice.PricePerUnit.Amount, selectedPrice.UnitDescription)
+	}
+
+	promptContinue()
+	fmt.Printf("\n\n")
+
+	if o.reuseTokens {
+
+		units := o.unitsToDeliver(o.unitQuantity)
+
+		if held := tokens.usable(selectedBM.ServerID, selectedSVC.ServiceID, selectedPrice.ID, units, time.Now()); held != nil {
+
+			return deliverWithToken(selectedBM, selectedSVC, selectedPrice, held, units)
+		}
+	}
+
+	if tier := volumePrice(svcPrices, selectedPrice, o.unitQuantity); tier != selectedPrice {
+
+		fmt.Printf("Buying %d units at volume price %d @%s %dp per %s\n", o.unitQuantity, tier.ID, tier.PricePerUnit.CurrencyCode, tier.PricePerUnit.Amount, tier.UnitDescription)
+		selectedPrice = tier
+	}
+
+	return purchaseService(o, selectedBM, selectedSVC, selectedPrice, o.unitQuantity)
+}
+
+// discoverDevices performs device discovery
+func discoverDevices() ([]wpwtypes.BroadcastMessage, error) {
+
+	// Device discovery
+	fmt.Printf("Performing device discovery with timeout %dms\n", flagDiscoveryTimeout)
+	devices, err := deviceDiscovery(flagDiscoveryTimeout)
+
+	if err != nil {
+
+		return nil, fmt.Errorf("wpw.DeviceDiscovery(): %s", err.Error())
+	}
+
+	return devices, nil
+}
+
+// connectDevice sets up the consumer connection with a discovered producer
+func connectDevice(bm *wpwtypes.BroadcastMessage) error {
+
+	var pspConfig = make(map[string]string, 0)
+	pspConfig[psp.CfgPSPName] = onlineworldpay.PSPName
+	pspConfig[onlineworldpay.CfgAPIEndpoint] = "https://api.worldpay.com/v1"
+
+	fmt.Printf("Setting up connection with %s\n", bm.DeviceDescription)
+	fmt.Printf("\n\n")
+
+	return initConsumer(bm, pspConfig)
+}
+
+// findService returns the service with the given ID, or nil if the producer does not offer it
+func findService(svcs []wpwtypes.ServiceDetails, serviceID int) *wpwtypes.ServiceDetails {
+
+	for _, svc := range svcs {
+
+		if svc.ServiceID == serviceID {
+
+			fmt.Printf("Found required service %d - %s\n", serviceID, svc.ServiceName)
+			return &svc
+		}
+	}
+
+	return nil
+}
+
+// purchaseService gets a quote for the selected service and price, pays for it and begins delivery
+func purchaseService(o *order, device *wpwtypes.BroadcastMessage, selectedSVC *wpwtypes.ServiceDetails, selectedPrice *wpwtypes.Price, unitQuantity int) (*purchase, error) {
+
+	// Checked before asking for a quote, as the producer can only refuse the payment
+	if err := checkUnitLimits(selectedPrice, unitQuantity); err != nil {
+
+		return nil, err
+	}
+
+	// Service + price selection
+	fmt.Println("Selecting service and price.. Getting quote for:")
+	fmt.Printf("%s - %d units of %s @ %s %dp per unit\n", selectedPrice.Description, unitQuantity, selectedPrice.UnitDescription, selectedPrice.PricePerUnit.CurrencyCode, selectedPrice.PricePerUnit.Amount)
+	fmt.Println()
+	totalPriceResponse, err := selectService(selectedSVC.ServiceID, unitQuantity, selectedPrice.ID)
+
+	if err != nil {
+
+		return nil, fmt.Errorf("wpw.SelectService(): %s", err.Error())
+	}
+
+	fmt.Println("TotalPriceResponse:")
+	fmt.Printf("Total price %dp\n", totalPriceResponse.TotalPrice)
+	fmt.Printf("Merchant Public Key: %s\n", totalPriceResponse.MerchantClientKey)
+	fmt.Printf("Currency: %s\n", totalPriceResponse.CurrencyCode)
+	fmt.Printf("Reference: %s\n", totalPriceResponse.PaymentReferenceID)
+	fmt.Printf("Units to supply: %d\n", totalPriceResponse.UnitsToSupply)
+
+	if totalPriceResponse.PaymentReferenceID == "" {
+
+		return nil, fmt.Errorf("quote for %d units of price %d has no payment reference", unitQuantity, selectedPrice.ID)
+	}
+
+	if err := checkQuote(device, totalPriceResponse.PaymentReferenceID); err != nil {
+
+		return nil, err
+	}
+
+	if o.approve != nil {
+
+		if err := o.approve(totalPriceResponse); err != nil {
+
+			return nil, fmt.Errorf("quote %s not approved: %s", totalPriceResponse.PaymentReferenceID, err.Error())
+		}
+	}
+
+	promptContinue()
+	fmt.Printf("\n\n")
+
+	// Payment request
+	fmt.Printf("Proceed to make payment of %dp\n", totalPriceResponse.TotalPrice)
+	fmt.Printf("Payment card for %s %s, number %s, with expiry %d/%d\n", hceCard.FirstName, hceCard.LastName, hceCard.CardNumber, hceCard.ExpMonth, hceCard.ExpYear)
+	paymentResponse, err := payments.makePayment(totalPriceResponse)
+
+	if err != nil {
+
+		return nil, fmt.Errorf("wpw.MakePayment(): %s", err.Error())
+	}
+
+	fmt.Println("Worldpay Within payment successful")
+
+	fmt.Printf("\n\n")
+
+	fmt.Println("PaymentResponse:")
+	fmt.Printf("Total paid: %dp\n", paymentResponse.TotalPaid)
+	fmt.Printf("DeliveryToken - Key: %s\n", paymentResponse.ServiceDeliveryToken.Key)
+	fmt.Printf("DeliveryToken - Issued: %s\n", paymentResponse.ServiceDeliveryToken.Issued)
+	fmt.Printf("DeliveryToken - Expiry: %s\n", paymentResponse.ServiceDeliveryToken.Expiry)
+	fmt.Printf("DeliveryToken - Refund on expiry: %t\n", paymentResponse.ServiceDeliveryToken.RefundOnExpiry)
+
+	p := &purchase{
+		device:  *device,
+		service: *selectedSVC,
+		price:   *selectedPrice,
+		units:   unitQuantity,
+		quote:   totalPriceResponse,
+		payment: paymentResponse,
+	}
+
+	// The payment has been taken, so a failure to store the receipt or token does not stop delivery
+	if _, err := receipts.add(p); err != nil {
+
+		fmt.Printf("Failed to store receipt for %s: %s\n", totalPriceResponse.PaymentReferenceID, err.Error())
+	}
+
+	held, err := tokens.add(p)
+
+	if err != nil {
+
+		fmt.Printf("Failed to store delivery token for %s: %s\n", totalPriceResponse.PaymentReferenceID, err.Error())
+	}
+
+	deliverUnits := o.unitsToDeliver(unitQuantity)
+
+	promptContinue()
+	fmt.Printf("\n\n")
+
+	// Begin service delivery
+
+	fmt.Println("Proceed to begin service delivery (Turn on the LED)")
+
+	promptContinue()
+	fmt.Printf("\n\n")
+
+	after := lastDelivery(*device, paymentResponse.ServiceDeliveryToken.Key)
+	_, err = wpw.BeginServiceDelivery(selectedSVC.ServiceID, *paymentResponse.ServiceDeliveryToken, deliverUnits)
+
+	if err != nil {
+
+		return p, fmt.Errorf("wpw.BeginServiceDelivery(): %s", err.Error())
+	}
+
+	if held != nil {
+
+		if err := tokens.use(held, deliverUnits); err != nil {
+
+			fmt.Printf("Failed to update delivery token %s: %s\n", held.Token.Key, err.Error())
+		}
+
+		if held.remaining() > 0 {
+
+			fmt.Printf("%d * %s remain on delivery token %s until %s\n", held.remaining(), selectedPrice.UnitDescription, held.Token.Key, held.Token.Expiry)
+		}
+	}
+
+	fmt.Printf("\n\n")
+	reportDelivery(*device, totalPriceResponse.PaymentReferenceID, paymentResponse.ServiceDeliveryToken.Key, after, selectedSVC.ServiceName, deliverUnits, selectedPrice.UnitDescription)
+	fmt.Printf("\n\n")
+
+	return p, nil
+}
+
+// deliverWithToken begins delivery using a token from an earlier payment instead of paying again
+func deliverWithToken(device *wpwtypes.BroadcastMessage, selectedSVC *wpwtypes.ServiceDetails, selectedPrice *wpwtypes.Price, held *heldToken, units int) (*purchase, error) {
+
+	fmt.Printf("Reusing delivery token %s from payment %s: %d of %d * %s remaining, expires %s\n",
+		held.Token.Key, held.Reference, held.remaining(), held.UnitsPaid, held.UnitDescription, held.Token.Expiry)
+
+	promptContinue()
+	fmt.Printf("\n\n")
+
+	p := &purchase{
+		device:  *device,
+		service: *selectedSVC,
+		price:   *selectedPrice,
+		units:   units,
+		payment: wpwtypes.PaymentResponse{ServiceDeliveryToken: &held.Token},
+		reused:  held,
+	}
+
+	fmt.Println("Proceed to begin service delivery (Turn on the LED)")
+
+	promptContinue()
+	fmt.Printf("\n\n")
+
+	after := lastDelivery(*device, held.Token.Key)
+	_, err := wpw.BeginServiceDelivery(selectedSVC.ServiceID, held.Token, units)
+
+	if err != nil {
+
+		return p, fmt.Errorf("wpw.BeginServiceDelivery(): %s", err.Error())
+	}
+
+	if err := tokens.use(held, units); err != nil {
+
+		fmt.Printf("Failed to update delivery token %s: %s\n", held.Token.Key, err.Error())
+	}
+
+	fmt.Printf("\n\n")
+	reportDelivery(*device, held.Reference, held.Token.Key, after, selectedSVC.ServiceName, units, selectedPrice.UnitDescription)
+	fmt.Printf("%d * %s remain on the token\n", held.remaining(), held.UnitDescription)
+	fmt.Printf("\n\n")
+
+	return p, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// Payment attempt states
+const (
+	paymentSubmitted string = "submitted" // MakePayment called, outcome not yet known
+	paymentPaid      string = "paid"
+	paymentUnknown   string = "unknown"  // MakePayment failed or timed out, the card may have been charged
+	paymentResolved  string = "resolved" // operator has checked an unknown payment by hand
+)
+
+// paymentAttempt records a single call to MakePayment, keyed by the payment reference of the quote
+type paymentAttempt struct {
+	Reference  string    `json:"reference"`
+	ServerID   string    `json:"serverId"`
+	PriceID    int       `json:"priceId"`
+	Units      int       `json:"units"`
+	TotalPrice int       `json:"totalPrice"`
+	Currency   string    `json:"currency"`
+	State      string    `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+// paymentJournal is the on disk record of payment attempts. It is written before MakePayment is
+// called so that a crash or timeout part way through a payment is never followed by a blind retry.
+type paymentJournal struct {
+	path     string
+	Attempts map[string]*paymentAttempt `json:"attempts"`
+}
+
+func loadPaymentJournal(path string) (*paymentJournal, error) {
+
+	journal := &paymentJournal{
+		path:     path,
+		Attempts: make(map[string]*paymentAttempt, 0),
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+
+		return journal, nil
+	} else if err != nil {
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, journal); err != nil {
+
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	if journal.Attempts == nil {
+
+		journal.Attempts = make(map[string]*paymentAttempt, 0)
+	}
+
+	return journal, nil
+}
+
+func (journal *paymentJournal) save() error {
+
+	data, err := json.MarshalIndent(journal, "", "\t")
+
+	if err != nil {
+
+		return err
+	}
+
+	tmp := journal.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+
+		return err
+	}
+
+	return os.Rename(tmp, journal.path)
+}
+
+// unresolved returns the attempts whose outcome is not known
+func (journal *paymentJournal) unresolved() []*paymentAttempt {
+
+	var attempts []*paymentAttempt
+
+	for _, attempt := range journal.Attempts {
+
+		if attempt.State == paymentSubmitted || attempt.State == paymentUnknown {
+
+			attempts = append(attempts, attempt)
+		}
+	}
+
+	return attempts
+}
+
+// resolve marks an attempt with an unknown outcome as checked by the operator
+func (journal *paymentJournal) resolve(reference string) error {
+
+	attempt, ok := journal.Attempts[reference]
+
+	if !ok {
+
+		return fmt.Errorf("no payment with reference %s", reference)
+	}
+
+	attempt.State = paymentResolved
+	attempt.Updated = time.Now()
+
+	return journal.save()
+}
+
+// makePayment pays for a quote at most once. The attempt is journaled before the SDK is called;
+// any failure leaves it in the unknown state, which blocks further purchases until it is resolved.
+func (journal *paymentJournal) makePayment(quote wpwtypes.TotalPriceResponse) (wpwtypes.PaymentResponse, error) {
+
+	if quote.PaymentReferenceID == "" {
+
+		return wpwtypes.PaymentResponse{}, errors.New("quote has no payment reference")
+	}
+
+	if attempt, ok := journal.Attempts[quote.PaymentReferenceID]; ok {
+
+		return wpwtypes.PaymentResponse{}, fmt.Errorf("payment %s was already attempted (%s), refusing to pay again", attempt.Reference, attempt.State)
+	}
+
+	attempt := &paymentAttempt{
+		Reference:  quote.PaymentReferenceID,
+		ServerID:   quote.ServerID,
+		PriceID:    quote.PriceID,
+		Units:      quote.UnitsToSupply,
+		TotalPrice: quote.TotalPrice,
+		Currency:   quote.CurrencyCode,
+		State:      paymentSubmitted,
+		Updated:    time.Now(),
+	}
+
+	journal.Attempts[attempt.Reference] = attempt
+
+	if err := journal.save(); err != nil {
+
+		delete(journal.Attempts, attempt.Reference)
+		return wpwtypes.PaymentResponse{}, fmt.Errorf("record payment attempt: %s", err.Error())
+	}
+
+	result, err := callStep(stepMakePayment, func() (interface{}, error) {
+
+		return wpw.MakePayment(quote)
+	})
+
+	attempt.Updated = time.Now()
+
+	if err != nil {
+
+		attempt.State = paymentUnknown
+		attempt.Error = err.Error()
+	} else {
+
+		attempt.State = paymentPaid
+	}
+
+	if saveErr := journal.save(); saveErr != nil {
+
+		fmt.Printf("Failed to update payment journal: %s\n", saveErr.Error())
+	}
+
+	if err != nil {
+
+		return wpwtypes.PaymentResponse{}, err
+	}
+
+	return result.(wpwtypes.PaymentResponse), nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// receipt is the local record of a successful payment
+type receipt struct {
+	Reference           string    `json:"reference"`
+	Time                time.Time `json:"time"`
+	ProducerUUID        string    `json:"producerUuid"`
+	ProducerDescription string    `json:"producerDescription"`
+	ServiceID           int       `json:"serviceId"`
+	ServiceName         string    `json:"serviceName"`
+	PriceID             int       `json:"priceId"`
+	PriceDescription    string    `json:"priceDescription"`
+	UnitDescription     string    `json:"unitDescription"`
+	PricePerUnit        int       `json:"pricePerUnit"`
+	Currency            string    `json:"currency"`
+	Units               int       `json:"units"`
+	TotalPaid           int       `json:"totalPaid"`
+	TokenKey            string    `json:"tokenKey"`
+	TokenIssued         time.Time `json:"tokenIssued"`
+	TokenExpiry         time.Time `json:"tokenExpiry"`
+	RefundOnExpiry      bool      `json:"refundOnExpiry"`
+	Disputes            []dispute `json:"disputes,omitempty"`
+}
+
+// dispute records a delivery which the producer reported as short of the units asked for
+type dispute struct {
+	Time           time.Time `json:"time"`
+	TokenKey       string    `json:"tokenKey"`
+	State          string    `json:"state"`
+	UnitsRequested int       `json:"unitsRequested"`
+	UnitsDelivered int       `json:"unitsDelivered"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+// receiptStore is the JSON file holding every receipt, oldest first
+type receiptStore struct {
+	path     string
+	Receipts []*receipt `json:"receipts"`
+}
+
+func loadReceipts(path string) (*receiptStore, error) {
+
+	store := &receiptStore{path: path}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+
+		return store, nil
+	} else if err != nil {
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, store); err != nil {
+
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	return store, nil
+}
+
+func (store *receiptStore) save() error {
+
+	data, err := json.MarshalIndent(store, "", "\t")
+
+	if err != nil {
+
+		return err
+	}
+
+	tmp := store.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+
+		return err
+	}
+
+	return os.Rename(tmp, store.path)
+}
+
+// add records the receipt for a paid purchase
+func (store *receiptStore) add(p *purchase) (*receipt, error) {
+
+	r := &receipt{
+		Reference:           p.quote.PaymentReferenceID,
+		Time:                time.Now(),
+		ProducerUUID:        p.device.ServerID,
+		ProducerDescription: p.device.DeviceDescription,
+		ServiceID:           p.service.ServiceID,
+		ServiceName:         p.service.ServiceName,
+		PriceID:             p.price.ID,
+		PriceDescription:    p.price.Description,
+		UnitDescription:     p.price.UnitDescription,
+		Currency:            p.quote.CurrencyCode,
+		Units:               p.units,
+		TotalPaid:           p.payment.TotalPaid,
+	}
+
+	if p.price.PricePerUnit != nil {
+
+		r.PricePerUnit = p.price.PricePerUnit.Amount
+	}
+
+	if token := p.payment.ServiceDeliveryToken; token != nil {
+
+		r.TokenKey = token.Key
+		r.TokenIssued = token.Issued
+		r.TokenExpiry = token.Expiry
+		r.RefundOnExpiry = token.RefundOnExpiry
+	}
+
+	store.Receipts = append(store.Receipts, r)
+
+	if err := store.save(); err != nil {
+
+		store.Receipts = store.Receipts[:len(store.Receipts)-1]
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// dispute records a short delivery on the receipt for the payment
+func (store *receiptStore) dispute(reference string, d dispute) error {
+
+	r := store.find(reference)
+
+	if r == nil {
+
+		return fmt.Errorf("no receipt with reference %s", reference)
+	}
+
+	r.Disputes = append(r.Disputes, d)
+
+	if err := store.save(); err != nil {
+
+		r.Disputes = r.Disputes[:len(r.Disputes)-1]
+		return err
+	}
+
+	return nil
+}
+
+func (store *receiptStore) find(reference string) *receipt {
+
+	for _, r := range store.Receipts {
+
+		if r.Reference == reference {
+
+			return r
+		}
+	}
+
+	return nil
+}
+
+var receiptCSVHeader = []string{
+	"reference", "time", "producer_uuid", "producer_description", "service_id", "service_name",
+	"price_id", "price_description", "unit_description", "price_per_unit", "currency", "units",
+	"total_paid", "token_key", "token_issued", "token_expiry", "refund_on_expiry", "disputes",
+}
+
+func (store *receiptStore) exportCSV(w io.Writer) error {
+
+	out := csv.NewWriter(w)
+
+	if err := out.Write(receiptCSVHeader); err != nil {
+
+		return err
+	}
+
+	for _, r := range store.Receipts {
+
+		row := []string{
+			r.Reference,
+			r.Time.Format(time.RFC3339),
+			r.ProducerUUID,
+			r.ProducerDescription,
+			strconv.Itoa(r.ServiceID),
+			r.ServiceName,
+			strconv.Itoa(r.PriceID),
+			r.PriceDescription,
+			r.UnitDescription,
+			strconv.Itoa(r.PricePerUnit),
+			r.Currency,
+			strconv.Itoa(r.Units),
+			strconv.Itoa(r.TotalPaid),
+			r.TokenKey,
+			r.TokenIssued.Format(time.RFC3339),
+			r.TokenExpiry.Format(time.RFC3339),
+			strconv.FormatBool(r.RefundOnExpiry),
+			strconv.Itoa(len(r.Disputes)),
+		}
+
+		if err := out.Write(row); err != nil {
+
+			return err
+		}
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
+
+// runReceiptsCommand implements "consumer receipts list|show <reference>|export [file]"
+func runReceiptsCommand(args []string) error {
+
+	store, err := loadReceipts(flagReceipts)
+
+	if err != nil {
+
+		return err
+	}
+
+	if len(args) == 0 {
+
+		return errors.New("usage: consumer receipts list | show <reference> | export [file.csv]")
+	}
+
+	switch args[0] {
+
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tREFERENCE\tSERVICE\tUNITS\tTOTAL PAID\tTOKEN EXPIRY\tDISPUTES")
+
+		for _, r := range store.Receipts {
+
+			fmt.Fprintf(w, "%s\t%s\t%d - %s\t%d x %s\t%s %dp\t%s\t%d\n",
+				r.Time.Format(time.RFC3339), r.Reference, r.ServiceID, r.ServiceName,
+				r.Units, r.UnitDescription, r.Currency, r.TotalPaid, r.TokenExpiry.Format(time.RFC3339), len(r.Disputes))
+		}
+
+		return w.Flush()
+
+	case "show":
+		if len(args) != 2 {
+
+			return errors.New("usage: consumer receipts show <reference>")
+		}
+
+		r := store.find(args[1])
+
+		if r == nil {
+
+			return fmt.Errorf("no receipt with reference %s", args[1])
+		}
+
+		printReceipt(r)
+		return nil
+
+	case "export":
+		if len(args) == 1 {
+
+			return store.exportCSV(os.Stdout)
+		}
+
+		f, err := os.Create(args[1])
+
+		if err != nil {
+
+			return err
+		}
+
+		if err := store.exportCSV(f); err != nil {
+
+			f.Close()
+			return err
+		}
+
+		fmt.Printf("Exported %d receipts to %s\n", len(store.Receipts), args[1])
+		return f.Close()
+	}
+
+	return fmt.Errorf("unknown receipts command %q", args[0])
+}
+
+func printReceipt(r *receipt) {
+
+	fmt.Printf("Reference: %s\n", r.Reference)
+	fmt.Printf("Time: %s\n", r.Time.Format(time.RFC1123))
+	fmt.Printf("Producer: %s (%s)\n", r.ProducerDescription, r.ProducerUUID)
+	fmt.Printf("Service: %d - %s\n", r.ServiceID, r.ServiceName)
+	fmt.Printf("Price: %d - %s @ %s %dp per %s\n", r.PriceID, r.PriceDescription, r.Currency, r.PricePerUnit, r.UnitDescription)
+	fmt.Printf("Units: %d\n", r.Units)
+	fmt.Printf("Total paid: %s %dp\n", r.Currency, r.TotalPaid)
+	fmt.Printf("DeliveryToken - Key: %s\n", r.TokenKey)
+	fmt.Printf("DeliveryToken - Issued: %s\n", r.TokenIssued)
+	fmt.Printf("DeliveryToken - Expiry: %s\n", r.TokenExpiry)
+	fmt.Printf("DeliveryToken - Refund on expiry: %t\n", r.RefundOnExpiry)
+
+	for _, d := range r.Disputes {
+
+		fmt.Printf("Dispute: %s, token %s %s with %d of %d units delivered (%s)\n",
+			d.Time.Format(time.RFC1123), d.TokenKey, d.State, d.UnitsDelivered, d.UnitsRequested, d.Reason)
+	}
+}
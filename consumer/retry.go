@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// Names of the SDK steps which can be given their own retry policy
+const (
+	stepDeviceDiscovery  string = "DeviceDiscovery"
+	stepInitConsumer     string = "InitConsumer"
+	stepRequestServices  string = "RequestServices"
+	stepGetServicePrices string = "GetServicePrices"
+	stepSelectService    string = "SelectService"
+	stepMakePayment      string = "MakePayment"
+)
+
+// stepPolicy controls how many times an SDK step is attempted and how long each attempt may take
+type stepPolicy struct {
+	TimeoutMillis int `json:"timeoutMillis"`
+	Retries       int `json:"retries"`
+	BackoffMillis int `json:"backoffMillis"`
+}
+
+// stepPolicies holds per step overrides loaded from the -retryconfig file
+var stepPolicies = make(map[string]stepPolicy, 0)
+
+// loadStepPolicies reads per step policies from a JSON file of the form
+// {"DeviceDiscovery": {"timeoutMillis": 40000, "retries": 3, "backoffMillis": 2000}, ...}
+func loadStepPolicies(path string) error {
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+
+		return err
+	}
+
+	policies := make(map[string]stepPolicy, 0)
+
+	if err := json.Unmarshal(data, &policies); err != nil {
+
+		return fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	for step, policy := range policies {
+
+		switch step {
+
+		case stepDeviceDiscovery, stepInitConsumer, stepRequestServices, stepGetServicePrices, stepSelectService, stepMakePayment:
+		default:
+			return fmt.Errorf("parse %s: unknown step %q", path, step)
+		}
+
+		if policy.TimeoutMillis < 0 || policy.Retries < 0 || policy.BackoffMillis < 0 {
+
+			return fmt.Errorf("parse %s: negative value in policy for %s", path, step)
+		}
+
+		stepPolicies[step] = policy
+	}
+
+	return nil
+}
+
+// policyFor returns the configured policy for a step, falling back to the command line defaults.
+// MakePayment is never retried, whatever the configuration says.
+func policyFor(step string) stepPolicy {
+
+	policy, ok := stepPolicies[step]
+
+	if !ok {
+
+		policy = stepPolicy{
+			TimeoutMillis: flagStepTimeout,
+			Retries:       flagRetries,
+			BackoffMillis: flagRetryBackoff,
+		}
+
+		// Discovery blocks for the whole discovery timeout, so the step timeout is on top of that
+		if step == stepDeviceDiscovery && policy.TimeoutMillis > 0 {
+
+			policy.TimeoutMillis += flagDiscoveryTimeout
+		}
+	}
+
+	if step == stepMakePayment {
+
+		policy.Retries = 0
+	}
+
+	return policy
+}
+
+// callStep runs an SDK call under the policy for the step, retrying failures with exponential backoff.
+// The call returns its result as an interface{} so that a timed out attempt which completes later
+// cannot write over the result of a retry. The SDK is not safe for concurrent use, so a retry
+// waits for a timed out attempt to return before calling the SDK again.
+func callStep(step string, fn func() (interface{}, error)) (interface{}, error) {
+
+	policy := policyFor(step)
+
+	var result interface{}
+	var err error
+	var finished <-chan struct{}
+
+	for attempt := 0; attempt <= policy.Retries; attempt++ {
+
+		if attempt > 0 {
+
+			wait := time.Duration(policy.BackoffMillis) * time.Millisecond << uint(attempt-1)
+
+			fmt.Printf("Retrying %s in %s (retry %d of %d)\n", step, wait, attempt, policy.Retries)
+			time.Sleep(wait)
+
+			select {
+
+			case <-finished:
+			default:
+				fmt.Printf("Waiting for the timed out %s call to return before retrying\n", step)
+				<-finished
+			}
+		}
+
+		result, finished, err = callWithTimeout(step, time.Duration(policy.TimeoutMillis)*time.Millisecond, fn)
+
+		if err == nil {
+
+			return result, nil
+		}
+
+		fmt.Printf("%s failed: %s\n", step, err.Error())
+		log.WithFields(log.Fields{"step": step, "attempt": attempt + 1}).Warnf("SDK step failed: %s", err.Error())
+	}
+
+	return nil, err
+}
+
+// callWithTimeout runs fn, giving up after timeout. A timeout of zero waits forever.
+// The SDK offers no way to cancel a call, so a timed out call is left to finish in the background;
+// the returned channel is closed once fn has returned.
+func callWithTimeout(step string, timeout time.Duration, fn func() (interface{}, error)) (interface{}, <-chan struct{}, error) {
+
+	finished := make(chan struct{})
+
+	if timeout <= 0 {
+
+		result, err := fn()
+		close(finished)
+
+		return result, finished, err
+	}
+
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+
+	done := make(chan outcome, 1)
+
+	go func() {
+
+		defer close(finished)
+
+		result, err := fn()
+		done <- outcome{result, err}
+	}()
+
+	select {
+
+	case o := <-done:
+		return o.result, finished, o.err
+	case <-time.After(timeout):
+		return nil, finished, fmt.Errorf("%s timed out after %s", step, timeout)
+	}
+}
+
+func deviceDiscovery(timeoutMillis int) ([]wpwtypes.BroadcastMessage, error) {
+
+	result, err := callStep(stepDeviceDiscovery, func() (interface{}, error) {
+
+		return wpw.DeviceDiscovery(timeoutMillis)
+	})
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	return result.([]wpwtypes.BroadcastMessage), nil
+}
+
+func initConsumer(bm *wpwtypes.BroadcastMessage, pspConfig map[string]string) error {
+
+	_, err := callStep(stepInitConsumer, func() (interface{}, error) {
+
+		return nil, wpw.InitConsumer(bm.Scheme, bm.Hostname, bm.PortNumber, bm.URLPrefix, "123", hceCard, pspConfig)
+	})
+
+	return err
+}
+
+func requestServices() ([]wpwtypes.ServiceDetails, error) {
+
+	result, err := callStep(stepRequestServices, func() (interface{}, error) {
+
+		return wpw.RequestServices()
+	})
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	return result.([]wpwtypes.ServiceDetails), nil
+}
+
+func getServicePrices(serviceID int) ([]wpwtypes.Price, error) {
+
+	result, err := callStep(stepGetServicePrices, func() (interface{}, error) {
+
+		return wpw.GetServicePrices(serviceID)
+	})
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	return result.([]wpwtypes.Price), nil
+}
+
+func selectService(serviceID int, unitQuantity int, priceID int) (wpwtypes.TotalPriceResponse, error) {
+
+	result, err := callStep(stepSelectService, func() (interface{}, error) {
+
+		return wpw.SelectService(serviceID, unitQuantity, priceID)
+	})
+
+	if err != nil {
+
+		return wpwtypes.TotalPriceResponse{}, err
+	}
+
+	return result.(wpwtypes.TotalPriceResponse), nil
+}
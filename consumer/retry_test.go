@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withPolicies runs the test with the given step policies and command line defaults, restoring them after
+func withPolicies(t *testing.T, policies map[string]stepPolicy, timeout int, retries int, backoff int) {
+
+	saved := stepPolicies
+	savedTimeout, savedRetries, savedBackoff, savedDiscovery := flagStepTimeout, flagRetries, flagRetryBackoff, flagDiscoveryTimeout
+
+	stepPolicies = policies
+	flagStepTimeout, flagRetries, flagRetryBackoff, flagDiscoveryTimeout = timeout, retries, backoff, 10000
+
+	t.Cleanup(func() {
+
+		stepPolicies = saved
+		flagStepTimeout, flagRetries, flagRetryBackoff, flagDiscoveryTimeout = savedTimeout, savedRetries, savedBackoff, savedDiscovery
+	})
+}
+
+// failing returns a step which fails the first failures times it is called, counting the calls
+func failing(failures int, calls *int32) func() (interface{}, error) {
+
+	return func() (interface{}, error) {
+
+		if n := atomic.AddInt32(calls, 1); int(n) <= failures {
+
+			return nil, errors.New("unreachable")
+		}
+
+		return "ok", nil
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+
+	withPolicies(t, map[string]stepPolicy{
+		stepSelectService: {TimeoutMillis: 500, Retries: 1, BackoffMillis: 50},
+		stepMakePayment:   {TimeoutMillis: 500, Retries: 4, BackoffMillis: 50},
+	}, 2000, 3, 100)
+
+	tests := []struct {
+		step string
+		want stepPolicy
+	}{
+		{stepRequestServices, stepPolicy{TimeoutMillis: 2000, Retries: 3, BackoffMillis: 100}},
+		{stepDeviceDiscovery, stepPolicy{TimeoutMillis: 12000, Retries: 3, BackoffMillis: 100}},
+		{stepSelectService, stepPolicy{TimeoutMillis: 500, Retries: 1, BackoffMillis: 50}},
+		{stepMakePayment, stepPolicy{TimeoutMillis: 500, Retries: 0, BackoffMillis: 50}},
+	}
+
+	for _, test := range tests {
+
+		if got := policyFor(test.step); got != test.want {
+
+			t.Errorf("%s: got %+v, want %+v", test.step, got, test.want)
+		}
+	}
+
+	// Not configured, MakePayment takes the defaults but still without retries
+	delete(stepPolicies, stepMakePayment)
+
+	if got := policyFor(stepMakePayment); got.Retries != 0 || got.TimeoutMillis != 2000 {
+
+		t.Errorf("%s by default: got %+v, want 2000ms without retries", stepMakePayment, got)
+	}
+}
+
+func TestCallStepRetries(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		step     string
+		retries  int
+		failures int
+		calls    int
+		ok       bool
+	}{
+		{"succeeds first time", stepRequestServices, 2, 0, 1, true},
+		{"succeeds on a retry", stepRequestServices, 2, 1, 2, true},
+		{"succeeds on the last retry", stepRequestServices, 2, 2, 3, true},
+		{"fails every attempt", stepRequestServices, 2, 3, 3, false},
+		{"no retries", stepRequestServices, 0, 1, 1, false},
+		{"payment is not retried", stepMakePayment, 5, 1, 1, false},
+	}
+
+	for _, test := range tests {
+
+		withPolicies(t, map[string]stepPolicy{test.step: {Retries: test.retries, BackoffMillis: 1}}, 0, 0, 0)
+
+		var calls int32
+		result, err := callStep(test.step, failing(test.failures, &calls))
+
+		if (err == nil) != test.ok || int(atomic.LoadInt32(&calls)) != test.calls {
+
+			t.Errorf("%s: got %v %v after %d calls, want ok %t after %d", test.name, result, err, calls, test.ok, test.calls)
+		}
+	}
+}
+
+func TestCallStepBackoff(t *testing.T) {
+
+	withPolicies(t, map[string]stepPolicy{stepGetServicePrices: {Retries: 3, BackoffMillis: 20}}, 0, 0, 0)
+
+	var calls int32
+	started := time.Now()
+
+	callStep(stepGetServicePrices, failing(3, &calls))
+
+	// 20ms, then 40ms, then 80ms between the four attempts
+	if elapsed := time.Since(started); elapsed < 140*time.Millisecond {
+
+		t.Errorf("retried after %s, want the backoff to double from 20ms to at least 140ms in all", elapsed)
+	}
+}
+
+func TestCallStepTimeout(t *testing.T) {
+
+	withPolicies(t, map[string]stepPolicy{stepSelectService: {TimeoutMillis: 20, Retries: 1, BackoffMillis: 1}}, 0, 0, 0)
+
+	var calls, running, overlapped int32
+
+	slow := func() (interface{}, error) {
+
+		if atomic.AddInt32(&running, 1) > 1 {
+
+			atomic.StoreInt32(&overlapped, 1)
+		}
+
+		defer atomic.AddInt32(&running, -1)
+
+		// Only the first attempt outlasts the timeout
+		if atomic.AddInt32(&calls, 1) == 1 {
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		return "ok", nil
+	}
+
+	result, err := callStep(stepSelectService, slow)
+
+	if n := atomic.LoadInt32(&calls); err != nil || result != "ok" || n != 2 {
+
+		t.Errorf("got %v %v after %d calls, want ok on the retry", result, err, n)
+	}
+
+	// The SDK is not safe for concurrent use, so the retry waits for the timed out call
+	if atomic.LoadInt32(&overlapped) != 0 {
+
+		t.Error("the retry called the SDK while the timed out call was still running")
+	}
+
+	withPolicies(t, map[string]stepPolicy{stepMakePayment: {TimeoutMillis: 20, Retries: 3}}, 0, 0, 0)
+
+	atomic.StoreInt32(&calls, 0)
+
+	if _, err := callStep(stepMakePayment, slow); err == nil || atomic.LoadInt32(&calls) != 1 {
+
+		t.Errorf("payment: got %v after %d calls, want a timeout and no retry", err, atomic.LoadInt32(&calls))
+	}
+}
+
+func TestLoadStepPoliciesRejects(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"unknown step", `{"BeginServiceDelivery": {"retries": 1}}`},
+		{"negative retries", `{"SelectService": {"retries": -1}}`},
+		{"negative timeout", `{"SelectService": {"timeoutMillis": -1}}`},
+		{"not JSON", `retries: 1`},
+	}
+
+	for _, test := range tests {
+
+		withPolicies(t, make(map[string]stepPolicy, 0), 0, 0, 0)
+
+		path := t.TempDir() + "/retry.json"
+
+		if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+
+			t.Fatalf("write: %s", err.Error())
+		}
+
+		if err := loadStepPolicies(path); err == nil {
+
+			t.Errorf("%s: loaded %+v, want an error", test.name, stepPolicies)
+		}
+	}
+}
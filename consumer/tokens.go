@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	wpwtypes "github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// heldToken is a delivery token from an earlier payment, along with how many of its units have been used
+type heldToken struct {
+	Token           wpwtypes.ServiceDeliveryToken `json:"token"`
+	Reference       string                        `json:"reference"`
+	ProducerUUID    string                        `json:"producerUuid"`
+	ServiceID       int                           `json:"serviceId"`
+	ServiceName     string                        `json:"serviceName"`
+	PriceID         int                           `json:"priceId"`
+	UnitDescription string                        `json:"unitDescription"`
+	UnitsPaid       int                           `json:"unitsPaid"`
+	UnitsUsed       int                           `json:"unitsUsed"`
+	LastUsed        time.Time                     `json:"lastUsed,omitempty"`
+}
+
+func (held *heldToken) remaining() int {
+
+	return held.UnitsPaid - held.UnitsUsed
+}
+
+func (held *heldToken) expired(now time.Time) bool {
+
+	return !held.Token.Expiry.IsZero() && !now.Before(held.Token.Expiry)
+}
+
+// tokenStore is the JSON file holding every delivery token the consumer has been issued
+type tokenStore struct {
+	path   string
+	Tokens []*heldToken `json:"tokens"`
+}
+
+func loadTokens(path string) (*tokenStore, error) {
+
+	store := &tokenStore{path: path}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+
+		return store, nil
+	} else if err != nil {
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, store); err != nil {
+
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	return store, nil
+}
+
+func (store *tokenStore) save() error {
+
+	data, err := json.MarshalIndent(store, "", "\t")
+
+	if err != nil {
+
+		return err
+	}
+
+	tmp := store.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+
+		return err
+	}
+
+	return os.Rename(tmp, store.path)
+}
+
+// add holds the delivery token from a paid purchase, none of its units used yet
+func (store *tokenStore) add(p *purchase) (*heldToken, error) {
+
+	if p.payment.ServiceDeliveryToken == nil {
+
+		return nil, errors.New("payment has no delivery token")
+	}
+
+	held := &heldToken{
+		Token:           *p.payment.ServiceDeliveryToken,
+		Reference:       p.quote.PaymentReferenceID,
+		ProducerUUID:    p.device.ServerID,
+		ServiceID:       p.service.ServiceID,
+		ServiceName:     p.service.ServiceName,
+		PriceID:         p.price.ID,
+		UnitDescription: p.price.UnitDescription,
+		UnitsPaid:       p.units,
+	}
+
+	store.Tokens = append(store.Tokens, held)
+
+	if err := store.save(); err != nil {
+
+		store.Tokens = store.Tokens[:len(store.Tokens)-1]
+		return nil, err
+	}
+
+	return held, nil
+}
+
+// usable returns an unexpired token for the producer, service and price with at least units remaining.
+// When several match, the one expiring first is used.
+func (store *tokenStore) usable(producerUUID string, serviceID int, priceID int, units int, now time.Time) *heldToken {
+
+	var best *heldToken
+
+	for _, held := range store.Tokens {
+
+		if held.ProducerUUID != producerUUID || held.ServiceID != serviceID || held.PriceID != priceID {
+
+			continue
+		}
+
+		if held.expired(now) || held.remaining() < units {
+
+			continue
+		}
+
+		if best == nil || held.Token.Expiry.Before(best.Token.Expiry) {
+
+			best = held
+		}
+	}
+
+	return best
+}
+
+// use records that units of a held token have been delivered
+func (store *tokenStore) use(held *heldToken, units int) error {
+
+	held.UnitsUsed += units
+	held.LastUsed = time.Now()
+
+	return store.save()
+}
+
+func (store *tokenStore) find(key string) *heldToken {
+
+	for _, held := range store.Tokens {
+
+		if held.Token.Key == key {
+
+			return held
+		}
+	}
+
+	return nil
+}
+
+// runTokensCommand implements "consumer tokens list|show <key>"
+func runTokensCommand(args []string) error {
+
+	store, err := loadTokens(flagTokens)
+
+	if err != nil {
+
+		return err
+	}
+
+	if len(args) == 0 {
+
+		return errors.New("usage: consumer tokens list | show <key>")
+	}
+
+	now := time.Now()
+
+	switch args[0] {
+
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tPRODUCER\tSERVICE\tPRICE\tUNITS LEFT\tEXPIRY\tSTATUS")
+
+		for _, held := range store.Tokens {
+
+			fmt.Fprintf(w, "%s\t%s\t%d - %s\t%d\t%d/%d %s\t%s\t%s\n",
+				held.Token.Key, held.ProducerUUID, held.ServiceID, held.ServiceName, held.PriceID,
+				held.remaining(), held.UnitsPaid, held.UnitDescription,
+				held.Token.Expiry.Format(time.RFC3339), held.status(now))
+		}
+
+		return w.Flush()
+
+	case "show":
+		if len(args) != 2 {
+
+			return errors.New("usage: consumer tokens show <key>")
+		}
+
+		held := store.find(args[1])
+
+		if held == nil {
+
+			return fmt.Errorf("no token with key %s", args[1])
+		}
+
+		fmt.Printf("Key: %s\n", held.Token.Key)
+		fmt.Printf("Status: %s\n", held.status(now))
+		fmt.Printf("Payment reference: %s\n", held.Reference)
+		fmt.Printf("Producer: %s\n", held.ProducerUUID)
+		fmt.Printf("Service: %d - %s\n", held.ServiceID, held.ServiceName)
+		fmt.Printf("Price ID: %d\n", held.PriceID)
+		fmt.Printf("Units paid: %d %s\n", held.UnitsPaid, held.UnitDescription)
+		fmt.Printf("Units used: %d %s\n", held.UnitsUsed, held.UnitDescription)
+		fmt.Printf("Issued: %s\n", held.Token.Issued)
+		fmt.Printf("Expiry: %s\n", held.Token.Expiry)
+		fmt.Printf("Refund on expiry: %t\n", held.Token.RefundOnExpiry)
+		if !held.LastUsed.IsZero() {
+
+			fmt.Printf("Last used: %s\n", held.LastUsed)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown tokens command %q", args[0])
+}
+
+func (held *heldToken) status(now time.Time) string {
+
+	switch {
+
+	case held.remaining() <= 0:
+		return "used"
+	case held.expired(now):
+		return "expired"
+	}
+
+	return "usable"
+}
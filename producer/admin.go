@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The admin API manages the running producer. It has no authentication, so should only
+// listen on localhost or a trusted network.
+
+// startAdmin starts the admin API listening on addr
+func startAdmin(addr string) error {
+
+	listener, err := net.Listen("tcp", addr)
+
+	if err != nil {
+
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", adminReload)
+	mux.HandleFunc("/maintenance", adminMaintenance)
+	mux.HandleFunc("/refunds", adminRefunds)
+	mux.HandleFunc("/health", adminHealth)
+	mux.HandleFunc("/sessions", adminSessions)
+	mux.HandleFunc("/faults", adminFaults)
+
+	go func() {
+
+		if err := http.Serve(listener, mux); err != nil {
+
+			log.Errorf("Admin API stopped: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// adminReload reloads the catalog file: POST /reload
+func adminReload(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use POST"})
+		return
+	}
+
+	result, err := reloadCatalog(flagCatalog, "admin API")
+
+	if err != nil {
+
+		writeJSON(w, http.StatusUnprocessableEntity, adminError{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// adminMaintenance shows maintenance mode: GET /maintenance, or switches it on or off:
+// POST /maintenance {"enabled": true, "reason": "replacing the red LED"}
+func adminMaintenance(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, wpwHandler.maintenance.status())
+	case http.MethodPost:
+		var request maintenanceStatus
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+
+		wpwHandler.maintenance.set(request.Enabled, request.Reason)
+		wpwHandler.refreshAvailability()
+
+		fmt.Printf("Maintenance mode enabled=%t %s\n", request.Enabled, request.Reason)
+		log.WithField("reason", request.Reason).Infof("Maintenance mode enabled=%t", request.Enabled)
+
+		writeJSON(w, http.StatusOK, wpwHandler.maintenance.status())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use GET or POST"})
+	}
+}
+
+// adminRefunds lists the refunds owed, refund-due and refund-pending, which have not been paid back: GET /refunds
+func adminRefunds(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use GET"})
+		return
+	}
+
+	outstanding, err := wpwHandler.outstandingRefunds()
+
+	if err != nil {
+
+		writeJSON(w, http.StatusInternalServerError, adminError{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, outstanding)
+}
+
+// adminHealth reports the broadcast, GPIO, PSP and session manager: GET /health. The status is
+// 503 Service Unavailable when any of them is unhealthy.
+func adminHealth(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use GET"})
+		return
+	}
+
+	report := wpwHandler.health()
+
+	if !report.OK {
+
+		writeJSON(w, http.StatusServiceUnavailable, report)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// sessionStatus is a delivery in progress, as listed by GET /sessions
+type sessionStatus struct {
+	TokenKey  string    `json:"tokenKey"`
+	ServiceID int       `json:"serviceId"`
+	PriceID   int       `json:"priceId"`
+	Units     int       `json:"units"`
+	Resources []string  `json:"resources"`
+	Started   time.Time `json:"started"`
+	Ends      time.Time `json:"ends"` // End of the paid time, or for count units the most time allowed
+}
+
+// adminSessions lists the deliveries in progress: GET /sessions
+func adminSessions(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use GET"})
+		return
+	}
+
+	statuses := make([]sessionStatus, 0)
+
+	for _, s := range wpwHandler.sessions.list() {
+
+		statuses = append(statuses, sessionStatus{
+			TokenKey:  s.tokenKey,
+			ServiceID: s.serviceID,
+			PriceID:   s.priceID,
+			Units:     s.units,
+			Resources: s.resources,
+			Started:   s.started,
+			Ends:      s.started.Add(s.duration),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// adminFaults lists the outputs found not to light: GET /faults, or clears the fault on an output,
+// putting its services back in the broadcast: POST /faults {"output": "red"}. An empty output clears every fault.
+func adminFaults(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, wpwHandler.faults.list())
+	case http.MethodPost:
+		var request struct {
+			Output string `json:"output"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+
+		if _, err := wpwHandler.clearFaults(request.Output); err != nil {
+
+			writeJSON(w, http.StatusInternalServerError, adminError{Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, wpwHandler.faults.list())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use GET or POST"})
+	}
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+
+		log.Errorf("Admin API response: %s", err.Error())
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockWindow is a span of the day, from HH:MM up to HH:MM. It spans midnight when to is earlier than from.
+type clockWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	from int // Minutes after midnight
+	to   int
+}
+
+func (window *clockWindow) parse() error {
+
+	from, err := parseClock(window.From)
+
+	if err != nil {
+
+		return fmt.Errorf("from: %s", err.Error())
+	}
+
+	to, err := parseClock(window.To)
+
+	if err != nil {
+
+		return fmt.Errorf("to: %s", err.Error())
+	}
+
+	window.from = from
+	window.to = to
+
+	return nil
+}
+
+// parseClock parses HH:MM into minutes after midnight
+func parseClock(value string) (int, error) {
+
+	t, err := time.Parse("15:04", value)
+
+	if err != nil {
+
+		return 0, fmt.Errorf("%q is not HH:MM", value)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (window *clockWindow) contains(now time.Time) bool {
+
+	minute := now.Hour()*60 + now.Minute()
+
+	if window.from <= window.to {
+
+		return minute >= window.from && minute < window.to
+	}
+
+	// Spans midnight, e.g. 22:00 to 06:00
+	return minute >= window.from || minute < window.to
+}
+
+// openingHours is when a service can be bought, on some days of the week or every day
+type openingHours struct {
+	Days []string `json:"days"` // mon, tue, wed, thu, fri, sat, sun. Every day when empty.
+
+	clockWindow
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (hours *openingHours) validate() error {
+
+	for _, day := range hours.Days {
+
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+
+	return hours.clockWindow.parse()
+}
+
+// open reports whether now is within the hours. For hours spanning midnight, the day is the day they start.
+func (hours *openingHours) open(now time.Time) bool {
+
+	if !hours.contains(now) {
+
+		return false
+	}
+
+	if len(hours.Days) == 0 {
+
+		return true
+	}
+
+	day := now.Weekday()
+
+	if hours.from > hours.to && now.Hour()*60+now.Minute() < hours.to {
+
+		day = (day + 6) % 7
+	}
+
+	for _, name := range hours.Days {
+
+		if weekdays[strings.ToLower(name)] == day {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (hours *openingHours) String() string {
+
+	if len(hours.Days) == 0 {
+
+		return fmt.Sprintf("%s-%s", hours.From, hours.To)
+	}
+
+	return fmt.Sprintf("%s %s-%s", strings.Join(hours.Days, ","), hours.From, hours.To)
+}
+
+// maintenanceMode stops new deliveries of every service, e.g. while the LEDs are being replaced
+type maintenanceMode struct {
+	mu      sync.Mutex
+	enabled bool
+	reason  string
+	since   time.Time
+}
+
+// maintenanceStatus is the admin API view of maintenance mode
+type maintenanceStatus struct {
+	Enabled bool      `json:"enabled"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since,omitempty"`
+}
+
+func (mode *maintenanceMode) set(enabled bool, reason string) {
+
+	mode.mu.Lock()
+	defer mode.mu.Unlock()
+
+	if enabled != mode.enabled {
+
+		mode.since = time.Now()
+	}
+
+	mode.enabled = enabled
+	mode.reason = reason
+}
+
+func (mode *maintenanceMode) status() maintenanceStatus {
+
+	mode.mu.Lock()
+	defer mode.mu.Unlock()
+
+	return maintenanceStatus{Enabled: mode.enabled, Reason: mode.reason, Since: mode.since}
+}
+
+// unavailable returns why a service cannot be bought at the time, or an empty string if it can
+func (handler *Handler) unavailable(svc *catalogService, now time.Time) string {
+
+	if status := handler.maintenance.status(); status.Enabled {
+
+		if status.Reason == "" {
+
+			return "maintenance"
+		}
+
+		return "maintenance - " + status.Reason
+	}
+
+	if reason := handler.faults.affects(svc); reason != "" {
+
+		return reason
+	}
+
+	if len(svc.Hours) == 0 {
+
+		return ""
+	}
+
+	var hours []string
+
+	for i := range svc.Hours {
+
+		if svc.Hours[i].open(now) {
+
+			return ""
+		}
+
+		hours = append(hours, svc.Hours[i].String())
+	}
+
+	return "closed, open " + strings.Join(hours, "; ")
+}
+
+// refreshAvailability marks the services which cannot be bought right now in their descriptions, so
+// consumers can see why before asking for a quote. Discovery still lists the service.
+func (handler *Handler) refreshAvailability() {
+
+	c, _ := handler.current()
+	now := time.Now()
+
+	sdkMu.Lock()
+	defer sdkMu.Unlock()
+
+	for i := range c.Services {
+
+		catalogSvc := &c.Services[i]
+		svc := handler.services[catalogSvc.ID]
+
+		if svc == nil {
+
+			continue
+		}
+
+		description := catalogSvc.Description
+
+		if reason := handler.unavailable(catalogSvc, now); reason != "" {
+
+			description += unavailableMarker + reason + "]"
+		}
+
+		if svc.Description != description {
+
+			svc.Description = description
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// catalog describes the outputs the producer drives and the services and prices it sells
+type catalog struct {
+	Units    []catalogUnit    `json:"units"`
+	Outputs  []catalogOutput  `json:"outputs"`
+	Inputs   []catalogInput   `json:"inputs"`
+	Services []catalogService `json:"services"`
+}
+
+// Unit kinds
+const (
+	unitTime  string = "time"  // A span of time, e.g. a second
+	unitCount string = "count" // Something the delivery plugin counts, e.g. a blink or a photo
+)
+
+// catalogUnit is a unit that prices are quoted in. For count units, seconds is the most time
+// allowed to deliver each unit before delivery is cut short.
+type catalogUnit struct {
+	ID          int    `json:"id"`
+	Description string `json:"description"`
+	Kind        string `json:"kind"` // time (default) or count
+	Seconds     int    `json:"seconds"`
+}
+
+func (unit *catalogUnit) isCount() bool {
+
+	return unit.Kind == unitCount
+}
+
+// catalogOutput is a GPIO output with an LED attached
+type catalogOutput struct {
+	Name         string          `json:"name"`
+	Pin          int             `json:"pin"`
+	HardwarePWM  bool            `json:"hardwarePwm"`  // Pin supports hardware PWM (GPIO 12, 13, 18 or 19)
+	PWMFrequency int             `json:"pwmFrequency"` // Hz, defaults to defaultPWMFrequency
+	Feedback     *outputFeedback `json:"feedback"`     // Optional sensor showing whether the LED lit
+}
+
+// catalogService is a service delivered by a single output, or a composite service
+// mixing several outputs, e.g. a colour made from the red, green and blue LEDs.
+type catalogService struct {
+	ID          int            `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Output      string         `json:"output"`
+	Outputs     []string       `json:"outputs"` // Composite services only
+	Prices      []catalogPrice `json:"prices"`
+	Hours       []openingHours `json:"hours"` // When the service can be bought, any time when empty
+
+	Plugin string          `json:"plugin"` // Delivery plugin, defaults to led
+	Config json.RawMessage `json:"config"` // Plugin specific, e.g. {"pin": 17} for a relay
+}
+
+func (svc *catalogService) pluginName() string {
+
+	if svc.Plugin == "" {
+
+		return defaultPlugin
+	}
+
+	return svc.Plugin
+}
+
+// outputNames returns the outputs driven by the service
+func (svc *catalogService) outputNames() []string {
+
+	if len(svc.Outputs) > 0 {
+
+		return svc.Outputs
+	}
+
+	return []string{svc.Output}
+}
+
+type catalogPrice struct {
+	ID          int                    `json:"id"`
+	Description string                 `json:"description"`
+	UnitID      int                    `json:"unitId"`
+	Amount      int                    `json:"amount"` // Minor units
+	Currency    string                 `json:"currency"`
+	MinUnits    int                    `json:"minUnits"`   // Fewest units in one purchase, 0 = no minimum
+	MaxUnits    int                    `json:"maxUnits"`   // Most units in one purchase or delivery, 0 = no maximum
+	Currencies  []catalogPriceCurrency `json:"currencies"` // The same price in other currencies
+	Brightness  int                    `json:"brightness"` // Percent, defaults to 100
+	RGB         []int                  `json:"rgb"`        // Composite services only, 0-255 for each of the service's outputs
+	Pattern     *catalogPattern        `json:"pattern"`    // Animate the outputs instead of holding them on
+}
+
+// catalogPriceCurrency offers a price in another currency. It is sold as a price of its own,
+// so needs an ID unique within the service.
+type catalogPriceCurrency struct {
+	ID       int    `json:"id"`
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// unitLimits is the marker for the purchase limits added to the description consumers see,
+// e.g. " [units: 5-120]", " [units: 5+]" or " [units: 1-120]". It is empty when there are no limits.
+func (price *catalogPrice) unitLimits() string {
+
+	if price.MinUnits == 0 && price.MaxUnits == 0 {
+
+		return ""
+	}
+
+	min := price.MinUnits
+
+	if min == 0 {
+
+		min = 1
+	}
+
+	if price.MaxUnits == 0 {
+
+		return fmt.Sprintf("%s%d+]", unitsMarker, min)
+	}
+
+	return fmt.Sprintf("%s%d-%d]", unitsMarker, min, price.MaxUnits)
+}
+
+// checkUnits returns an error if a purchase of units is outside the price's limits
+func (price *catalogPrice) checkUnits(units int) error {
+
+	if units <= 0 {
+
+		return fmt.Errorf("%d units cannot be bought", units)
+	}
+
+	if units < price.MinUnits {
+
+		return fmt.Errorf("at least %d units must be bought, not %d", price.MinUnits, units)
+	}
+
+	if price.MaxUnits > 0 && units > price.MaxUnits {
+
+		return fmt.Errorf("at most %d units can be bought, not %d", price.MaxUnits, units)
+	}
+
+	return nil
+}
+
+// levels returns the brightness percentage of each output for a price of the service
+func (svc *catalogService) levels(price *catalogPrice) map[string]int {
+
+	levels := make(map[string]int, 0)
+
+	if len(svc.Outputs) == 0 {
+
+		levels[svc.Output] = price.Brightness
+		return levels
+	}
+
+	for i, name := range svc.Outputs {
+
+		if len(price.RGB) == 0 {
+
+			levels[name] = price.Brightness
+			continue
+		}
+
+		levels[name] = (price.RGB[i]*price.Brightness + 127) / 255
+	}
+
+	return levels
+}
+
+func loadCatalog(path string) (*catalog, error) {
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	var c catalog
+
+	if err := json.Unmarshal(data, &c); err != nil {
+
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	if err := c.validate(); err != nil {
+
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return &c, nil
+}
+
+// validate checks the catalog is consistent and fills in defaults
+func (c *catalog) validate() error {
+
+	if len(c.Services) == 0 {
+
+		return errors.New("no services defined")
+	}
+
+	unitIDs := make(map[int]bool, 0)
+
+	for i := range c.Units {
+
+		unit := &c.Units[i]
+
+		if unitIDs[unit.ID] {
+
+			return fmt.Errorf("duplicate unit id %d", unit.ID)
+		}
+
+		if unit.Kind == "" {
+
+			unit.Kind = unitTime
+		}
+
+		if unit.Kind != unitTime && unit.Kind != unitCount {
+
+			return fmt.Errorf("unit %d: kind must be %s or %s", unit.ID, unitTime, unitCount)
+		}
+
+		if unit.Seconds <= 0 {
+
+			return fmt.Errorf("unit %d must be at least one second", unit.ID)
+		}
+
+		unitIDs[unit.ID] = true
+	}
+
+	outputs := make(map[string]bool, 0)
+
+	for i := range c.Outputs {
+
+		output := &c.Outputs[i]
+
+		if output.Name == "" || outputs[output.Name] {
+
+			return fmt.Errorf("output names must be unique and not empty (%q)", output.Name)
+		}
+
+		if output.PWMFrequency < 0 {
+
+			return fmt.Errorf("output %s: negative PWM frequency", output.Name)
+		}
+
+		if output.PWMFrequency == 0 {
+
+			output.PWMFrequency = defaultPWMFrequency
+		}
+
+		if output.Feedback != nil {
+
+			if err := output.Feedback.validate(); err != nil {
+
+				return fmt.Errorf("output %s: %s", output.Name, err.Error())
+			}
+		}
+
+		outputs[output.Name] = true
+	}
+
+	serviceIDs := make(map[int]bool, 0)
+
+	for i := range c.Services {
+
+		svc := &c.Services[i]
+
+		if serviceIDs[svc.ID] {
+
+			return fmt.Errorf("duplicate service id %d", svc.ID)
+		}
+
+		serviceIDs[svc.ID] = true
+
+		for j := range svc.Hours {
+
+			if err := svc.Hours[j].validate(); err != nil {
+
+				return fmt.Errorf("service %d hours %d: %s", svc.ID, j+1, err.Error())
+			}
+		}
+
+		if _, ok := plugins[svc.pluginName()]; !ok {
+
+			return fmt.Errorf("service %d: unknown plugin %q", svc.ID, svc.pluginName())
+		}
+
+		if svc.pluginName() != "led" {
+
+			if err := svc.validatePrices(unitIDs); err != nil {
+
+				return err
+			}
+
+			if svc.pluginName() == "relay" {
+
+				for _, price := range svc.Prices {
+
+					if c.unit(price.UnitID).isCount() {
+
+						return fmt.Errorf("service %d price %d: the relay plugin cannot count units", svc.ID, price.ID)
+					}
+				}
+			}
+
+			continue
+		}
+
+		if svc.Output != "" && len(svc.Outputs) > 0 {
+
+			return fmt.Errorf("service %d: set either output or outputs, not both", svc.ID)
+		}
+
+		used := make(map[string]bool, 0)
+
+		for _, name := range svc.outputNames() {
+
+			if !outputs[name] {
+
+				return fmt.Errorf("service %d: unknown output %q", svc.ID, name)
+			}
+
+			if used[name] {
+
+				return fmt.Errorf("service %d: output %s listed twice", svc.ID, name)
+			}
+
+			used[name] = true
+		}
+
+		if err := svc.validatePrices(unitIDs); err != nil {
+
+			return err
+		}
+
+		for j := range svc.Prices {
+
+			price := &svc.Prices[j]
+
+			if price.Brightness == 0 {
+
+				price.Brightness = 100
+			}
+
+			if price.Brightness < 0 || price.Brightness > 100 {
+
+				return fmt.Errorf("service %d price %d: brightness must be 1-100", svc.ID, price.ID)
+			}
+
+			if len(svc.Outputs) == 0 && len(price.RGB) > 0 {
+
+				return fmt.Errorf("service %d price %d: rgb is only valid on composite services", svc.ID, price.ID)
+			}
+
+			if len(svc.Outputs) > 0 && (len(price.RGB) > 0 || price.Pattern == nil) {
+
+				if len(price.RGB) != len(svc.Outputs) {
+
+					return fmt.Errorf("service %d price %d: rgb needs a value for each of %d outputs", svc.ID, price.ID, len(svc.Outputs))
+				}
+
+				for _, v := range price.RGB {
+
+					if v < 0 || v > 255 {
+
+						return fmt.Errorf("service %d price %d: rgb values must be 0-255", svc.ID, price.ID)
+					}
+				}
+			}
+
+			if price.Pattern != nil {
+
+				if err := price.Pattern.validate(len(svc.outputNames())); err != nil {
+
+					return fmt.Errorf("service %d price %d: %s", svc.ID, price.ID, err.Error())
+				}
+			}
+
+			// The LED plugin counts pattern cycles, so a steady light cannot be sold by count
+			if c.unit(price.UnitID).isCount() && (price.Pattern == nil || price.Pattern.Type == patternBreathe) {
+
+				return fmt.Errorf("service %d price %d: count units need a blink, morse or chase pattern", svc.ID, price.ID)
+			}
+		}
+	}
+
+	return c.validateInputs()
+}
+
+// validatePrices checks the fields every price has, whichever plugin delivers the service
+func (svc *catalogService) validatePrices(unitIDs map[int]bool) error {
+
+	if len(svc.Prices) == 0 {
+
+		return fmt.Errorf("service %d: no prices", svc.ID)
+	}
+
+	svc.expandCurrencies()
+
+	if svc.pluginName() != "led" && (svc.Output != "" || len(svc.Outputs) > 0) {
+
+		return fmt.Errorf("service %d: outputs are only used by the led plugin", svc.ID)
+	}
+
+	priceIDs := make(map[int]bool, 0)
+
+	for j := range svc.Prices {
+
+		price := &svc.Prices[j]
+
+		if priceIDs[price.ID] {
+
+			return fmt.Errorf("service %d: duplicate price id %d", svc.ID, price.ID)
+		}
+
+		priceIDs[price.ID] = true
+
+		if !unitIDs[price.UnitID] {
+
+			return fmt.Errorf("service %d price %d: unknown unit %d", svc.ID, price.ID, price.UnitID)
+		}
+
+		if price.Amount < 0 || price.Currency == "" {
+
+			return fmt.Errorf("service %d price %d: amount and currency are required", svc.ID, price.ID)
+		}
+
+		if price.MinUnits < 0 || price.MaxUnits < 0 || (price.MaxUnits > 0 && price.MaxUnits < price.MinUnits) {
+
+			return fmt.Errorf("service %d price %d: minUnits and maxUnits must not be negative, and maxUnits must not be less than minUnits", svc.ID, price.ID)
+		}
+
+		if svc.pluginName() != "led" && (price.Brightness != 0 || len(price.RGB) > 0 || price.Pattern != nil) {
+
+			return fmt.Errorf("service %d price %d: brightness, rgb and pattern are only used by the led plugin", svc.ID, price.ID)
+		}
+	}
+
+	return nil
+}
+
+// expandCurrencies adds a price for each other currency a price is offered in, copying everything
+// but the ID, amount and currency, so the producer offers them all
+func (svc *catalogService) expandCurrencies() {
+
+	var alternates []catalogPrice
+
+	for j := range svc.Prices {
+
+		for _, currency := range svc.Prices[j].Currencies {
+
+			alternate := svc.Prices[j]
+			alternate.ID = currency.ID
+			alternate.Amount = currency.Amount
+			alternate.Currency = currency.Currency
+			alternate.Currencies = nil
+
+			alternates = append(alternates, alternate)
+		}
+
+		svc.Prices[j].Currencies = nil
+	}
+
+	svc.Prices = append(svc.Prices, alternates...)
+}
+
+func (c *catalog) unit(id int) *catalogUnit {
+
+	for i := range c.Units {
+
+		if c.Units[i].ID == id {
+
+			return &c.Units[i]
+		}
+	}
+
+	return nil
+}
+
+func (c *catalog) output(name string) *catalogOutput {
+
+	for i := range c.Outputs {
+
+		if c.Outputs[i].Name == name {
+
+			return &c.Outputs[i]
+		}
+	}
+
+	return nil
+}
+
+func (c *catalog) service(id int) *catalogService {
+
+	for i := range c.Services {
+
+		if c.Services[i].ID == id {
+
+			return &c.Services[i]
+		}
+	}
+
+	return nil
+}
+
+func (c *catalog) price(serviceID int, priceID int) *catalogPrice {
+
+	svc := c.service(serviceID)
+
+	if svc == nil {
+
+		return nil
+	}
+
+	for i := range svc.Prices {
+
+		if svc.Prices[i].ID == priceID {
+
+			return &svc.Prices[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+// The descriptions here are the ones consumer/limits_test.go reads back
+func TestUnitLimits(t *testing.T) {
+
+	tests := []struct {
+		minUnits int
+		maxUnits int
+		want     string
+	}{
+		{0, 0, ""},
+		{0, 600, " [units: 1-600]"},
+		{5, 120, " [units: 5-120]"},
+		{5, 0, " [units: 5+]"},
+		{30, 30, " [units: 30-30]"},
+	}
+
+	for _, test := range tests {
+
+		price := catalogPrice{MinUnits: test.minUnits, MaxUnits: test.maxUnits}
+
+		if got := price.unitLimits(); got != test.want {
+
+			t.Errorf("minUnits %d maxUnits %d: got %q, want %q", test.minUnits, test.maxUnits, got, test.want)
+		}
+	}
+}
+
+func TestNewServiceDescribesLimits(t *testing.T) {
+
+	c := &catalog{
+		Units: []catalogUnit{{ID: 1, Description: "Second", Seconds: 1}},
+		Services: []catalogService{{
+			ID:          1,
+			Name:        "RGB LED",
+			Description: "Mix a colour",
+			Prices: []catalogPrice{
+				{ID: 1, Description: "Purple (255,0,255)", UnitID: 1, Amount: 10, Currency: "GBP", MaxUnits: 600},
+				{ID: 2, Description: "White (255,255,255)", UnitID: 1, Amount: 12, Currency: "GBP"},
+			},
+		}},
+	}
+
+	svc, err := newService(c, c.Services[0])
+
+	if err != nil {
+
+		t.Fatalf("newService: %s", err.Error())
+	}
+
+	want := map[int]string{
+		1: "Purple (255,0,255) [units: 1-600]",
+		2: "White (255,255,255)",
+	}
+
+	for id, description := range want {
+
+		if got := svc.Prices[id].Description; got != description {
+
+			t.Errorf("price %d: got %q, want %q", id, got, description)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command is a producer subcommand, e.g. producer catalog validate <file>
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string)
+}
+
+var commands = []command{
+	{name: "serve", summary: "Run the producer, broadcasting its services (the default)", run: serve},
+	{name: "catalog validate", args: "<file>", summary: "Check a catalog file without running the producer (default -catalog)", run: catalogValidate},
+	{name: "outputs test", summary: "Turn each output in the catalog on for -testms, in turn, to check the wiring", run: outputsTest},
+	{name: "outputs selftest", summary: "Light each output in turn, asking whether it lit and reading the pin back (-readback, -calibrate)", run: outputsSelfTest},
+	{name: "sessions list", summary: "List the deliveries in progress on the running producer, through the admin API", run: sessionsList},
+	{name: "ledger export", summary: "Write the ledger to stdout as -format csv or json", run: ledgerExport},
+}
+
+// findCommand returns the subcommand named at the start of args, and the args after it. With no
+// subcommand, as when flags come first, the producer serves.
+func findCommand(args []string) (command, []string) {
+
+	for _, cmd := range commands {
+
+		words := strings.Fields(cmd.name)
+
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+
+			return cmd, args[len(words):]
+		}
+	}
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+
+		fmt.Printf("Unknown command: %s\n\n", strings.Join(args, " "))
+		usage()
+		os.Exit(2)
+	}
+
+	return commands[0], args
+}
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "Usage: producer [command] [flags] [args]\n\nCommands:\n")
+
+	for _, cmd := range commands {
+
+		fmt.Fprintf(os.Stderr, "  %-30s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func catalogValidate(args []string) {
+
+	path := flagCatalog
+
+	if len(args) > 0 {
+
+		path = args[0]
+	}
+
+	c, err := loadCatalog(path)
+	errCheck(err, fmt.Sprintf("validate %s", path))
+
+	prices := 0
+
+	for _, svc := range c.Services {
+
+		prices += len(svc.Prices)
+	}
+
+	fmt.Printf("%s is valid: %d outputs, %d units, %d services, %d prices\n", path, len(c.Outputs), len(c.Units), len(c.Services), prices)
+}
+
+func outputsTest(args []string) {
+
+	c, err := loadCatalog(flagCatalog)
+	errCheck(err, "loadCatalog()")
+
+	outputs, _, err := openOutputs(c, flagIgnoreGPIO)
+	errCheck(err, "open outputs")
+
+	duration := time.Duration(flagTestMillis) * time.Millisecond
+
+	for _, config := range c.Outputs {
+
+		out := outputs[config.Name]
+
+		fmt.Printf("Testing %s for %s\n", out.label(), duration)
+		out.on(100)
+		time.Sleep(duration)
+		out.off()
+	}
+
+	fmt.Printf("Tested %d outputs\n", len(c.Outputs))
+}
+
+func sessionsList(args []string) {
+
+	if flagAdminAddr == "" {
+
+		errCheck(errors.New("-adminaddr is empty"), "sessions list")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + flagAdminAddr + "/sessions")
+	errCheck(err, "GET /sessions, is the producer running?")
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+
+		errCheck(fmt.Errorf("admin API answered %s", resp.Status), "GET /sessions")
+	}
+
+	var sessions []sessionStatus
+
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	errCheck(err, "decode sessions")
+
+	if len(sessions) == 0 {
+
+		fmt.Println("No deliveries in progress")
+		return
+	}
+
+	for _, s := range sessions {
+
+		fmt.Printf("token=%s service=%d price=%d units=%d started=%s ends=%s resources=%s\n",
+			s.TokenKey, s.ServiceID, s.PriceID, s.Units, s.Started.Format(time.RFC3339), s.Ends.Format(time.RFC3339), strings.Join(s.Resources, ","))
+	}
+}
+
+func ledgerExport(args []string) {
+
+	entries, err := newLedger(flagLedger).entries()
+	errCheck(err, "read ledger")
+
+	switch flagExportFormat {
+
+	case "json":
+		if entries == nil {
+
+			entries = []ledgerEntry{}
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "\t")
+		errCheck(encoder.Encode(entries), "write ledger")
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"time", "type", "tokenKey", "reference", "serviceId", "priceId", "unit", "unitsPaid", "unitsDelivered", "unitsReported", "amount", "currency", "reason"})
+
+		for _, e := range entries {
+
+			w.Write([]string{
+				e.Time.Format(time.RFC3339), e.Type, e.TokenKey, e.Reference, strconv.Itoa(e.ServiceID), strconv.Itoa(e.PriceID), e.Unit,
+				strconv.Itoa(e.UnitsPaid), strconv.Itoa(e.UnitsDelivered), strconv.Itoa(e.UnitsReported), strconv.Itoa(e.Amount), e.Currency, e.Reason,
+			})
+		}
+
+		w.Flush()
+		errCheck(w.Error(), "write ledger")
+	default:
+		errCheck(fmt.Errorf("unknown format %q, use csv or json", flagExportFormat), "ledger export")
+	}
+}
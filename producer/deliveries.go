@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Delivery states, as reported to consumers
+const (
+	deliveryStarted   string = "started"   // Accepted, the plugin is starting
+	deliveryRunning   string = "running"   // The outputs are being driven
+	deliveryCompleted string = "completed" // Every unit asked for was delivered
+	deliveryAborted   string = "aborted"   // Refused, or ended before every unit was delivered
+)
+
+// deliveryHistoryLimit bounds the deliveries remembered for status requests
+const deliveryHistoryLimit = 1024
+
+// deliveryStatus is the latest delivery for a token, served to consumers on the status port
+type deliveryStatus struct {
+	TokenKey       string    `json:"tokenKey"`
+	Delivery       int       `json:"delivery"` // 1 for the token's first delivery, 2 for the next, so a new one can be told from the last
+	ServiceID      int       `json:"serviceId"`
+	PriceID        int       `json:"priceId"`
+	State          string    `json:"state"`
+	UnitsRequested int       `json:"unitsRequested"`
+	UnitsDelivered int       `json:"unitsDelivered"`
+	Started        time.Time `json:"started"`
+	Ends           time.Time `json:"ends,omitempty"` // When a running delivery is due to end
+	Ended          time.Time `json:"ended,omitempty"`
+	Reason         string    `json:"reason,omitempty"` // Why a delivery was aborted
+}
+
+// deliveryTracker remembers the latest delivery for each token, forgetting the oldest beyond the limit
+type deliveryTracker struct {
+	mu      sync.Mutex
+	byToken map[string]*deliveryStatus
+	order   []string
+}
+
+func (tracker *deliveryTracker) update(tokenKey string, fn func(status *deliveryStatus)) {
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.byToken == nil {
+
+		tracker.byToken = make(map[string]*deliveryStatus, 0)
+	}
+
+	status, ok := tracker.byToken[tokenKey]
+
+	if !ok {
+
+		status = &deliveryStatus{TokenKey: tokenKey}
+		tracker.byToken[tokenKey] = status
+		tracker.order = append(tracker.order, tokenKey)
+
+		if len(tracker.order) > deliveryHistoryLimit {
+
+			delete(tracker.byToken, tracker.order[0])
+			tracker.order = tracker.order[1:]
+		}
+	}
+
+	fn(status)
+}
+
+// started records a session about to start, replacing any earlier delivery on the token
+func (tracker *deliveryTracker) started(s *session) {
+
+	tracker.update(s.tokenKey, func(status *deliveryStatus) {
+
+		*status = deliveryStatus{
+			TokenKey:       s.tokenKey,
+			Delivery:       status.Delivery + 1,
+			ServiceID:      s.serviceID,
+			PriceID:        s.priceID,
+			State:          deliveryStarted,
+			UnitsRequested: s.units,
+			Started:        s.started,
+			Ends:           s.started.Add(s.duration),
+		}
+	})
+}
+
+func (tracker *deliveryTracker) running(tokenKey string) {
+
+	tracker.update(tokenKey, func(status *deliveryStatus) {
+
+		status.State = deliveryRunning
+	})
+}
+
+// ended records how many units a delivery delivered, aborted if it was short
+func (tracker *deliveryTracker) ended(tokenKey string, delivered int, reason string) {
+
+	tracker.update(tokenKey, func(status *deliveryStatus) {
+
+		status.State = deliveryCompleted
+		status.UnitsDelivered = delivered
+		status.Ended = time.Now()
+
+		if delivered < status.UnitsRequested {
+
+			status.State = deliveryAborted
+			status.Reason = reason
+		}
+	})
+}
+
+// refused records a delivery which was never started. A delivery in progress on the token is left alone.
+func (tracker *deliveryTracker) refused(tokenKey string, serviceID int, priceID int, units int, reason string) {
+
+	tracker.update(tokenKey, func(status *deliveryStatus) {
+
+		if status.State == deliveryStarted || status.State == deliveryRunning {
+
+			return
+		}
+
+		now := time.Now()
+
+		*status = deliveryStatus{
+			TokenKey:       tokenKey,
+			Delivery:       status.Delivery + 1,
+			ServiceID:      serviceID,
+			PriceID:        priceID,
+			State:          deliveryAborted,
+			UnitsRequested: units,
+			Started:        now,
+			Ended:          now,
+			Reason:         reason,
+		}
+	})
+}
+
+func (tracker *deliveryTracker) find(tokenKey string) (deliveryStatus, bool) {
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	status, ok := tracker.byToken[tokenKey]
+
+	if !ok {
+
+		return deliveryStatus{}, false
+	}
+
+	return *status, true
+}
+
+// startStatusServer serves consumers the status of their deliveries, GET /deliveries/<token>, and of their
+// quotes, GET /quotes/<payment reference>. Unlike the admin API it listens on every interface, so only
+// answers for a token or reference the consumer already holds.
+func startStatusServer(port int) error {
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+
+	if err != nil {
+
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deliveries/", statusDelivery)
+	mux.HandleFunc("/quotes/", statusQuote)
+
+	go func() {
+
+		if err := http.Serve(listener, mux); err != nil {
+
+			log.Errorf("Delivery status server stopped: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func statusDelivery(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use GET"})
+		return
+	}
+
+	tokenKey := strings.TrimPrefix(r.URL.Path, "/deliveries/")
+	status, ok := wpwHandler.deliveries.find(tokenKey)
+
+	if tokenKey == "" || !ok {
+
+		writeJSON(w, http.StatusNotFound, adminError{Error: "no delivery for the token"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// quoteStatus tells a consumer whether a quote can be paid for, as the SDK cannot refuse one
+type quoteStatus struct {
+	Reference string `json:"reference"`
+	ServiceID int    `json:"serviceId"`
+	PriceID   int    `json:"priceId"`
+	Units     int    `json:"units"`
+	Total     int    `json:"total"`
+	Currency  string `json:"currency"`
+	Paid      bool   `json:"paid"`
+	Refused   string `json:"refused,omitempty"`
+}
+
+func statusQuote(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "use GET"})
+		return
+	}
+
+	reference := strings.TrimPrefix(r.URL.Path, "/quotes/")
+	quote, ok := wpwHandler.tokens.quote(reference)
+
+	if reference == "" || !ok {
+
+		writeJSON(w, http.StatusNotFound, adminError{Error: "no quote with the reference"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, quoteStatus{
+		Reference: quote.Reference,
+		ServiceID: quote.ServiceID,
+		PriceID:   quote.PriceID,
+		Units:     quote.Units,
+		Total:     quote.Total,
+		Currency:  quote.Currency,
+		Paid:      !quote.Paid.IsZero(),
+		Refused:   quote.Refused,
+	})
+}
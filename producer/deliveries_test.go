@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveriesNumbered(t *testing.T) {
+
+	tracker := &deliveryTracker{}
+	s := &session{tokenKey: "tok", serviceID: 1, priceID: 1, units: 5, started: time.Now(), duration: 5 * time.Second}
+
+	tracker.started(s)
+	tracker.refused("tok", 1, 1, 5, "in use") // Left alone, the first is in progress
+	tracker.ended("tok", 5, "")
+
+	if status, _ := tracker.find("tok"); status.Delivery != 1 || status.State != deliveryCompleted {
+
+		t.Fatalf("first delivery is %+v", status)
+	}
+
+	tracker.refused("tok", 1, 1, 5, "used up")
+
+	if status, _ := tracker.find("tok"); status.Delivery != 2 || status.State != deliveryAborted {
+
+		t.Fatalf("refused delivery is %+v", status)
+	}
+
+	tracker.started(s)
+
+	if status, _ := tracker.find("tok"); status.Delivery != 3 || status.State != deliveryStarted {
+
+		t.Fatalf("third delivery is %+v", status)
+	}
+}
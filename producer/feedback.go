@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stianeikeland/go-rpio"
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// defaultFeedbackDelayMs is how long after an output is lit its sensor is read
+const defaultFeedbackDelayMs = 100
+
+// outputFeedback is a sensor showing whether an output's LED is lit: a photoresistor on a digital input
+// pin, e.g. through a comparator, or an ADC reading from sysfs
+type outputFeedback struct {
+	Pin       int    `json:"pin"`       // GPIO input which reads high when the LED is lit
+	ADC       string `json:"adc"`       // Or a sysfs IIO raw reading, e.g. /sys/bus/iio/devices/iio:device0/in_voltage0_raw
+	Threshold int    `json:"threshold"` // ADC reading at or above which the LED is lit
+	ActiveLow bool   `json:"activeLow"` // The pin reads low, or the ADC reads at or below threshold, when lit
+	DelayMs   int    `json:"delayMs"`   // Default defaultFeedbackDelayMs
+}
+
+func (feedback *outputFeedback) validate() error {
+
+	if (feedback.Pin > 0) == (feedback.ADC != "") {
+
+		return errors.New("feedback needs either a pin or an adc")
+	}
+
+	if feedback.ADC != "" && feedback.Threshold <= 0 {
+
+		return errors.New("feedback from an adc needs a threshold")
+	}
+
+	if feedback.DelayMs < 0 {
+
+		return errors.New("negative feedback delay")
+	}
+
+	if feedback.DelayMs == 0 {
+
+		feedback.DelayMs = defaultFeedbackDelayMs
+	}
+
+	return nil
+}
+
+// lightSensor reports whether an output's LED is lit
+type lightSensor interface {
+	lit() (bool, error)
+}
+
+type pinSensor struct {
+	pin       rpio.Pin
+	activeLow bool
+}
+
+func (sensor *pinSensor) lit() (bool, error) {
+
+	return (sensor.pin.Read() == rpio.High) != sensor.activeLow, nil
+}
+
+type adcSensor struct {
+	path      string
+	threshold int
+	activeLow bool
+}
+
+func (sensor *adcSensor) lit() (bool, error) {
+
+	data, err := ioutil.ReadFile(sensor.path)
+
+	if err != nil {
+
+		return false, err
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+
+	if err != nil {
+
+		return false, fmt.Errorf("%s: %s", sensor.path, err.Error())
+	}
+
+	if sensor.activeLow {
+
+		return value <= sensor.threshold, nil
+	}
+
+	return value >= sensor.threshold, nil
+}
+
+// openSensors sets up the feedback sensor of each output which has one. Pin sensors need GPIO.
+func openSensors(c *catalog, rpioenabled bool) map[string]lightSensor {
+
+	sensors := make(map[string]lightSensor, 0)
+
+	for _, config := range c.Outputs {
+
+		feedback := config.Feedback
+
+		if feedback == nil {
+
+			continue
+		}
+
+		if feedback.ADC != "" {
+
+			sensors[config.Name] = &adcSensor{path: feedback.ADC, threshold: feedback.Threshold, activeLow: feedback.ActiveLow}
+			continue
+		}
+
+		if !rpioenabled {
+
+			fmt.Printf("GPIO is not available, ignoring the feedback sensor of %s\n", config.Name)
+			continue
+		}
+
+		pin := rpio.Pin(feedback.Pin)
+		pin.Input()
+		sensors[config.Name] = &pinSensor{pin: pin, activeLow: feedback.ActiveLow}
+	}
+
+	return sensors
+}
+
+// outputFault is an output found not to light. Its services are kept out of the broadcast until it is cleared.
+type outputFault struct {
+	Output string    `json:"output"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// outputFaults are the faulty outputs, kept in a JSON file so a restart does not put them back in the broadcast
+type outputFaults struct {
+	mu     sync.Mutex
+	path   string // Not saved when empty
+	faults map[string]outputFault
+}
+
+// load reads the faults saved at path, and saves them there from now on
+func (f *outputFaults) load(path string) error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.path = path
+	f.faults = make(map[string]outputFault, 0)
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+
+		return nil
+	} else if err != nil {
+
+		return err
+	}
+
+	var faults []outputFault
+
+	if err := json.Unmarshal(data, &faults); err != nil {
+
+		return fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	for _, fault := range faults {
+
+		f.faults[fault.Output] = fault
+	}
+
+	return nil
+}
+
+// save writes the faults to the file. Must be called with mu held.
+func (f *outputFaults) save() error {
+
+	if f.path == "" {
+
+		return nil
+	}
+
+	faults := make([]outputFault, 0)
+
+	for _, fault := range f.faults {
+
+		faults = append(faults, fault)
+	}
+
+	sort.Slice(faults, func(i, j int) bool {
+
+		return faults[i].Output < faults[j].Output
+	})
+
+	data, err := json.MarshalIndent(faults, "", "\t")
+
+	if err != nil {
+
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+
+		return err
+	}
+
+	return os.Rename(tmp, f.path)
+}
+
+// mark records an output as faulty. It is faulty from now on even if it cannot be saved.
+func (f *outputFaults) mark(output string, reason string, now time.Time) error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.faults == nil {
+
+		f.faults = make(map[string]outputFault, 0)
+	}
+
+	f.faults[output] = outputFault{Output: output, Reason: reason, Since: now}
+
+	return f.save()
+}
+
+// clear clears the fault on an output, or on every output when output is empty, returning the outputs cleared
+func (f *outputFaults) clear(output string) ([]string, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var cleared []string
+
+	for name := range f.faults {
+
+		if output == "" || name == output {
+
+			cleared = append(cleared, name)
+			delete(f.faults, name)
+		}
+	}
+
+	sort.Strings(cleared)
+
+	if len(cleared) == 0 {
+
+		return nil, nil
+	}
+
+	return cleared, f.save()
+}
+
+// list returns the faults, by output name
+func (f *outputFaults) list() []outputFault {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	faults := make([]outputFault, 0)
+
+	for _, fault := range f.faults {
+
+		faults = append(faults, fault)
+	}
+
+	sort.Slice(faults, func(i, j int) bool {
+
+		return faults[i].Output < faults[j].Output
+	})
+
+	return faults
+}
+
+// affects returns why a service cannot be delivered because one of its outputs is faulty, or an empty string
+func (f *outputFaults) affects(svc *catalogService) string {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if svc.pluginName() != "led" {
+
+		return ""
+	}
+
+	for _, name := range svc.outputNames() {
+
+		if fault, ok := f.faults[name]; ok {
+
+			return fmt.Sprintf("output %s faulty, %s", name, fault.Reason)
+		}
+	}
+
+	return ""
+}
+
+// checkFeedback reads the sensors of the session's outputs lit at full brightness, shortly after they
+// were lit. Outputs which did not light are marked faulty, the session is aborted and the services using
+// them are taken out of the broadcast. Patterns and dimmed levels are not checked, as the LED is not steady.
+func (handler *Handler) checkFeedback(s *session, levels map[string]int) {
+
+	defer handler.recoverCallback("checkFeedback", s.serviceID, "")
+
+	c, _ := handler.current()
+
+	var names []string
+	delay := 0
+
+	for _, name := range s.resources {
+
+		output := c.output(name)
+
+		if levels[name] < 100 || handler.sensors[name] == nil || output == nil || output.Feedback == nil {
+
+			continue
+		}
+
+		names = append(names, name)
+
+		if output.Feedback.DelayMs > delay {
+
+			delay = output.Feedback.DelayMs
+		}
+	}
+
+	if len(names) == 0 {
+
+		return
+	}
+
+	select {
+	case <-s.ended:
+		return
+	case <-time.After(time.Duration(delay) * time.Millisecond):
+	}
+
+	var faulty []string
+	now := time.Now()
+
+	for _, name := range names {
+
+		lit, err := handler.sensors[name].lit()
+
+		if err != nil {
+
+			// A sensor which cannot be read says nothing about the LED
+			log.WithField("output", name).Errorf("Feedback sensor read failed: %s", err.Error())
+			continue
+		}
+
+		if lit {
+
+			continue
+		}
+
+		reason := fmt.Sprintf("did not light for token %s", s.tokenKey)
+
+		if err := handler.faults.mark(name, reason, now); err != nil {
+
+			log.WithField("output", name).Errorf("Failed to save fault: %s", err.Error())
+		}
+		faulty = append(faulty, name)
+
+		fmt.Printf("FAULT: %s did not light, aborting delivery of service %d\n", handler.outputs[name].label(), s.serviceID)
+		log.WithFields(log.Fields{"output": name, "serviceID": s.serviceID, "token": s.tokenKey}).Error("Output did not light")
+
+		entry := ledgerEntry{
+			Time:      now,
+			Type:      ledgerFault,
+			TokenKey:  s.tokenKey,
+			ServiceID: s.serviceID,
+			PriceID:   s.priceID,
+			Reason:    fmt.Sprintf("output %s %s", name, reason),
+		}
+
+		if err := handler.ledger.append(entry); err != nil {
+
+			log.WithField("token", s.tokenKey).Errorf("Failed to write ledger: %s", err.Error())
+		}
+	}
+
+	if len(faulty) == 0 {
+
+		return
+	}
+
+	// Ended as if by the consumer, so the undelivered units are owed back
+	handler.EndServiceDelivery(s.serviceID, types.ServiceDeliveryToken{Key: s.tokenKey}, 0)
+
+	if err := handler.updateBroadcast(); err != nil {
+
+		log.Errorf("Failed to take faulty services out of the broadcast: %s", err.Error())
+	}
+}
+
+// clearFaults clears the fault on an output, or every output when output is empty, and puts its
+// services back in the broadcast
+func (handler *Handler) clearFaults(output string) ([]string, error) {
+
+	cleared, err := handler.faults.clear(output)
+
+	if err != nil {
+
+		// Cleared in memory, but the file still has the fault and would bring it back on a restart
+		log.WithField("outputs", cleared).Errorf("Failed to save cleared faults: %s", err.Error())
+	}
+
+	if len(cleared) == 0 {
+
+		return nil, nil
+	}
+
+	fmt.Printf("Cleared faults on %s\n", strings.Join(cleared, ", "))
+	log.WithField("outputs", cleared).Info("Output faults cleared")
+
+	return cleared, handler.updateBroadcast()
+}
+
+// updateBroadcast removes the services using a faulty output from the broadcast, and adds back those
+// whose outputs have been cleared
+func (handler *Handler) updateBroadcast() error {
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := handler.updateServices(); err != nil {
+
+		return err
+	}
+
+	handler.refreshAvailability()
+
+	return nil
+}
+
+// updateServices adds and removes the services, holding sdkMu as the device's services are the map
+// lookupService reads
+func (handler *Handler) updateServices() error {
+
+	sdkMu.Lock()
+	defer sdkMu.Unlock()
+
+	c, _ := handler.current()
+	device := wpw.GetDevice()
+
+	for i := range c.Services {
+
+		catalogSvc := &c.Services[i]
+		svc, offered := device.Services[catalogSvc.ID]
+		reason := handler.faults.affects(catalogSvc)
+
+		switch {
+
+		case reason != "" && offered:
+			if err := wpw.RemoveService(svc); err != nil {
+
+				return fmt.Errorf("remove service %d: %s", catalogSvc.ID, err.Error())
+			}
+
+			fmt.Printf("Service %d removed from the broadcast: %s\n", catalogSvc.ID, reason)
+		case reason == "" && !offered:
+			svc, err := newService(c, *catalogSvc)
+
+			if err != nil {
+
+				return fmt.Errorf("new service %d: %s", catalogSvc.ID, err.Error())
+			}
+
+			if err := wpw.AddService(svc); err != nil {
+
+				return fmt.Errorf("add service %d: %s", catalogSvc.ID, err.Error())
+			}
+
+			fmt.Printf("Service %d back in the broadcast\n", catalogSvc.ID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFaultsKeptAcrossRestart(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "faults.json")
+	now := time.Now().Truncate(time.Second)
+
+	var before outputFaults
+
+	if err := before.load(path); err != nil {
+
+		t.Fatalf("load: %s", err.Error())
+	}
+
+	for _, name := range []string{"red", "green", "blue"} {
+
+		if err := before.mark(name, "did not light", now); err != nil {
+
+			t.Fatalf("mark: %s", err.Error())
+		}
+	}
+
+	if cleared, err := before.clear("green"); err != nil || !reflect.DeepEqual(cleared, []string{"green"}) {
+
+		t.Fatalf("clear: got %v %v, want [green]", cleared, err)
+	}
+
+	// The producer restarts
+	var after outputFaults
+
+	if err := after.load(path); err != nil {
+
+		t.Fatalf("load after restart: %s", err.Error())
+	}
+
+	var names []string
+
+	for _, fault := range after.list() {
+
+		names = append(names, fault.Output)
+
+		if !fault.Since.Equal(now) || fault.Reason != "did not light" {
+
+			t.Errorf("%s: got %+v", fault.Output, fault)
+		}
+	}
+
+	if !reflect.DeepEqual(names, []string{"blue", "red"}) {
+
+		t.Errorf("faults after restart: got %v, want [blue red]", names)
+	}
+
+	led := &catalogService{ID: 1, Output: "red"}
+
+	if after.affects(led) == "" {
+
+		t.Error("a service using a faulty output was not affected after restart")
+	}
+}
@@ -3,33 +3,92 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
+	"sync"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/stianeikeland/go-rpio"
 	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
 )
 
+// maxDeliverySeconds is the longest delivery that can be timed, in an int on any platform and in a time.Duration
+const maxDeliverySeconds = math.MaxInt32
+
 // Handler handles the events coming from Worldpay Within
 type Handler struct {
-	ledGreen    rpio.Pin
-	ledRed      rpio.Pin
-	ledBlue     rpio.Pin
+	outputs     map[string]output
+	mu          sync.RWMutex           // Guards plugins and catalog, which are replaced when the catalog is reloaded
+	plugins     map[int]deliveryPlugin // By service ID
 	services    map[int]*types.Service
+	catalog     *catalog
+	sessions    *sessionManager
+	deliveries  deliveryTracker // Latest delivery status by token, for consumers
+	ledger      *ledger
+	pricing     *pricingEngine
+	maintenance maintenanceMode
+	tokens      *tokenRegistry
+	refunder    refunder
+	sensors     map[string]lightSensor // Feedback sensors by output name
+	faults      outputFaults
+	panics      int64 // Callbacks recovered from panicking, see recoverCallback
 	rpioenabled bool
 }
 
-func (handler *Handler) setup(services map[int]*types.Service, ignoreGPIO bool) error {
+func (handler *Handler) setup(services map[int]*types.Service, c *catalog, l *ledger, p *pricingEngine, tokens *tokenRegistry, ignoreGPIO bool) error {
 
 	if services == nil {
 
 		return errors.New("Services must be set.")
 	}
 
+	if c == nil {
+
+		return errors.New("Catalog must be set.")
+	}
+
 	handler.services = services
-	handler.ledRed = rpio.Pin(2)
-	handler.ledGreen = rpio.Pin(3)
-	handler.ledBlue = rpio.Pin(4)
+	handler.catalog = c
+	handler.ledger = l
+	handler.pricing = p
+	handler.tokens = tokens
+	handler.refunder = unsupportedRefunder{}
+	handler.sessions = newSessionManager()
+
+	outputs, rpioenabled, err := openOutputs(c, ignoreGPIO)
+
+	if err != nil {
+
+		return err
+	}
+
+	handler.outputs = outputs
+	handler.rpioenabled = rpioenabled
+	handler.sensors = openSensors(c, rpioenabled)
+
+	env := &pluginEnv{outputs: handler.outputs, gpioEnabled: handler.rpioenabled}
+	handler.plugins = make(map[int]deliveryPlugin, 0)
 
+	for i := range c.Services {
+
+		plugin, err := newPlugin(env, &c.Services[i])
+
+		if err != nil {
+
+			return err
+		}
+
+		handler.plugins[c.Services[i].ID] = plugin
+	}
+
+	return nil
+}
+
+// openOutputs opens the Raspberry Pi GPIO and sets up each output in the catalog, off. When GPIO cannot be
+// opened and ignoreGPIO is set, the outputs are simulated and rpioenabled is false.
+func openOutputs(c *catalog, ignoreGPIO bool) (map[string]output, bool, error) {
+
+	rpioenabled := false
 	gpioErr := rpio.Open()
 
 	if gpioErr != nil {
@@ -37,86 +96,300 @@ func (handler *Handler) setup(services map[int]*types.Service, ignoreGPIO bool)
 
 		if !ignoreGPIO {
 
-			return gpioErr
+			return nil, false, gpioErr
 		}
 
 		fmt.Println("Ignore Raspberry Pi GPIO errors")
-		return nil
+	} else {
+
+		// Did successfully setup rpio
+
+		rpioenabled = true
+
+		fmt.Println("Did open Raspberry Pi GPIO")
+
+		// Cleanup (defer until end)
+		// rpio.Close()
+	}
+
+	outputs := make(map[string]output, 0)
+
+	for _, config := range c.Outputs {
+
+		if !rpioenabled {
+
+			// Record what the LED would do instead
+			outputs[config.Name] = newSimOutput(config.Name)
+			continue
+		}
+
+		led := newLEDOutput(config)
+
+		// Ensure pins are in output mode, with the LEDs off
+		led.init()
+		outputs[config.Name] = led
 	}
 
-	// Did successfully setup rpio
+	if rpioenabled {
 
-	handler.rpioenabled = true
+		fmt.Println("Did set GPIO pins to output type")
+		fmt.Println("Did set GPIO pins to low")
+	}
 
-	fmt.Println("Did open Raspberry Pi GPIO")
+	return outputs, rpioenabled, nil
+}
 
-	// Cleanup (defer until end)
-	// rpio.Close()
+// lookupService returns a copy of the service offered with the ID, or an error if there is none
+func (handler *Handler) lookupService(serviceID int) (types.Service, error) {
 
-	// Ensure pins are in output mode
-	handler.ledGreen.Output()
-	handler.ledRed.Output()
-	handler.ledBlue.Output()
-	fmt.Println("Did set GPIO pins to output type")
+	sdkMu.RLock()
+	defer sdkMu.RUnlock()
 
-	// Turn of both LEDs, set the pins to low.
-	handler.ledGreen.Low()
-	handler.ledRed.Low()
-	handler.ledBlue.Low()
-	fmt.Println("Did set GPIO pins to low")
+	svc, ok := handler.services[serviceID]
 
-	return nil
+	if !ok || svc == nil {
+
+		return types.Service{}, fmt.Errorf("service %d not found", serviceID)
+	}
+
+	return *svc, nil
+}
+
+// lookupPrice returns the price of the service with the ID, or an error if there is none. The service
+// must be a copy from lookupService, as its prices are replaced when they change.
+func lookupPrice(svc types.Service, priceID int) (types.Price, error) {
+
+	price, ok := svc.Prices[priceID]
+
+	if !ok || price.PricePerUnit == nil {
+
+		return types.Price{}, fmt.Errorf("price %d not found for service %d", priceID, svc.ID)
+	}
+
+	return price, nil
+}
+
+// reportError prints and logs an error handling a callback. Callbacks cannot return errors, so the SDK and
+// the consumer are not told; consumers see refused deliveries on the status port.
+func (handler *Handler) reportError(callback string, err error) {
+
+	fmt.Printf("%s: %s\n", callback, err.Error())
+	log.WithField("callback", callback).Error(err.Error())
+}
+
+// current returns the catalog and plugins in use for new deliveries
+func (handler *Handler) current() (*catalog, map[int]deliveryPlugin) {
+
+	handler.mu.RLock()
+	defer handler.mu.RUnlock()
+
+	return handler.catalog, handler.plugins
 }
 
 // BeginServiceDelivery is called by Worldpay Within when a consumer wish to begin delivery of a service
 func (handler *Handler) BeginServiceDelivery(serviceID int, servicePriceID int, serviceDeliveryToken types.ServiceDeliveryToken, unitsToSupply int) {
 
+	// Set while the token's units are claimed but no session holds them, for a panic to give them back
+	var claimed *registeredToken
+	// Set once this delivery holds its session, for a panic to end it
+	var acquired *session
+
+	defer handler.recoverCallback("BeginServiceDelivery", serviceID, serviceDeliveryToken.Key, func() {
+
+		if claimed != nil {
+
+			handler.unclaimToken(claimed.Key, unitsToSupply)
+		}
+
+		if acquired != nil && handler.sessions.releaseSession(acquired) {
+
+			handler.abandonSession(acquired)
+		}
+	})
+
 	fmt.Printf("BeginServiceDelivery. ServiceID = %d\n", serviceID)
 	fmt.Printf("BeginServiceDelivery. ServicePriceID = %d\n", servicePriceID)
 	fmt.Printf("BeginServiceDelivery. UnitsToSupply = %d\n", unitsToSupply)
 	fmt.Printf("BeginServiceDelivery. DeliveryToken = %+v\n", serviceDeliveryToken.Key)
 	fmt.Println()
-	svc := handler.services[serviceID]
+	svc, err := handler.lookupService(serviceID)
+
+	if err != nil {
+
+		handler.refuseUnoffered(serviceDeliveryToken, serviceID, servicePriceID, unitsToSupply, err)
+		return
+	}
+
+	price, err := lookupPrice(svc, servicePriceID)
 
-	if &svc == nil {
+	if err != nil {
 
-		fmt.Printf("Service %d not found", serviceID)
+		handler.refuseUnoffered(serviceDeliveryToken, serviceID, servicePriceID, unitsToSupply, err)
 		return
 	}
 
-	price := svc.Prices[1]
+	c, plugins := handler.current()
+	catalogPrice := c.price(serviceID, servicePriceID)
+	plugin := plugins[serviceID]
 
-	durationSeconds := unitsToSupply * (unitsInTime[price.ID])
-	fmt.Println("Warning, hardcoded price selection due to WPW design flaw. i.e. This event doesn't know what price was selected..")
-	fmt.Printf("(%d) %s -> %s for %d %s\n", svc.ID, svc.Name, price.Description, durationSeconds, price.UnitDescription)
+	if catalogPrice == nil || plugin == nil {
 
-	var selectedPin rpio.Pin
+		handler.refuseUnoffered(serviceDeliveryToken, serviceID, servicePriceID, unitsToSupply, fmt.Errorf("service %d price %d is not in the catalog", serviceID, servicePriceID))
+		return
+	}
 
-	fmt.Print("POWER ON ")
-	switch svc.ID {
+	// Checked before the token is claimed, as nothing can be delivered
+	unit := c.unit(price.UnitID)
+	metered, isMetered := plugin.(meteredPlugin)
 
-	case 1:
-		fmt.Println("RED LED")
-		selectedPin = handler.ledRed
-	case 2:
-		fmt.Println("GREEN LED")
-		selectedPin = handler.ledGreen
-	case 3:
-		fmt.Println("BLUE LED")
-		selectedPin = handler.ledBlue
-	default:
-		fmt.Println("Unknown service id")
+	if unit.isCount() && !isMetered {
+
+		fmt.Printf("Service %d cannot count %s units\n", serviceID, unit.Description)
+		handler.deliveries.refused(serviceDeliveryToken.Key, serviceID, servicePriceID, unitsToSupply, fmt.Sprintf("cannot count %s units", unit.Description))
+		return
 	}
 
-	if handler.rpioenabled {
+	// A longer delivery's time would overflow, however many units were paid for
+	if unit.Seconds > 0 && unitsToSupply > maxDeliverySeconds/unit.Seconds {
 
-		selectedPin.High()
+		fmt.Printf("Service %d cannot time %d %s units\n", serviceID, unitsToSupply, unit.Description)
+		handler.deliveries.refused(serviceDeliveryToken.Key, serviceID, servicePriceID, unitsToSupply, fmt.Sprintf("%d %s units are too long to deliver", unitsToSupply, unit.Description))
+		return
+	}
+
+	// The token must be paid for, unexpired and have enough units left. Its units are reserved until delivery ends.
+	token, err := handler.tokens.claim(serviceDeliveryToken, serviceID, servicePriceID, unitsToSupply, time.Now())
+
+	if err != nil {
+
+		fmt.Printf("Refusing delivery of service %d: %s\n", serviceID, err.Error())
+		log.WithFields(log.Fields{"serviceID": serviceID, "priceID": servicePriceID, "units": unitsToSupply, "token": serviceDeliveryToken.Key}).Warnf("Delivery token rejected: %s", err.Error())
+		handler.deliveries.refused(serviceDeliveryToken.Key, serviceID, servicePriceID, unitsToSupply, err.Error())
+		return
+	}
+
+	claimed = token
+
+	// Consumers are told in the service description, but may have paid before it changed
+	if reason := handler.unavailable(c.service(serviceID), time.Now()); reason != "" {
+
+		fmt.Printf("Refusing delivery of service %d: unavailable, %s\n", serviceID, reason)
+		log.WithFields(log.Fields{"serviceID": serviceID, "token": serviceDeliveryToken.Key}).Warnf("Delivery refused, service unavailable: %s", reason)
+
+		// Nothing started, so the units stay on the token for the consumer to try again later
+		handler.deliveries.refused(serviceDeliveryToken.Key, serviceID, servicePriceID, unitsToSupply, "unavailable: "+reason)
+		handler.unclaimToken(token.Key, unitsToSupply)
+		return
+	}
+
+	// Only the maximum is checked here: a held token can deliver fewer units than the minimum purchase at a time
+	if catalogPrice.MaxUnits > 0 && unitsToSupply > catalogPrice.MaxUnits {
+
+		reason := fmt.Sprintf("at most %d units can be delivered, not %d", catalogPrice.MaxUnits, unitsToSupply)
+
+		fmt.Printf("Refusing delivery of service %d: %s\n", serviceID, reason)
+		log.WithFields(log.Fields{"serviceID": serviceID, "token": serviceDeliveryToken.Key}).Warnf("Delivery refused: %s", reason)
+
+		// The consumer can still ask for fewer units at a time
+		handler.deliveries.refused(serviceDeliveryToken.Key, serviceID, servicePriceID, unitsToSupply, reason)
+		handler.unclaimToken(token.Key, unitsToSupply)
+		return
+	}
+
+	// For count units this is the most time allowed, delivery normally finishes sooner
+	durationSeconds := unitsToSupply * unit.Seconds
+
+	if unit.isCount() {
+
+		fmt.Printf("(%d) %s -> %s, %d %s within %d seconds\n", svc.ID, svc.Name, price.Description, unitsToSupply, price.UnitDescription, durationSeconds)
 	} else {
 
-		fmt.Println("Raspberry Pi GPIO disabled.")
+		fmt.Printf("(%d) %s -> %s for %d seconds (%d %s)\n", svc.ID, svc.Name, price.Description, durationSeconds, unitsToSupply, price.UnitDescription)
+	}
+
+	s := &session{
+		tokenKey:  serviceDeliveryToken.Key,
+		serviceID: serviceID,
+		priceID:   servicePriceID,
+		units:     unitsToSupply,
+		resources: plugin.resources(catalogPrice),
+		plugin:    plugin,
+		unit:      *unit,
+		price:     *catalogPrice,
+		token:     *token,
+		started:   time.Now(),
+		duration:  time.Duration(durationSeconds) * time.Second,
+	}
+
+	// Deliveries sharing a resource cannot overlap, e.g. a colour mix needs all of its LEDs
+	if err := handler.sessions.acquire(s); err != nil {
+
+		fmt.Printf("Refusing delivery of service %d: %s\n", serviceID, err.Error())
+		log.WithFields(log.Fields{"serviceID": serviceID, "token": serviceDeliveryToken.Key}).Warnf("Delivery refused: %s", err.Error())
+		handler.deliveries.refused(serviceDeliveryToken.Key, serviceID, servicePriceID, unitsToSupply, err.Error())
+		handler.unclaim(s)
+		return
+	}
+
+	// From here a panic ends the session instead
+	claimed = nil
+	acquired = s
+
+	// One more delivery in progress, for demand pricing
+	handler.repriceAll()
+
+	handler.deliveries.started(s)
+
+	err = handler.sessions.start(s, func() error {
+
+		return plugin.start(s, catalogPrice)
+	})
+
+	if err == errSessionEnded {
+
+		// EndServiceDelivery has already released and reconciled the session
+		fmt.Printf("Delivery of service %d ended before it started\n", serviceID)
+		return
 	}
 
-	time.Sleep(time.Duration(durationSeconds) * time.Second)
+	if err != nil {
+
+		handler.sessions.releaseSession(s)
+		handler.unclaim(s)
+		fmt.Printf("Failed to start delivery of service %d: %s\n", serviceID, err.Error())
+		log.WithFields(log.Fields{"serviceID": serviceID, "token": serviceDeliveryToken.Key}).Errorf("Delivery failed to start: %s", err.Error())
+		handler.deliveries.ended(s.tokenKey, 0, "failed to start: "+err.Error())
+		return
+	}
+
+	handler.deliveries.running(s.tokenKey)
+
+	// Outputs lit steadily are checked against their feedback sensors
+	if catalogSvc := c.service(serviceID); catalogSvc.pluginName() == "led" && catalogPrice.Pattern == nil {
+
+		go handler.checkFeedback(s, catalogSvc.levels(catalogPrice))
+	}
+
+	var finished <-chan struct{}
+
+	if unit.isCount() {
+
+		finished = metered.finished(s)
+	}
+
+	select {
+	case <-finished:
+		fmt.Println("All units delivered..")
+	case <-time.After(s.duration):
+		if unit.isCount() {
+
+			fmt.Println("Delivery took too long..")
+		}
+	case <-s.ended:
+		// Ended early, e.g. by the consumer or the stop button
+		fmt.Println("Delivery ended early..")
+		return
+	}
 
 	fmt.Println("Time is up.. calling EndServiceDelivery()..")
 	fmt.Println()
@@ -127,72 +400,418 @@ func (handler *Handler) BeginServiceDelivery(serviceID int, servicePriceID int,
 // EndServiceDelivery is called by Worldpay Within when a consumer wish to end delivery of a service
 func (handler *Handler) EndServiceDelivery(serviceID int, serviceDeliveryToken types.ServiceDeliveryToken, unitsReceived int) {
 
+	// Set while a released session is being stopped, for a panic to turn its outputs off and reconcile it
+	var ending *session
+
+	defer handler.recoverCallback("EndServiceDelivery", serviceID, serviceDeliveryToken.Key, func() {
+
+		if ending != nil {
+
+			handler.abandonSession(ending)
+		}
+	})
+
 	fmt.Printf("EndServiceDelivery. ServiceID = %d\n", serviceID)
 	fmt.Printf("EndServiceDelivery. UnitsReceived = %d\n", unitsReceived)
 	fmt.Printf("EndServiceDelivery. DeliveryToken = %+v\n", serviceDeliveryToken.Key)
 	fmt.Println()
-	svc := handler.services[serviceID]
+	// The service may have been removed from the catalog since delivery began, the session is still ended
+	if svc, err := handler.lookupService(serviceID); err == nil {
+
+		fmt.Printf("%d - %s\n", svc.ID, svc.Name)
+	}
+
+	// Only this token's session is stopped, never another session sharing the service
+	s := handler.sessions.release(serviceDeliveryToken.Key)
 
-	if &svc == nil {
+	if s == nil {
 
-		fmt.Printf("Service %d not found", serviceID)
+		handler.reportError("EndServiceDelivery", fmt.Errorf("no active session for service %d with token %s", serviceID, serviceDeliveryToken.Key))
 		return
 	}
 
-	fmt.Printf("%d - %s\n", svc.ID, svc.Name)
+	if s.serviceID != serviceID {
 
-	var selectedPin rpio.Pin
+		log.WithFields(log.Fields{"serviceID": serviceID, "token": s.tokenKey}).Warnf("Ending session for service %d, token was used for service %d", serviceID, s.serviceID)
+	}
+
+	ending = s
 
-	fmt.Print("POWER OFF ")
-	switch svc.ID {
+	// The session's own plugin, which a catalog reload since delivery began does not replace
+	plugin := s.plugin
 
-	case 1:
-		fmt.Println("RED LED")
-		selectedPin = handler.ledRed
-	case 2:
-		fmt.Println("GREEN LED")
-		selectedPin = handler.ledGreen
-	case 3:
-		fmt.Println("BLUE LED")
-		selectedPin = handler.ledBlue
-	default:
-		fmt.Println("Unknown service id")
+	if err := plugin.stop(s); err != nil {
+
+		fmt.Printf("Failed to stop delivery of service %d: %s\n", s.serviceID, err.Error())
+		log.WithFields(log.Fields{"serviceID": s.serviceID, "token": s.tokenKey}).Errorf("Delivery failed to stop: %s", err.Error())
 	}
 
-	if handler.rpioenabled {
+	ending = nil
 
-		selectedPin.Low()
-	} else {
+	handler.reconcile(s, plugin, unitsReceived)
+	handler.repriceAll()
+}
+
+// refuseUnoffered refuses a delivery of a service or price which is no longer offered, e.g. taken out of the
+// broadcast for a faulty output after the consumer paid. A token paid for it is still claimed, so what the
+// consumer paid is owed back.
+func (handler *Handler) refuseUnoffered(deliveryToken types.ServiceDeliveryToken, serviceID int, priceID int, units int, err error) {
+
+	handler.deliveries.refused(deliveryToken.Key, serviceID, priceID, units, err.Error())
+	handler.reportError("BeginServiceDelivery", err)
+
+	token, claimErr := handler.tokens.claim(deliveryToken, serviceID, priceID, units, time.Now())
+
+	if claimErr != nil {
+
+		return
+	}
+
+	handler.refundUndelivered(token, "", units, err.Error())
+}
+
+// unclaim gives the units of a session that did not start back to its token, so the consumer can try again
+func (handler *Handler) unclaim(s *session) {
+
+	handler.unclaimToken(s.tokenKey, s.units)
+}
+
+func (handler *Handler) unclaimToken(key string, units int) {
+
+	if err := handler.tokens.unclaim(key, units); err != nil {
+
+		log.WithField("token", key).Errorf("Failed to give back token units: %s", err.Error())
+	}
+}
+
+// refundUndelivered records in the ledger that a paid delivery was refused, so what the consumer paid
+// for the units claimed from the token is owed back. Nothing is owed for free tokens, e.g. demos.
+func (handler *Handler) refundUndelivered(token *registeredToken, unit string, units int, reason string) {
+
+	if token.Total == 0 {
+
+		return
+	}
+
+	entry := ledgerEntry{
+		Time:      time.Now(),
+		Type:      ledgerRefundDue,
+		TokenKey:  token.Key,
+		ServiceID: token.ServiceID,
+		PriceID:   token.PriceID,
+		Unit:      unit,
+		UnitsPaid: units,
+		Amount:    token.value(units),
+		Currency:  token.Currency,
+		Reason:    reason,
+	}
+
+	fmt.Printf("Refund due for %d undelivered units: %d %s\n", units, entry.Amount, entry.Currency)
+
+	if err := handler.ledger.append(entry); err != nil {
+
+		log.WithField("token", token.Key).Errorf("Failed to write ledger: %s", err.Error())
+	}
+}
+
+// refundRefusedQuote records in the ledger that a refused quote was paid for, so the payment is owed back
+func (handler *Handler) refundRefusedQuote(quote *paidQuote) {
+
+	entry := ledgerEntry{
+		Time:      time.Now(),
+		Type:      ledgerRefundDue,
+		ServiceID: quote.ServiceID,
+		PriceID:   quote.PriceID,
+		UnitsPaid: quote.Units,
+		Amount:    quote.Total,
+		Currency:  quote.Currency,
+		Reference: quote.Reference,
+		Reason:    "quote refused: " + quote.Refused,
+	}
+
+	fmt.Printf("Refund due for payment %s of refused quote: %d %s\n", quote.Reference, entry.Amount, entry.Currency)
+	log.WithField("reference", quote.Reference).Warnf("Refused quote paid, refund due: %d %s", entry.Amount, entry.Currency)
+
+	if err := handler.ledger.append(entry); err != nil {
+
+		log.WithField("reference", quote.Reference).Errorf("Failed to write ledger: %s", err.Error())
+	}
+}
+
+// reconcile records what a session delivered in the ledger, along with any amount owed back
+// to the consumer when fewer units were delivered than were paid for
+func (handler *Handler) reconcile(s *session, plugin deliveryPlugin, unitsReported int) {
+
+	delivered := s.delivered(plugin, time.Now())
+
+	entry := ledgerEntry{
+		Time:           time.Now(),
+		Type:           ledgerDelivery,
+		TokenKey:       s.tokenKey,
+		ServiceID:      s.serviceID,
+		PriceID:        s.priceID,
+		Unit:           s.unit.Description,
+		UnitsPaid:      s.units,
+		UnitsDelivered: delivered,
+		UnitsReported:  unitsReported,
+		Amount:         s.token.value(delivered),
+		Currency:       s.token.Currency,
+	}
+
+	fmt.Printf("Delivered %d of %d %s units\n", delivered, s.units, s.unit.Description)
+	handler.deliveries.ended(s.tokenKey, delivered, fmt.Sprintf("ended after %d of %d units", delivered, s.units))
+
+	if err := handler.tokens.delivered(s.tokenKey, delivered); err != nil {
+
+		log.WithField("token", s.tokenKey).Errorf("Failed to record delivered units: %s", err.Error())
+	}
+
+	if err := handler.ledger.append(entry); err != nil {
+
+		log.WithField("token", s.tokenKey).Errorf("Failed to write ledger: %s", err.Error())
+	}
 
-		fmt.Println("Raspberry Pi GPIO disabled.")
+	// Nothing is owed for free tokens, e.g. demos
+	if delivered >= s.units || s.token.Total == 0 {
+
+		return
+	}
+
+	shortfall := s.units - delivered
+
+	entry.Type = ledgerRefundDue
+	entry.Amount = s.token.value(s.units) - s.token.value(delivered)
+
+	fmt.Printf("Refund due for %d undelivered units: %d %s\n", shortfall, entry.Amount, entry.Currency)
+	log.WithFields(log.Fields{"serviceID": s.serviceID, "token": s.tokenKey}).Warnf("Refund due: %d %s", entry.Amount, entry.Currency)
+
+	if err := handler.ledger.append(entry); err != nil {
+
+		log.WithField("token", s.tokenKey).Errorf("Failed to write ledger: %s", err.Error())
 	}
 }
 
 // GenericEvent handles general events
 func (handler *Handler) GenericEvent(name string, message string, data interface{}) error {
 
+	defer handler.recoverCallback("GenericEvent", 0, "")
+
 	return nil
 }
 
+// MakePaymentEvent records a payment against the quote it paid for. The order description carries the
+// quote's payment reference, and uuid is the key of the delivery token the SDK issued for the payment.
 func (handler *Handler) MakePaymentEvent(totalPrice int, orderCurrency string, clientToken string, orderDescription string, uuid string) {
 
+	defer handler.recoverCallback("MakePaymentEvent", 0, "")
+
 	fmt.Printf("go event from core - payment: totalPrice=%d, orderCurrency=%s, clientToken=%s, orderDescription=%s, uui=%s\n",
 		totalPrice, orderCurrency, clientToken, orderDescription, uuid)
+
+	quote, err := handler.tokens.paid(totalPrice, orderCurrency, orderDescription, uuid, time.Now())
+
+	if err != nil {
+
+		fmt.Printf("Payment does not match a quote: %s\n", err.Error())
+		log.WithFields(log.Fields{"totalPrice": totalPrice, "currency": orderCurrency, "description": orderDescription, "token": uuid}).Errorf("Payment does not match a quote: %s", err.Error())
+		return
+	}
+
+	// The consumer paid for a quote it was told was refused, so it is owed the payment back
+	if quote.Refused != "" {
+
+		handler.refundRefusedQuote(quote)
+		return
+	}
+
+	log.WithFields(log.Fields{"reference": quote.Reference, "token": quote.TokenKey, "serviceID": quote.ServiceID, "priceID": quote.PriceID, "units": quote.Units}).Info("Quote paid")
 }
 
 func (handler *Handler) ServiceDiscoveryEvent(remoteAddr string) {
 
+	defer handler.recoverCallback("ServiceDiscoveryEvent", 0, "")
+
 	fmt.Printf("go event from core - service dicovery: remoteAddr: %s\n", remoteAddr)
+
+	// A consumer found the producer, so the SDK is broadcasting and answering
+	broadcast.heardAt(time.Now())
+
+	handler.refreshAvailability()
 }
 
 func (handler *Handler) ServicePricesEvent(remoteAddr string, serviceId int) {
 
+	defer handler.recoverCallback("ServicePricesEvent", serviceId, "")
+
 	fmt.Printf("go event from core - service prices: remoteAddr: %s, serviceId: %d\n", remoteAddr, serviceId)
+
+	handler.refreshAvailability()
 }
 
 func (handler *Handler) ServiceTotalPriceEvent(remoteAddr string, serviceId int, totalPrice *types.TotalPriceResponse) {
 
+	defer handler.recoverCallback("ServiceTotalPriceEvent", serviceId, "")
+
 	fmt.Printf("go event from core - service prices: remoteAddr: %s, serviceId: %d\n", remoteAddr, serviceId)
+
+	if totalPrice == nil {
+
+		return
+	}
+
+	// The SDK cannot refuse a quote and sends it whatever this handler does, so a quote which cannot be
+	// bought is recorded as refused instead. Consumers can see why on the status port before paying,
+	// a payment for it is refunded, and delivery against it is refused.
+	reason := handler.quoteRefusal(serviceId, totalPrice.PriceID, totalPrice.UnitsToSupply)
+
+	if reason != "" {
+
+		fmt.Printf("Refusing quote %s for service %d price %d: %s\n", totalPrice.PaymentReferenceID, serviceId, totalPrice.PriceID, reason)
+		log.WithFields(log.Fields{"serviceID": serviceId, "priceID": totalPrice.PriceID, "reference": totalPrice.PaymentReferenceID}).Warnf("Quote refused: %s", reason)
+	} else {
+
+		fmt.Printf("Quoted %d units of service %d price %d at %d %s\n", totalPrice.UnitsToSupply, serviceId, totalPrice.PriceID, totalPrice.TotalPrice, totalPrice.CurrencyCode)
+	}
+
+	// Delivery tokens are checked against the quotes paid for
+	if err := handler.tokens.quoted(serviceId, *totalPrice, reason, time.Now()); err != nil {
+
+		log.WithField("reference", totalPrice.PaymentReferenceID).Errorf("Failed to record quote: %s", err.Error())
+	}
+}
+
+// quoteRefusal returns why units of a service and price cannot be bought right now, or "" if they can
+func (handler *Handler) quoteRefusal(serviceID int, priceID int, units int) string {
+
+	svc, err := handler.lookupService(serviceID)
+
+	if err != nil {
+
+		return err.Error()
+	}
+
+	if _, err := lookupPrice(svc, priceID); err != nil {
+
+		return err.Error()
+	}
+
+	c, _ := handler.current()
+	catalogPrice := c.price(serviceID, priceID)
+
+	if catalogPrice == nil {
+
+		return fmt.Sprintf("service %d price %d is not in the catalog", serviceID, priceID)
+	}
+
+	if reason := handler.unavailable(c.service(serviceID), time.Now()); reason != "" {
+
+		return "unavailable: " + reason
+	}
+
+	if err := catalogPrice.checkUnits(units); err != nil {
+
+		return err.Error()
+	}
+
+	return ""
+}
+
+// reprice sets the prices of a service from the catalog and the pricing rules. The SDK works out a
+// quote before ServiceTotalPriceEvent is called, so prices are kept up to date ahead of consumers
+// asking, see repriceAll, rather than in the event handlers. The SDK shares the service, so a new
+// set of prices replaces the old one under sdkMu, and only when a price has changed.
+func (handler *Handler) reprice(serviceID int, now time.Time) {
+
+	if handler.pricing == nil {
+
+		return
+	}
+
+	c, _ := handler.current()
+	activeSessions := len(handler.sessions.list())
+
+	sdkMu.Lock()
+	defer sdkMu.Unlock()
+
+	svc := handler.services[serviceID]
+
+	if svc == nil {
+
+		return
+	}
+
+	prices := make(map[int]types.Price, len(svc.Prices))
+	changed := false
+
+	for id, price := range svc.Prices {
+
+		prices[id] = price
+		catalogPrice := c.price(serviceID, id)
+
+		if catalogPrice == nil || price.PricePerUnit == nil {
+
+			continue
+		}
+
+		amount := handler.pricing.unitPrice(serviceID, catalogPrice.Amount, now, activeSessions)
+
+		if amount == price.PricePerUnit.Amount {
+
+			continue
+		}
+
+		log.WithFields(log.Fields{"serviceID": serviceID, "priceID": id}).Infof("Price changed from %d to %d", price.PricePerUnit.Amount, amount)
+
+		price.PricePerUnit = &types.PricePerUnit{Amount: amount, CurrencyCode: price.PricePerUnit.CurrencyCode}
+		prices[id] = price
+		changed = true
+	}
+
+	if changed {
+
+		svc.Prices = prices
+	}
+}
+
+// repriceAll reprices every offered service. It is called when the catalog is loaded or reloaded and
+// when a delivery starts or ends, which change what the demand rules see, and by runRepricer for the
+// time of day rules.
+func (handler *Handler) repriceAll() {
+
+	sdkMu.RLock()
+	serviceIDs := make([]int, 0, len(handler.services))
+
+	for id := range handler.services {
+
+		serviceIDs = append(serviceIDs, id)
+	}
+
+	sdkMu.RUnlock()
+
+	now := time.Now()
+
+	for _, id := range serviceIDs {
+
+		handler.reprice(id, now)
+	}
+}
+
+// runRepricer reprices every interval, for as long as the producer runs, so prices follow the time of
+// day rules. An interval of 0 or less turns it off, leaving prices to change only with the catalog and
+// deliveries.
+func (handler *Handler) runRepricer(interval time.Duration) {
+
+	if interval <= 0 {
+
+		return
+	}
+
+	for {
+
+		time.Sleep(interval)
+
+		safely("reprice", handler.repriceAll)
+	}
 }
 
 // GenericEvent handles general events
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// FuzzHandler quotes, pays for and delivers any service, price and units on simulated outputs, then ends
+// the delivery. Whatever a consumer sends, a callback must not panic, including a panic recoverCallback
+// would hide, no output may be left on and no more units may be delivered than were paid for.
+func FuzzHandler(f *testing.F) {
+
+	c, err := loadCatalog("catalog.json")
+
+	if err != nil {
+
+		f.Fatalf("loadCatalog: %s", err.Error())
+	}
+
+	// Without limits any count reaches the unit arithmetic, as it would for a price with no maxUnits
+	for i := range c.Services {
+
+		for j := range c.Services[i].Prices {
+
+			c.Services[i].Prices[j].MaxUnits = 0
+		}
+	}
+
+	f.Add(1, 1, 10, 5, "token")
+	f.Add(4, 2, 3, 3, "token")
+	f.Add(1, 8, 2, 2, "token")
+	f.Add(1, 1, 0, 0, "")
+	f.Add(99, -1, -5, -5, "token")
+	f.Add(2, 2, 1<<62, 1<<62, "token")
+	f.Add(1, 1, 1<<40, 1<<40, "token")
+
+	f.Fuzz(func(t *testing.T, serviceID int, priceID int, paid int, units int, key string) {
+
+		handler := newSimHandler(t, c)
+
+		// The quote and payment as the SDK would report them, so delivery gets past the token checks
+		quote := &types.TotalPriceResponse{PriceID: priceID, UnitsToSupply: paid, TotalPrice: paid, CurrencyCode: "GBP", PaymentReferenceID: "fuzz"}
+		token := types.ServiceDeliveryToken{Key: key, Issued: time.Now(), Expiry: time.Now().Add(time.Hour)}
+
+		handler.ServicePricesEvent("fuzz", serviceID)
+		handler.ServiceTotalPriceEvent("fuzz", serviceID, quote)
+		handler.MakePaymentEvent(paid, "GBP", "", "Payment for fuzz", key)
+
+		begun := make(chan struct{})
+
+		go func() {
+
+			defer close(begun)
+			handler.BeginServiceDelivery(serviceID, priceID, token, units)
+		}()
+
+		// Ended once delivering, unless it was refused
+		deadline := time.Now().Add(5 * time.Second)
+
+		for !delivering(handler, key) && !isClosed(begun) && time.Now().Before(deadline) {
+
+			time.Sleep(time.Millisecond)
+		}
+
+		handler.EndServiceDelivery(serviceID, token, units)
+
+		select {
+		case <-begun:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("service %d price %d units %d: delivery did not end", serviceID, priceID, units)
+		}
+
+		if panics := atomic.LoadInt64(&handler.panics); panics > 0 {
+
+			t.Fatalf("service %d price %d paid %d units %d token %q: %d callbacks panicked", serviceID, priceID, paid, units, key, panics)
+		}
+
+		for name, out := range handler.outputs {
+
+			if level := out.(*simOutput).current(); level != 0 {
+
+				t.Errorf("service %d price %d units %d: %s left at %d", serviceID, priceID, units, name, level)
+			}
+		}
+
+		entries, err := handler.ledger.entries()
+
+		if err != nil {
+
+			t.Fatalf("ledger: %s", err.Error())
+		}
+
+		// What was delivered and what is owed back are each at most what was paid
+		for _, entry := range entries {
+
+			if entry.UnitsDelivered < 0 || entry.UnitsDelivered > entry.UnitsPaid || entry.Amount < 0 || entry.Amount > paid {
+
+				t.Errorf("service %d price %d paid %d units %d: ledger entry %+v", serviceID, priceID, paid, units, entry)
+			}
+		}
+
+		handler.tokens.mu.Lock()
+		defer handler.tokens.mu.Unlock()
+
+		if registered := handler.tokens.find(key); registered != nil && (registered.UnitsDelivered > registered.UnitsPaid || registered.UnitsDelivered < 0) {
+
+			t.Errorf("service %d price %d units %d: delivered %d of %d units paid", serviceID, priceID, units, registered.UnitsDelivered, registered.UnitsPaid)
+		}
+	})
+}
+
+// newSimHandler sets up a handler on simulated outputs with its own token registry and ledger, so
+// each test or fuzz input starts from nothing
+func newSimHandler(t *testing.T, c *catalog) *Handler {
+
+	services := make(map[int]*types.Service, 0)
+
+	for _, catalogSvc := range c.Services {
+
+		svc, err := newService(c, catalogSvc)
+
+		if err != nil {
+
+			t.Fatalf("newService: %s", err.Error())
+		}
+
+		services[svc.ID] = svc
+	}
+
+	dir := t.TempDir()
+	handler := &Handler{}
+	tokens := &tokenRegistry{path: filepath.Join(dir, "tokens.json")}
+
+	if err := handler.setup(services, c, newLedger(filepath.Join(dir, "ledger.jsonl")), &pricingEngine{}, tokens, true); err != nil {
+
+		t.Fatalf("setup: %s", err.Error())
+	}
+
+	// Simulated even where GPIO opens, so what each output was left at can be checked. The plugins share the map.
+	for name := range handler.outputs {
+
+		handler.outputs[name] = newSimOutput(name)
+	}
+
+	return handler
+}
+
+func delivering(handler *Handler, key string) bool {
+
+	for _, s := range handler.sessions.list() {
+
+		if s.tokenKey == key {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func isClosed(ch chan struct{}) bool {
+
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
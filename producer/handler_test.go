@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// paidToken quotes and pays for units of a service and price through the SDK callbacks, returning the
+// delivery token the payment was made with
+func paidToken(t *testing.T, handler *Handler, serviceID int, priceID int, units int) types.ServiceDeliveryToken {
+
+	quote := &types.TotalPriceResponse{PriceID: priceID, UnitsToSupply: units, TotalPrice: 10 * units, CurrencyCode: "GBP", PaymentReferenceID: "ref"}
+
+	handler.ServiceTotalPriceEvent("test", serviceID, quote)
+	handler.MakePaymentEvent(quote.TotalPrice, "GBP", "", "Payment for ref", "token")
+
+	return types.ServiceDeliveryToken{Key: "token"}
+}
+
+// unclaimed returns the units of the token which are neither claimed nor refunded
+func unclaimed(t *testing.T, handler *Handler, key string) int {
+
+	handler.tokens.mu.Lock()
+	defer handler.tokens.mu.Unlock()
+
+	token := handler.tokens.find(key)
+
+	if token == nil {
+
+		t.Fatalf("token %s was not registered", key)
+	}
+
+	return token.remaining()
+}
+
+func TestUnavailableRefusalKeepsUnits(t *testing.T) {
+
+	c, err := loadCatalog("catalog.json")
+
+	if err != nil {
+
+		t.Fatalf("loadCatalog: %s", err.Error())
+	}
+
+	handler := newSimHandler(t, c)
+	token := paidToken(t, handler, 1, 1, 4)
+
+	// Paid while open, presented once the producer went into maintenance
+	handler.maintenance.set(true, "testing")
+	handler.BeginServiceDelivery(1, 1, token, 4)
+
+	if units := unclaimed(t, handler, token.Key); units != 4 {
+
+		t.Errorf("units left on the token: got %d, want 4", units)
+	}
+
+	if entries, _ := handler.ledger.entries(); len(entries) != 0 {
+
+		t.Errorf("ledger: got %+v, want nothing owed back", entries)
+	}
+}
+
+func TestMaxUnitsRefusalKeepsUnits(t *testing.T) {
+
+	c, err := loadCatalog("catalog.json")
+
+	if err != nil {
+
+		t.Fatalf("loadCatalog: %s", err.Error())
+	}
+
+	handler := newSimHandler(t, c)
+	token := paidToken(t, handler, 1, 1, 4)
+
+	// Paid before the catalog limited deliveries to 2 units at a time
+	c.price(1, 1).MaxUnits = 2
+	handler.BeginServiceDelivery(1, 1, token, 4)
+
+	if units := unclaimed(t, handler, token.Key); units != 4 {
+
+		t.Errorf("units left on the token: got %d, want 4", units)
+	}
+
+	if entries, _ := handler.ledger.entries(); len(entries) != 0 {
+
+		t.Errorf("ledger: got %+v, want nothing owed back", entries)
+	}
+}
+
+func TestDemandPriceFollowsDeliveries(t *testing.T) {
+
+	c, err := loadCatalog("catalog.json")
+
+	if err != nil {
+
+		t.Fatalf("loadCatalog: %s", err.Error())
+	}
+
+	handler := newSimHandler(t, c)
+	handler.pricing = newEngine(t, pricingRule{Type: ruleDemand, Services: []int{1}, MinSessions: 1, Percent: 100})
+
+	unitPrice := func() int {
+
+		sdkMu.RLock()
+		defer sdkMu.RUnlock()
+
+		return handler.services[1].Prices[1].PricePerUnit.Amount
+	}
+
+	token := paidToken(t, handler, 1, 1, 4)
+
+	// Quoting leaves the prices as they were, the SDK has already quoted from them
+	if amount := unitPrice(); amount != 5 {
+
+		t.Fatalf("price after quoting: got %d, want 5", amount)
+	}
+
+	begun := make(chan struct{})
+
+	go func() {
+
+		defer close(begun)
+		handler.BeginServiceDelivery(1, 1, token, 4)
+	}()
+
+	for !delivering(handler, token.Key) && !isClosed(begun) {
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if amount := unitPrice(); amount != 10 {
+
+		t.Errorf("price while delivering: got %d, want 10", amount)
+	}
+
+	handler.EndServiceDelivery(1, token, 4)
+	<-begun
+
+	if amount := unitPrice(); amount != 5 {
+
+		t.Errorf("price once delivered: got %d, want 5", amount)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/psp/onlineworldpay"
+)
+
+// pspCheckInterval is how often the PSP is contacted for the health check, at most
+const pspCheckInterval = 30 * time.Second
+
+// livenessTimeout is how long the session manager may take to answer before it is reported hung
+const livenessTimeout = 2 * time.Second
+
+// overdueGrace is how long past its paid time a session may run before it is reported stuck
+const overdueGrace = time.Minute
+
+// broadcastListenTimeout is how long the producer listens for its own broadcast each check
+const broadcastListenTimeout = 5 * time.Second
+
+// broadcastMissedChecks is how many checks in a row may miss the broadcast before it is reported dead
+const broadcastMissedChecks = 3
+
+// broadcastMonitor tracks whether the SDK is still broadcasting. The SDK does not say, so the producer
+// listens for its own broadcast, and a consumer discovering the producer counts as hearing it too.
+type broadcastMonitor struct {
+	mu       sync.Mutex
+	started  time.Time
+	interval time.Duration // Between listens, 0 when the producer does not listen
+	heard    time.Time
+	missed   string // Why the last listen did not hear the broadcast
+}
+
+var broadcast broadcastMonitor
+
+// componentHealth is the state of one part of the producer
+type componentHealth struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// healthReport is returned by GET /health
+type healthReport struct {
+	OK             bool            `json:"ok"`
+	Time           time.Time       `json:"time"`
+	Broadcast      componentHealth `json:"broadcast"`
+	GPIO           componentHealth `json:"gpio"`
+	PSP            componentHealth `json:"psp"`
+	SessionManager componentHealth `json:"sessionManager"`
+}
+
+// pspProbe remembers the last PSP reachability check, so health checks do not hammer the PSP
+type pspProbe struct {
+	mu      sync.Mutex
+	checked time.Time
+	result  componentHealth
+}
+
+var pspHealth pspProbe
+
+// health checks each part of the producer
+func (handler *Handler) health() healthReport {
+
+	report := healthReport{
+		Time:           time.Now(),
+		Broadcast:      broadcastHealth(),
+		GPIO:           handler.gpioHealth(),
+		PSP:            pspHealth.check(pspConfig[onlineworldpay.CfgAPIEndpoint]),
+		SessionManager: handler.sessionManagerHealth(),
+	}
+
+	report.OK = report.Broadcast.OK && report.GPIO.OK && report.PSP.OK && report.SessionManager.OK
+
+	return report
+}
+
+func broadcastHealth() componentHealth {
+
+	return broadcast.health(time.Now())
+}
+
+// start records the broadcast starting, and listens for it every interval unless interval is 0
+func (monitor *broadcastMonitor) start(uid string, interval time.Duration) {
+
+	monitor.mu.Lock()
+	monitor.started = time.Now()
+	monitor.interval = interval
+	monitor.mu.Unlock()
+
+	if interval <= 0 {
+
+		return
+	}
+
+	go func() {
+
+		for {
+
+			safely("broadcast check", func() {
+
+				monitor.listen(uid)
+			})
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// listen discovers devices for a while, and records whether this producer was among them
+func (monitor *broadcastMonitor) listen(uid string) {
+
+	devices, err := wpw.DeviceDiscovery(int(broadcastListenTimeout / time.Millisecond))
+
+	if err != nil {
+
+		monitor.miss(fmt.Sprintf("discovery failed: %s", err.Error()))
+		return
+	}
+
+	for _, device := range devices {
+
+		if device.ServerID == uid {
+
+			monitor.heardAt(time.Now())
+			return
+		}
+	}
+
+	monitor.miss(fmt.Sprintf("own broadcast not heard among %d devices", len(devices)))
+}
+
+// startedAt returns when StartServiceBroadcast succeeded, or the zero time before it has
+func (monitor *broadcastMonitor) startedAt() time.Time {
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	return monitor.started
+}
+
+func (monitor *broadcastMonitor) heardAt(now time.Time) {
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	monitor.heard = now
+	monitor.missed = ""
+}
+
+func (monitor *broadcastMonitor) miss(reason string) {
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	monitor.missed = reason
+}
+
+// health reports a broadcast not heard for broadcastMissedChecks checks as dead. One which has only just
+// started has until then to be heard.
+func (monitor *broadcastMonitor) health(now time.Time) componentHealth {
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	if monitor.started.IsZero() {
+
+		return componentHealth{OK: false, Detail: "not started"}
+	}
+
+	if monitor.interval <= 0 {
+
+		if monitor.heard.IsZero() {
+
+			return componentHealth{OK: true, Detail: fmt.Sprintf("started %s, not checked", monitor.started.Format(time.RFC3339))}
+		}
+
+		return componentHealth{OK: true, Detail: fmt.Sprintf("started %s, last discovered %s, not checked", monitor.started.Format(time.RFC3339), monitor.heard.Format(time.RFC3339))}
+	}
+
+	window := broadcastMissedChecks * (monitor.interval + broadcastListenTimeout)
+
+	if !monitor.heard.IsZero() && now.Sub(monitor.heard) < window {
+
+		return componentHealth{OK: true, Detail: fmt.Sprintf("broadcasting since %s, last heard %s", monitor.started.Format(time.RFC3339), monitor.heard.Format(time.RFC3339))}
+	}
+
+	if monitor.heard.IsZero() && now.Sub(monitor.started) < window {
+
+		return componentHealth{OK: true, Detail: fmt.Sprintf("started %s, not heard yet", monitor.started.Format(time.RFC3339))}
+	}
+
+	last := "never heard"
+
+	if !monitor.heard.IsZero() {
+
+		last = "last heard " + monitor.heard.Format(time.RFC3339)
+	}
+
+	return componentHealth{OK: false, Detail: fmt.Sprintf("%s: %s", last, monitor.missed)}
+}
+
+func (handler *Handler) gpioHealth() componentHealth {
+
+	if faults := handler.faults.list(); len(faults) > 0 {
+
+		var names []string
+
+		for _, fault := range faults {
+
+			names = append(names, fault.Output)
+		}
+
+		return componentHealth{OK: false, Detail: fmt.Sprintf("faulty outputs: %s", strings.Join(names, ", "))}
+	}
+
+	if handler.rpioenabled {
+
+		return componentHealth{OK: true, Detail: fmt.Sprintf("Raspberry Pi GPIO, %d outputs", len(handler.outputs))}
+	}
+
+	// Running with -ignoregpio is healthy, the outputs are simulated on purpose
+	return componentHealth{OK: true, Detail: fmt.Sprintf("simulated, %d outputs", len(handler.outputs))}
+}
+
+// check reports whether the PSP API endpoint answers. Any HTTP response counts, only a
+// failure to connect is unhealthy.
+func (probe *pspProbe) check(endpoint string) componentHealth {
+
+	probe.mu.Lock()
+	defer probe.mu.Unlock()
+
+	if !probe.checked.IsZero() && time.Since(probe.checked) < pspCheckInterval {
+
+		return probe.result
+	}
+
+	if endpoint == "" {
+
+		probe.result = componentHealth{OK: false, Detail: "no PSP endpoint configured"}
+	} else {
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Head(endpoint)
+
+		if err != nil {
+
+			probe.result = componentHealth{OK: false, Detail: fmt.Sprintf("%s unreachable: %s", endpoint, err.Error())}
+		} else {
+
+			resp.Body.Close()
+			probe.result = componentHealth{OK: true, Detail: fmt.Sprintf("%s answered %s", endpoint, resp.Status)}
+		}
+	}
+
+	probe.checked = time.Now()
+
+	return probe.result
+}
+
+// sessionsListing is one call to list the sessions, done is closed once it returns
+type sessionsListing struct {
+	done     chan struct{}
+	sessions []session
+}
+
+// sessionsProbe shares one listing of the sessions between the health checks made while it is in flight,
+// so a hung session manager holds one goroutine, not one per check
+type sessionsProbe struct {
+	mu       sync.Mutex
+	inFlight *sessionsListing
+}
+
+var sessionsHealth sessionsProbe
+
+// list returns the listing in flight, starting one if there is none
+func (probe *sessionsProbe) list(manager *sessionManager) *sessionsListing {
+
+	probe.mu.Lock()
+	defer probe.mu.Unlock()
+
+	if probe.inFlight != nil {
+
+		return probe.inFlight
+	}
+
+	listing := &sessionsListing{done: make(chan struct{})}
+	probe.inFlight = listing
+
+	go func() {
+
+		listing.sessions = manager.list()
+		close(listing.done)
+
+		probe.mu.Lock()
+		probe.inFlight = nil
+		probe.mu.Unlock()
+	}()
+
+	return listing
+}
+
+// sessionManagerHealth reports a session manager which does not answer, as its lock is held by a hung
+// delivery, or a session left running long past its paid time
+func (handler *Handler) sessionManagerHealth() componentHealth {
+
+	listing := sessionsHealth.list(handler.sessions)
+
+	select {
+	case <-listing.done:
+		now := time.Now()
+
+		for _, s := range listing.sessions {
+
+			if now.After(s.started.Add(s.duration + overdueGrace)) {
+
+				return componentHealth{OK: false, Detail: fmt.Sprintf("session for token %s (service %d) overdue since %s", s.tokenKey, s.serviceID, s.started.Add(s.duration).Format(time.RFC3339))}
+			}
+		}
+
+		return componentHealth{OK: true, Detail: fmt.Sprintf("%d active sessions", len(listing.sessions))}
+	case <-time.After(livenessTimeout):
+		return componentHealth{OK: false, Detail: fmt.Sprintf("no answer within %s", livenessTimeout)}
+	}
+}
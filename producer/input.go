@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stianeikeland/go-rpio"
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// Input actions
+const (
+	inputStop string = "stop" // End the deliveries in progress
+	inputDemo string = "demo" // Start a free delivery
+)
+
+// defaultDebounceMs is how long a button must hold its new state before a press counts
+const defaultDebounceMs = 50
+
+// inputPollInterval is how often input pins are read
+const inputPollInterval = 5 * time.Millisecond
+
+// catalogInput is a GPIO input with a button attached
+type catalogInput struct {
+	Name       string `json:"name"`
+	Pin        int    `json:"pin"`
+	Pull       string `json:"pull"`       // up (default), down or off
+	ActiveHigh bool   `json:"activeHigh"` // The pin reads high when pressed. By default a press pulls it low.
+	DebounceMs int    `json:"debounceMs"`
+	Action     string `json:"action"`    // stop or demo
+	ServiceID  int    `json:"serviceId"` // stop: only end this service's deliveries, all when 0. demo: the service delivered.
+	PriceID    int    `json:"priceId"`   // demo: the price delivered
+	Units      int    `json:"units"`     // demo: the units delivered, default 1
+}
+
+// validateInputs checks the buttons, once the outputs and services have been checked
+func (c *catalog) validateInputs() error {
+
+	pins := make(map[int]string, 0)
+
+	for _, output := range c.Outputs {
+
+		pins[output.Pin] = "output " + output.Name
+	}
+
+	for _, output := range c.Outputs {
+
+		if output.Feedback == nil || output.Feedback.Pin == 0 {
+
+			continue
+		}
+
+		if used, ok := pins[output.Feedback.Pin]; ok {
+
+			return fmt.Errorf("output %s feedback: GPIO %d is already used by %s", output.Name, output.Feedback.Pin, used)
+		}
+
+		pins[output.Feedback.Pin] = "feedback for output " + output.Name
+	}
+
+	names := make(map[string]bool, 0)
+
+	for i := range c.Inputs {
+
+		input := &c.Inputs[i]
+
+		if input.Name == "" || names[input.Name] {
+
+			return fmt.Errorf("input names must be unique and not empty (%q)", input.Name)
+		}
+
+		names[input.Name] = true
+
+		if used, ok := pins[input.Pin]; ok {
+
+			return fmt.Errorf("input %s: GPIO %d is already used by %s", input.Name, input.Pin, used)
+		}
+
+		pins[input.Pin] = "input " + input.Name
+
+		switch input.Pull {
+
+		case "":
+			input.Pull = "up"
+		case "up", "down", "off":
+		default:
+			return fmt.Errorf("input %s: pull must be up, down or off", input.Name)
+		}
+
+		if input.DebounceMs < 0 {
+
+			return fmt.Errorf("input %s: negative debounce", input.Name)
+		}
+
+		if input.DebounceMs == 0 {
+
+			input.DebounceMs = defaultDebounceMs
+		}
+
+		switch input.Action {
+
+		case inputStop:
+			if input.ServiceID != 0 && c.service(input.ServiceID) == nil {
+
+				return fmt.Errorf("input %s: unknown service %d", input.Name, input.ServiceID)
+			}
+		case inputDemo:
+			price := c.price(input.ServiceID, input.PriceID)
+
+			if price == nil {
+
+				return fmt.Errorf("input %s: unknown service %d price %d", input.Name, input.ServiceID, input.PriceID)
+			}
+
+			if input.Units == 0 {
+
+				input.Units = 1
+			}
+
+			if input.Units < 0 || (price.MaxUnits > 0 && input.Units > price.MaxUnits) {
+
+				return fmt.Errorf("input %s: %d units cannot be delivered", input.Name, input.Units)
+			}
+		default:
+			return fmt.Errorf("input %s: action must be %s or %s", input.Name, inputStop, inputDemo)
+		}
+	}
+
+	return nil
+}
+
+// debouncer turns pin readings into presses. A change only counts once the pin has held it for delay.
+type debouncer struct {
+	delay     time.Duration
+	pressed   bool
+	candidate bool
+	since     time.Time
+}
+
+// update takes a reading and returns true when it completes a press
+func (d *debouncer) update(pressed bool, now time.Time) bool {
+
+	if pressed != d.candidate {
+
+		d.candidate = pressed
+		d.since = now
+		return false
+	}
+
+	if d.candidate == d.pressed || now.Sub(d.since) < d.delay {
+
+		return false
+	}
+
+	d.pressed = d.candidate
+
+	return d.pressed
+}
+
+// watchInputs sets up the button pins and acts on their presses for as long as the producer runs
+func (handler *Handler) watchInputs(inputs []catalogInput) {
+
+	if len(inputs) == 0 {
+
+		return
+	}
+
+	if !handler.rpioenabled {
+
+		fmt.Printf("GPIO is not available, ignoring %d buttons\n", len(inputs))
+		return
+	}
+
+	for _, input := range inputs {
+
+		pin := rpio.Pin(input.Pin)
+		pin.Input()
+
+		switch input.Pull {
+
+		case "up":
+			pin.PullUp()
+		case "down":
+			pin.PullDown()
+		default:
+			pin.PullOff()
+		}
+
+		go handler.watchButton(input, pin)
+
+		fmt.Printf("Button %s on GPIO %d: %s\n", input.Name, input.Pin, input.Action)
+	}
+}
+
+func (handler *Handler) watchButton(input catalogInput, pin rpio.Pin) {
+
+	active := rpio.Low
+
+	if input.ActiveHigh {
+
+		active = rpio.High
+	}
+
+	d := &debouncer{delay: time.Duration(input.DebounceMs) * time.Millisecond}
+
+	for {
+
+		if d.update(pin.Read() == active, time.Now()) {
+
+			handler.buttonPressed(input)
+		}
+
+		time.Sleep(inputPollInterval)
+	}
+}
+
+// buttonPressed records the press in the ledger and carries out the button's action
+func (handler *Handler) buttonPressed(input catalogInput) {
+
+	defer handler.recoverCallback("button "+input.Name, input.ServiceID, "")
+
+	fmt.Printf("Button %s pressed\n", input.Name)
+	log.WithFields(log.Fields{"button": input.Name, "action": input.Action}).Info("Button pressed")
+
+	var err error
+
+	switch input.Action {
+
+	case inputStop:
+		err = handler.stopDeliveries(input)
+	case inputDemo:
+		err = handler.startDemo(input, time.Now())
+	}
+
+	if err != nil {
+
+		fmt.Printf("Button %s: %s\n", input.Name, err.Error())
+		log.WithField("button", input.Name).Warnf("Button action failed: %s", err.Error())
+	}
+}
+
+// stopDeliveries ends the deliveries in progress through EndServiceDelivery, as if the consumer had
+// ended them, so the undelivered units are owed back
+func (handler *Handler) stopDeliveries(input catalogInput) error {
+
+	stopped := 0
+
+	for _, s := range handler.sessions.list() {
+
+		if input.ServiceID != 0 && s.serviceID != input.ServiceID {
+
+			continue
+		}
+
+		handler.recordButton(input, s.tokenKey, s.serviceID, s.priceID, fmt.Sprintf("stop button %s ended the delivery", input.Name))
+		handler.EndServiceDelivery(s.serviceID, types.ServiceDeliveryToken{Key: s.tokenKey}, 0)
+		stopped++
+	}
+
+	if stopped == 0 {
+
+		return errors.New("nothing is being delivered")
+	}
+
+	return nil
+}
+
+// startDemo gives away the button's units through the normal delivery path, under a token granted for them
+func (handler *Handler) startDemo(input catalogInput, now time.Time) error {
+
+	c, _ := handler.current()
+
+	// Checked here, as a refused delivery would be owed back as though it had been paid for
+	if reason := handler.unavailable(c.service(input.ServiceID), now); reason != "" {
+
+		return fmt.Errorf("service %d is unavailable, %s", input.ServiceID, reason)
+	}
+
+	key := fmt.Sprintf("demo-%s-%d", input.Name, now.UnixNano())
+
+	if err := handler.tokens.grant(key, input.ServiceID, input.PriceID, input.Units, now); err != nil {
+
+		return err
+	}
+
+	handler.recordButton(input, key, input.ServiceID, input.PriceID, fmt.Sprintf("demo button %s started a free delivery of %d units", input.Name, input.Units))
+
+	go handler.BeginServiceDelivery(input.ServiceID, input.PriceID, types.ServiceDeliveryToken{Key: key, Issued: now}, input.Units)
+
+	return nil
+}
+
+func (handler *Handler) recordButton(input catalogInput, tokenKey string, serviceID int, priceID int, reason string) {
+
+	entry := ledgerEntry{
+		Time:      time.Now(),
+		Type:      ledgerButton,
+		TokenKey:  tokenKey,
+		ServiceID: serviceID,
+		PriceID:   priceID,
+		Reason:    reason,
+	}
+
+	if err := handler.ledger.append(entry); err != nil {
+
+		log.WithField("button", input.Name).Errorf("Failed to write ledger: %s", err.Error())
+	}
+}
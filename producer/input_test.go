@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+
+	type reading struct {
+		ms      int // Since the first reading
+		pressed bool
+		press   bool // Whether the reading completes a press
+	}
+
+	tests := []struct {
+		name     string
+		readings []reading
+	}{
+		{"held for the delay", []reading{{0, true, false}, {49, true, false}, {50, true, true}}},
+		{"held down counts once", []reading{{0, true, false}, {50, true, true}, {100, true, false}, {500, true, false}}},
+		{"bounces restart the delay", []reading{{0, true, false}, {10, false, false}, {20, true, false}, {60, true, false}, {70, true, true}}},
+		{"too short a press", []reading{{0, true, false}, {30, false, false}, {200, false, false}}},
+		{"released and pressed again", []reading{{0, true, false}, {50, true, true}, {60, false, false}, {110, false, false}, {120, true, false}, {170, true, true}}},
+		{"release is not a press", []reading{{0, false, false}, {100, false, false}}},
+	}
+
+	for _, test := range tests {
+
+		d := &debouncer{delay: 50 * time.Millisecond}
+		start := time.Now()
+
+		for _, r := range test.readings {
+
+			if got := d.update(r.pressed, start.Add(time.Duration(r.ms)*time.Millisecond)); got != r.press {
+
+				t.Errorf("%s: at %dms pressed %t got press %t, want %t", test.name, r.ms, r.pressed, got, r.press)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Ledger entry types
+const (
+	ledgerDelivery      string = "delivery"       // A session ended
+	ledgerRefundDue     string = "refund-due"     // Fewer units were delivered than were paid for, or a paid delivery was refused
+	ledgerRefundPending string = "refund-pending" // A token expired with units unused, or a payment's token was never presented
+	ledgerRefunded      string = "refunded"       // The oldest refund owed to a token or payment was paid back through the PSP
+	ledgerButton        string = "button"         // A button stopped a delivery or started a free demo
+	ledgerFault         string = "fault"          // An output's feedback sensor showed it did not light
+)
+
+// ledgerEntry is one line of the producer's ledger
+type ledgerEntry struct {
+	Time           time.Time `json:"time"`
+	Type           string    `json:"type"`
+	TokenKey       string    `json:"tokenKey"`
+	ServiceID      int       `json:"serviceId"`
+	PriceID        int       `json:"priceId"`
+	Unit           string    `json:"unit"`
+	UnitsPaid      int       `json:"unitsPaid"`
+	UnitsDelivered int       `json:"unitsDelivered"`
+	UnitsReported  int       `json:"unitsReported"` // unitsReceived as passed to EndServiceDelivery
+	Amount         int       `json:"amount"`        // Minor units. For refund-due, the amount owed back.
+	Currency       string    `json:"currency"`
+	Reference      string    `json:"reference,omitempty"` // Payment reference, for a payment no token has claimed
+	Reason         string    `json:"reason,omitempty"`    // Why units were not delivered
+}
+
+// ledger is the producer's append only JSON lines record of deliveries and amounts owed back
+type ledger struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newLedger(path string) *ledger {
+
+	return &ledger{path: path}
+}
+
+func (l *ledger) append(entry ledgerEntry) error {
+
+	data, err := json.Marshal(entry)
+
+	if err != nil {
+
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+
+	return err
+}
+
+// entries reads every entry in the ledger, oldest first
+func (l *ledger) entries() ([]ledgerEntry, error) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+
+	if os.IsNotExist(err) {
+
+		return nil, nil
+	} else if err != nil {
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var entries []ledgerEntry
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+
+		if len(scanner.Bytes()) == 0 {
+
+			continue
+		}
+
+		var entry ledgerEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -19,26 +19,51 @@ import (
 var flagWPServiceKey string
 var flagWPClientKey string
 var flagIgnoreGPIO bool // Ignore any errors that arise from trying to setup RPi GPIO pins
+var flagCatalog string
+var flagLedger string
+var flagPricing string
+var flagCatalogPoll int
+var flagAdminAddr string
+var flagTokens string
+var flagFaults string
+var flagRefundSweep int
+var flagTestMillis int
+var flagExportFormat string
+var flagReadback bool
+var flagStatusPort int
+var flagCalibrate bool
+var flagBroadcastCheck int
+var flagReprice int
 
 // Application Vars
 var wpw wpwithin.WPWithin
 var wpwHandler Handler
 var pspConfig map[string]string
-var unitsInTime map[int]int
-
-const (
-	redDescr   string = "Turn on the red LED"
-	greenDescr string = "Turn on the green LED"
-	blueDescr  string = "Turn on the blue LED"
-	second     string = "second"
-	minute     string = "minute"
-)
+var serviceCatalog *catalog
+var deliveryLedger *ledger
+var pricing *pricingEngine
+var deliveryTokens *tokenRegistry
 
 func init() {
 
 	flag.StringVar(&flagWPServiceKey, "wpservicekey", "", "Worldpay service key")
 	flag.StringVar(&flagWPClientKey, "wpclientkey", "", "Worldpay client key")
 	flag.BoolVar(&flagIgnoreGPIO, "ignoregpio", false, "Ignore GPIO pin errors")
+	flag.StringVar(&flagCatalog, "catalog", "catalog.json", "Catalog of outputs, services and prices")
+	flag.StringVar(&flagLedger, "ledger", "ledger.jsonl", "Ledger of deliveries and refunds due")
+	flag.StringVar(&flagPricing, "pricing", "", "Pricing rules adjusting catalog prices, e.g. pricing.example.json (default fixed prices)")
+	flag.IntVar(&flagCatalogPoll, "catalogpoll", 5, "Seconds between checks for catalog changes, 0 = only reload on SIGHUP or the admin API")
+	flag.StringVar(&flagAdminAddr, "adminaddr", "127.0.0.1:8088", "Admin API listen address, empty to disable")
+	flag.StringVar(&flagTokens, "tokens", "tokens.json", "Registry of paid quotes and the delivery tokens presented")
+	flag.StringVar(&flagFaults, "faults", "faults.json", "Outputs found not to light, kept out of the broadcast until cleared")
+	flag.IntVar(&flagTestMillis, "testms", 1000, "Milliseconds each output is on for, for outputs test")
+	flag.BoolVar(&flagReadback, "readback", true, "Read each pin back during outputs selftest, to check it changes")
+	flag.BoolVar(&flagCalibrate, "calibrate", false, "Step each output through brightness levels during outputs selftest")
+	flag.StringVar(&flagExportFormat, "format", "csv", "Format for ledger export, csv or json")
+	flag.IntVar(&flagStatusPort, "statusport", 8089, "Port consumers poll for the status of their deliveries, 0 to disable")
+	flag.IntVar(&flagRefundSweep, "refundsweep", 60, "Seconds between checks for expired tokens with units to refund (0 = do not check)")
+	flag.IntVar(&flagReprice, "reprice", 60, "Seconds between updates of prices which follow the time of day (0 = only when the catalog or deliveries change)")
+	flag.IntVar(&flagBroadcastCheck, "broadcastcheck", 60, "Seconds between listening for the producer's own broadcast, for the health check (0 = do not listen)")
 }
 
 func main() {
@@ -46,7 +71,16 @@ func main() {
 	err := initLog()
 	errCheck(err, "initLog()")
 
-	flag.Parse()
+	cmd, args := findCommand(os.Args[1:])
+
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+
+	cmd.run(flag.Args())
+}
+
+// serve runs the producer, broadcasting its services until it is closed
+func serve(args []string) {
 
 	if strings.EqualFold(flagWPClientKey, "") {
 		fmt.Println("Flag wpclientkey is required")
@@ -56,6 +90,8 @@ func main() {
 		os.Exit(1)
 	}
 
+	loadConfig()
+
 	_wpw, err := wpwithin.Initialise("pi-led-producer", "Worldpay Within Pi LED Demo - Producer", "")
 	wpw = _wpw
 
@@ -66,8 +102,10 @@ func main() {
 	fmt.Printf("\n\n")
 
 	// wpwhandler accepts callbacks from worldpay within when service delivery begin/end is required.
-	err = wpwHandler.setup(wpw.GetDevice().Services, flagIgnoreGPIO)
+	err = wpwHandler.setup(wpw.GetDevice().Services, serviceCatalog, deliveryLedger, pricing, deliveryTokens, flagIgnoreGPIO)
 	errCheck(err, "wpwHandler setup")
+	wpwHandler.refreshAvailability()
+	wpwHandler.repriceAll()
 	wpw.SetEventHandler(&wpwHandler)
 
 	err = wpw.InitProducer(pspConfig)
@@ -78,18 +116,73 @@ func main() {
 	err = wpw.StartServiceBroadcast(0) // 0 = no timeout
 
 	errCheck(err, "start service broadcast")
+	broadcast.start(wpw.GetDevice().UID, time.Duration(flagBroadcastCheck)*time.Second)
+
+	wpwHandler.watchInputs(serviceCatalog.Inputs)
+
+	go wpwHandler.runRefundSweeper(time.Duration(flagRefundSweep) * time.Second)
+	go wpwHandler.runRepricer(time.Duration(flagReprice) * time.Second)
+
+	// Catalog changes are applied without stopping the broadcast
+	go watchCatalog(flagCatalog, time.Duration(flagCatalogPoll)*time.Second)
+
+	if !strings.EqualFold(flagAdminAddr, "") {
+
+		err = startAdmin(flagAdminAddr)
+		errCheck(err, "start admin API")
+		fmt.Printf("Admin API listening on %s\n", flagAdminAddr)
+	}
+
+	if flagStatusPort > 0 {
+
+		err = startStatusServer(flagStatusPort)
+		errCheck(err, "start delivery status server")
+		fmt.Printf("Delivery status served on port %d\n", flagStatusPort)
+	}
+
+	// Tell systemd the producer is up, and keep its watchdog fed while healthy
+	if err := sdNotify("READY=1"); err != nil {
+
+		log.Errorf("sd_notify READY failed: %s", err.Error())
+	}
+
+	watchdog, err := watchdogInterval()
+	errCheck(err, "watchdog interval")
+
+	if watchdog > 0 {
+
+		go wpwHandler.runWatchdog(watchdog)
+		fmt.Printf("Pinging the systemd watchdog every %s\n", watchdog)
+	}
 
 	// run the app until it is closed
 	runForever()
 }
 
-func doSetupServices() {
+// loadConfig loads the catalog, ledger, pricing rules and token registry named by the flags
+func loadConfig() {
+
+	var err error
 
-	_unitsInTime := make(map[int]int, 0)
-	unitsInTime = _unitsInTime
+	serviceCatalog, err = loadCatalog(flagCatalog)
+	errCheck(err, "loadCatalog()")
 
-	unitsInTime[1] = 1
-	unitsInTime[2] = 60
+	deliveryLedger = newLedger(flagLedger)
+
+	pricing, err = loadPricing(flagPricing)
+	errCheck(err, "loadPricing()")
+
+	err = pricing.expandVolumeTiers(serviceCatalog)
+	errCheck(err, "expandVolumeTiers()")
+
+	deliveryTokens, err = loadTokenRegistry(flagTokens)
+	errCheck(err, "loadTokenRegistry()")
+
+	err = wpwHandler.faults.load(flagFaults)
+	errCheck(err, "load faults")
+}
+
+func doSetupServices() {
 
 	////////////////////////////////////////////
 	// PSP Configuration
@@ -105,131 +198,68 @@ func doSetupServices() {
 	pspConfig[onlineworldpay.CfgAPIEndpoint] = "https://api.worldpay.com/v1"
 
 	////////////////////////////////////////////
-	// Red LED
+	// Services and prices from the catalog
 	////////////////////////////////////////////
 
-	svcRedLed, err := types.NewService()
-	errCheck(err, "New service - red led")
+	for _, catalogSvc := range serviceCatalog.Services {
 
-	svcRedLed.ID = 1
-	svcRedLed.Name = "Red LED"
-	svcRedLed.Description = redDescr
+		// Faults found before a restart stay until they are cleared
+		if reason := wpwHandler.faults.affects(&catalogSvc); reason != "" {
 
-	priceRedLedSecond, err := types.NewPrice()
-	errCheck(err, "Create new price - red led second")
-
-	priceRedLedSecond.Description = redDescr
-	priceRedLedSecond.ID = 1
-	priceRedLedSecond.UnitDescription = second
-	priceRedLedSecond.UnitID = 1
-	priceRedLedSecond.PricePerUnit = &types.PricePerUnit{
-		Amount:       5,
-		CurrencyCode: "GBP",
-	}
-
-	svcRedLed.AddPrice(*priceRedLedSecond)
+			fmt.Printf("Service %d left out of the broadcast: %s\n", catalogSvc.ID, reason)
+			continue
+		}
 
-	priceRedLedMinute, err := types.NewPrice()
-	errCheck(err, "Create new price - red led minute")
+		svc, err := newService(serviceCatalog, catalogSvc)
+		errCheck(err, fmt.Sprintf("New service - %s", catalogSvc.Name))
 
-	priceRedLedMinute.Description = redDescr
-	priceRedLedMinute.ID = 2
-	priceRedLedMinute.UnitDescription = minute
-	priceRedLedMinute.UnitID = 2
-	priceRedLedMinute.PricePerUnit = &types.PricePerUnit{
-		Amount:       20,
-		CurrencyCode: "GBP",
+		err = wpw.AddService(svc)
+		errCheck(err, fmt.Sprintf("Add service - %s", catalogSvc.Name))
 	}
+}
 
-	svcRedLed.AddPrice(*priceRedLedMinute)
-
-	err = wpw.AddService(svcRedLed)
-	errCheck(err, "Add service - red led")
-
-	////////////////////////////////////////////
-	// Green LED
-	////////////////////////////////////////////
-
-	svcGreenLed, err := types.NewService()
-	errCheck(err, "Create new service - Green LED")
-	svcGreenLed.ID = 2
-	svcGreenLed.Name = "Green LED"
-	svcGreenLed.Description = greenDescr
-
-	priceGreenLedSecond, err := types.NewPrice()
-	errCheck(err, "Create new price - green led second")
-
-	priceGreenLedSecond.Description = greenDescr
-	priceGreenLedSecond.ID = 1
-	priceGreenLedSecond.UnitDescription = second
-	priceGreenLedSecond.UnitID = 1
-	priceGreenLedSecond.PricePerUnit = &types.PricePerUnit{
-		Amount:       10,
-		CurrencyCode: "GBP",
-	}
+// newService builds the Worldpay Within service, with all its prices, for a catalog entry
+func newService(c *catalog, catalogSvc catalogService) (*types.Service, error) {
 
-	svcGreenLed.AddPrice(*priceGreenLedSecond)
+	svc, err := types.NewService()
 
-	priceGreenLedMinute, err := types.NewPrice()
-	errCheck(err, "Create new price - green led minute")
+	if err != nil {
 
-	priceGreenLedMinute.Description = greenDescr
-	priceGreenLedMinute.ID = 2
-	priceGreenLedMinute.UnitDescription = minute
-	priceGreenLedMinute.UnitID = 2
-	priceGreenLedMinute.PricePerUnit = &types.PricePerUnit{
-		Amount:       40, /* WOAH! This is minor units so means just 40p */
-		CurrencyCode: "GBP",
+		return nil, err
 	}
 
-	svcGreenLed.AddPrice(*priceGreenLedMinute)
+	svc.ID = catalogSvc.ID
+	svc.Name = catalogSvc.Name
+	svc.Description = catalogSvc.Description
 
-	err = wpw.AddService(svcGreenLed)
-	errCheck(err, "Add service - green led")
+	for _, catalogPrice := range catalogSvc.Prices {
 
-	////////////////////////////////////////////
-	// Blue LED
-	////////////////////////////////////////////
+		price, err := types.NewPrice()
 
-	svcBlueLed, err := types.NewService()
-	errCheck(err, "New service - blue led")
+		if err != nil {
 
-	svcBlueLed.ID = 3
-	svcBlueLed.Name = "Blue LED"
-	svcBlueLed.Description = redDescr
+			return nil, err
+		}
 
-	priceBlueLedSecond, err := types.NewPrice()
-	errCheck(err, "Create new price - blue led second")
+		unit := c.unit(catalogPrice.UnitID)
 
-	priceBlueLedSecond.Description = blueDescr
-	priceBlueLedSecond.ID = 1
-	priceBlueLedSecond.UnitDescription = second
-	priceBlueLedSecond.UnitID = 1
-	priceBlueLedSecond.PricePerUnit = &types.PricePerUnit{
-		Amount:       5,
-		CurrencyCode: "GBP",
-	}
-
-	err = svcBlueLed.AddPrice(*priceBlueLedSecond)
-	errCheck(err, "Add service price - blue led second")
+		// Consumers check the limits before asking for a quote
+		price.Description = catalogPrice.Description + catalogPrice.unitLimits()
+		price.ID = catalogPrice.ID
+		price.UnitDescription = unit.Description
+		price.UnitID = unit.ID
+		price.PricePerUnit = &types.PricePerUnit{
+			Amount:       catalogPrice.Amount, /* Minor units, so 20 means just 20p */
+			CurrencyCode: catalogPrice.Currency,
+		}
 
-	priceBlueLedMinute, err := types.NewPrice()
-	errCheck(err, "Create new price - blue led minute")
+		if err := svc.AddPrice(*price); err != nil {
 
-	priceBlueLedMinute.Description = blueDescr
-	priceBlueLedMinute.ID = 2
-	priceBlueLedMinute.UnitDescription = minute
-	priceBlueLedMinute.UnitID = 2
-	priceBlueLedMinute.PricePerUnit = &types.PricePerUnit{
-		Amount:       20,
-		CurrencyCode: "GBP",
+			return nil, fmt.Errorf("add price %d: %s", price.ID, err.Error())
+		}
 	}
 
-	err = svcBlueLed.AddPrice(*priceBlueLedMinute)
-	errCheck(err, "Add service price - blue led minute")
-
-	err = wpw.AddService(svcBlueLed)
-	errCheck(err, "Add service - blue led")
+	return svc, nil
 }
 
 func errCheck(err error, hint string) {
@@ -298,6 +328,31 @@ func printProducerOverview() {
 			fmt.Printf("\t\t\t\tID=%d, Description=%s\n", price.ID, price.Description)
 			fmt.Printf("\t\t\t\tUnitID=%d, UnitDescription=%s\n", price.UnitID, price.UnitDescription)
 			fmt.Printf("\t\t\t\tCurrency=%s, Amount=%d\n", price.PricePerUnit.CurrencyCode, price.PricePerUnit.Amount)
+
+			// Only LED prices have a brightness and colour
+			if catalogSvc := serviceCatalog.service(svc.ID); catalogSvc == nil || catalogSvc.pluginName() != "led" {
+
+				continue
+			}
+
+			if catalogPrice := serviceCatalog.price(svc.ID, price.ID); catalogPrice != nil {
+
+				fmt.Printf("\t\t\t\tBrightness=%d%%\n", catalogPrice.Brightness)
+
+				if len(catalogPrice.RGB) > 0 {
+
+					fmt.Printf("\t\t\t\tRGB=%v\n", catalogPrice.RGB)
+				}
+			}
+		}
+	}
+
+	if len(pricing.Rules) > 0 {
+
+		fmt.Println("Pricing rules:")
+		for _, rule := range pricing.Rules {
+
+			fmt.Printf("\t%s %+d%%, services=%v\n", rule.Type, rule.Percent, rule.Services)
 		}
 	}
 
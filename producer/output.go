@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// output is a light the producer can sell. ledOutput drives a GPIO pin; simOutput stands in
+// for it when GPIO is unavailable and records what the LED would have done.
+type output interface {
+	label() string
+	on(brightness int)
+	off()
+}
+
+// transition is a change of brightness on a simulated output
+type transition struct {
+	at    time.Time
+	level int
+}
+
+// simTimelineLimit bounds the recorded timeline so a long running producer does not grow without limit
+const simTimelineLimit = 4096
+
+// simOutput is a simulated output which records its on/off timeline
+type simOutput struct {
+	name string
+
+	mu       sync.Mutex
+	level    int
+	timeline []transition
+}
+
+func newSimOutput(name string) *simOutput {
+
+	return &simOutput{name: name}
+}
+
+func (output *simOutput) label() string {
+
+	return strings.ToUpper(output.name) + " LED"
+}
+
+func (output *simOutput) on(brightness int) {
+
+	output.set(brightness)
+}
+
+func (output *simOutput) off() {
+
+	output.set(0)
+}
+
+func (output *simOutput) set(level int) {
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+
+	if level == output.level {
+
+		return
+	}
+
+	output.level = level
+	output.timeline = append(output.timeline, transition{at: time.Now(), level: level})
+
+	if len(output.timeline) > simTimelineLimit {
+
+		output.timeline = output.timeline[len(output.timeline)-simTimelineLimit:]
+	}
+}
+
+// history returns a copy of the recorded transitions
+func (output *simOutput) history() []transition {
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+
+	return append([]transition(nil), output.timeline...)
+}
+
+// current returns the brightness the output is at now
+func (output *simOutput) current() int {
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+
+	return output.level
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pattern types
+const (
+	patternBlink   string = "blink"
+	patternBreathe string = "breathe"
+	patternMorse   string = "morse"
+	patternChase   string = "chase"
+)
+
+// breatheSteps is the number of brightness changes in one breathe cycle
+const breatheSteps = 40
+
+// catalogPattern is an animation sold as a price. Only the fields for its type are used.
+type catalogPattern struct {
+	Type     string  `json:"type"`
+	Rate     float64 `json:"rate"`     // blink: flashes per second
+	PeriodMs int     `json:"periodMs"` // breathe: length of one breath
+	Message  string  `json:"message"`  // morse: text to send
+	UnitMs   int     `json:"unitMs"`   // morse: length of a dot
+	StepMs   int     `json:"stepMs"`   // chase: time each output is lit
+}
+
+func (pattern *catalogPattern) validate(outputs int) error {
+
+	switch pattern.Type {
+
+	case patternBlink:
+		if pattern.Rate <= 0 || pattern.Rate > 50 {
+
+			return fmt.Errorf("blink rate must be between 0 and 50 per second")
+		}
+	case patternBreathe:
+		if pattern.PeriodMs < breatheSteps {
+
+			return fmt.Errorf("breathe periodMs must be at least %d", breatheSteps)
+		}
+	case patternMorse:
+		if pattern.UnitMs <= 0 {
+
+			return fmt.Errorf("morse unitMs must be greater than zero")
+		}
+
+		if len(pattern.Message) == 0 || len(pattern.Message) > 32 {
+
+			return fmt.Errorf("morse message must be 1-32 characters")
+		}
+
+		for _, r := range strings.ToUpper(pattern.Message) {
+
+			if _, ok := morseCode[r]; !ok && r != ' ' {
+
+				return fmt.Errorf("morse message has no code for %q", r)
+			}
+		}
+	case patternChase:
+		if pattern.StepMs <= 0 {
+
+			return fmt.Errorf("chase stepMs must be greater than zero")
+		}
+
+		if outputs < 2 {
+
+			return fmt.Errorf("chase needs at least two outputs")
+		}
+	default:
+		return fmt.Errorf("unknown pattern type %q", pattern.Type)
+	}
+
+	return nil
+}
+
+// step holds an output at a fraction of its session brightness for a time
+type step struct {
+	intensity float64 // 0 to 1
+	hold      time.Duration
+}
+
+// steps returns the looped sequence for each output. Every sequence in a pattern has the
+// same total length so outputs stay in step with each other.
+func (pattern *catalogPattern) steps(outputs []string) map[string][]step {
+
+	sequences := make(map[string][]step, 0)
+
+	switch pattern.Type {
+
+	case patternBlink:
+		half := time.Duration(float64(time.Second) / pattern.Rate / 2)
+
+		for _, name := range outputs {
+
+			sequences[name] = []step{{1, half}, {0, half}}
+		}
+
+	case patternBreathe:
+		hold := time.Duration(pattern.PeriodMs) * time.Millisecond / breatheSteps
+		seq := make([]step, breatheSteps)
+
+		for i := range seq {
+
+			seq[i] = step{(1 - math.Cos(2*math.Pi*float64(i)/breatheSteps)) / 2, hold}
+		}
+
+		for _, name := range outputs {
+
+			sequences[name] = seq
+		}
+
+	case patternMorse:
+		seq := morseSteps(pattern.Message, time.Duration(pattern.UnitMs)*time.Millisecond)
+
+		for _, name := range outputs {
+
+			sequences[name] = seq
+		}
+
+	case patternChase:
+		stepTime := time.Duration(pattern.StepMs) * time.Millisecond
+
+		for i, name := range outputs {
+
+			var seq []step
+
+			if i > 0 {
+
+				seq = append(seq, step{0, stepTime * time.Duration(i)})
+			}
+
+			seq = append(seq, step{1, stepTime})
+
+			if rest := len(outputs) - i - 1; rest > 0 {
+
+				seq = append(seq, step{0, stepTime * time.Duration(rest)})
+			}
+
+			sequences[name] = seq
+		}
+	}
+
+	return sequences
+}
+
+var morseCode = map[rune]string{
+	'A': ".-", 'B': "-...", 'C': "-.-.", 'D': "-..", 'E': ".", 'F': "..-.", 'G': "--.", 'H': "....",
+	'I': "..", 'J': ".---", 'K': "-.-", 'L': ".-..", 'M': "--", 'N': "-.", 'O': "---", 'P': ".--.",
+	'Q': "--.-", 'R': ".-.", 'S': "...", 'T': "-", 'U': "..-", 'V': "...-", 'W': ".--", 'X': "-..-",
+	'Y': "-.--", 'Z': "--..",
+	'0': "-----", '1': ".----", '2': "..---", '3': "...--", '4': "....-",
+	'5': ".....", '6': "-....", '7': "--...", '8': "---..", '9': "----.",
+}
+
+// morseSteps encodes a message with standard timing: dot 1 unit, dash 3, gap within a letter 1,
+// between letters 3 and between words 7. The sequence ends with a word gap so it loops cleanly.
+func morseSteps(message string, unit time.Duration) []step {
+
+	var seq []step
+
+	gap := func(units int) {
+
+		// Merge consecutive gaps so a space after a letter is 7 units, not 3 + 7
+		if n := len(seq); n > 0 && seq[n-1].intensity == 0 {
+
+			if seq[n-1].hold < unit*time.Duration(units) {
+
+				seq[n-1].hold = unit * time.Duration(units)
+			}
+
+			return
+		}
+
+		seq = append(seq, step{0, unit * time.Duration(units)})
+	}
+
+	for _, r := range strings.ToUpper(message) {
+
+		if r == ' ' {
+
+			gap(7)
+			continue
+		}
+
+		for i, symbol := range morseCode[r] {
+
+			if i > 0 {
+
+				gap(1)
+			}
+
+			if symbol == '.' {
+
+				seq = append(seq, step{1, unit})
+			} else {
+
+				seq = append(seq, step{1, unit * 3})
+			}
+		}
+
+		gap(3)
+	}
+
+	gap(7)
+
+	return seq
+}
+
+// patternPlayer runs a pattern with one goroutine per output until stopped, or until every
+// output has played its sequence a set number of times
+type patternPlayer struct {
+	stopCh chan struct{}
+	doneCh chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	mu     sync.Mutex
+	cycles map[string]int // Completed cycles by output name
+}
+
+// playPattern starts each output looping through its sequence, scaled by the output's session brightness.
+// A limit of 0 loops until stopped.
+func playPattern(outputs map[string]output, sequences map[string][]step, levels map[string]int, limit int) *patternPlayer {
+
+	player := &patternPlayer{
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+		cycles: make(map[string]int, 0),
+	}
+
+	for name, seq := range sequences {
+
+		player.cycles[name] = 0
+		player.wg.Add(1)
+
+		go player.run(name, outputs[name], seq, levels[name], limit)
+	}
+
+	go func() {
+
+		player.wg.Wait()
+		close(player.doneCh)
+	}()
+
+	return player
+}
+
+func (player *patternPlayer) run(name string, out output, seq []step, level int, limit int) {
+
+	defer player.wg.Done()
+	defer recoverGoroutine("pattern on "+name, out.off)
+
+	for {
+
+		for _, st := range seq {
+
+			if brightness := int(math.Round(st.intensity * float64(level))); brightness > 0 {
+
+				out.on(brightness)
+			} else {
+
+				out.off()
+			}
+
+			select {
+
+			case <-player.stopCh:
+				return
+			case <-time.After(st.hold):
+			}
+		}
+
+		player.mu.Lock()
+		player.cycles[name]++
+		completed := player.cycles[name]
+		player.mu.Unlock()
+
+		if limit > 0 && completed >= limit {
+
+			return
+		}
+	}
+}
+
+// completed returns the number of whole cycles played by every output
+func (player *patternPlayer) completed() int {
+
+	player.mu.Lock()
+	defer player.mu.Unlock()
+
+	least := -1
+
+	for _, n := range player.cycles {
+
+		if least < 0 || n < least {
+
+			least = n
+		}
+	}
+
+	if least < 0 {
+
+		return 0
+	}
+
+	return least
+}
+
+// done is closed once every output has finished, either by reaching the limit or being stopped
+func (player *patternPlayer) done() <-chan struct{} {
+
+	return player.doneCh
+}
+
+// stop ends the pattern and waits for every output goroutine to exit. The outputs are left as they are.
+func (player *patternPlayer) stop() {
+
+	player.once.Do(func() {
+
+		close(player.stopCh)
+	})
+
+	player.wg.Wait()
+}
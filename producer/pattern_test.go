@@ -0,0 +1,221 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// play runs a pattern to its cycle limit on simulated outputs and returns them
+func play(t *testing.T, pattern catalogPattern, levels map[string]int, limit int) map[string]*simOutput {
+
+	names := make([]string, 0, len(levels))
+
+	for _, name := range []string{"red", "green", "blue"} {
+
+		if _, ok := levels[name]; ok {
+
+			names = append(names, name)
+		}
+	}
+
+	if err := pattern.validate(len(names)); err != nil {
+
+		t.Fatalf("validate: %s", err.Error())
+	}
+
+	sims := make(map[string]*simOutput, 0)
+	outputs := make(map[string]output, 0)
+
+	for _, name := range names {
+
+		sims[name] = newSimOutput(name)
+		outputs[name] = sims[name]
+	}
+
+	player := playPattern(outputs, pattern.steps(names), levels, limit)
+
+	select {
+
+	case <-player.done():
+	case <-time.After(5 * time.Second):
+		player.stop()
+		t.Fatal("pattern did not finish")
+	}
+
+	if completed := player.completed(); completed != limit {
+
+		t.Errorf("completed %d cycles, want %d", completed, limit)
+	}
+
+	return sims
+}
+
+func levelsOf(timeline []transition) []int {
+
+	levels := make([]int, len(timeline))
+
+	for i, tr := range timeline {
+
+		levels[i] = tr.level
+	}
+
+	return levels
+}
+
+func sameLevels(got []int, want []int) bool {
+
+	if len(got) != len(want) {
+
+		return false
+	}
+
+	for i := range got {
+
+		if got[i] != want[i] {
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// Scheduling may make a step run long but never short, less a little clock slack
+const slack = 5 * time.Millisecond
+
+func TestBlinkTimeline(t *testing.T) {
+
+	sims := play(t, catalogPattern{Type: patternBlink, Rate: 10}, map[string]int{"red": 60}, 3)
+	timeline := sims["red"].history()
+
+	if want := []int{60, 0, 60, 0, 60, 0}; !sameLevels(levelsOf(timeline), want) {
+
+		t.Fatalf("levels %v, want %v", levelsOf(timeline), want)
+	}
+
+	for i := 1; i < len(timeline); i++ {
+
+		if gap := timeline[i].at.Sub(timeline[i-1].at); gap < 50*time.Millisecond-slack {
+
+			t.Errorf("transition %d came %s after the last, want at least 50ms", i, gap)
+		}
+	}
+}
+
+func TestBreatheTimeline(t *testing.T) {
+
+	sims := play(t, catalogPattern{Type: patternBreathe, PeriodMs: 400}, map[string]int{"green": 80}, 1)
+	timeline := sims["green"].history()
+	levels := levelsOf(timeline)
+
+	if len(levels) < 10 {
+
+		t.Fatalf("levels %v, want a fade up and down", levels)
+	}
+
+	peak := 0
+
+	for i, level := range levels {
+
+		if level > levels[peak] {
+
+			peak = i
+		}
+	}
+
+	if levels[peak] != 80 {
+
+		t.Errorf("peak level %d, want 80", levels[peak])
+	}
+
+	for i := 1; i < len(levels); i++ {
+
+		if i <= peak && levels[i] <= levels[i-1] {
+
+			t.Errorf("level fell from %d to %d while fading up: %v", levels[i-1], levels[i], levels)
+		}
+
+		if i > peak && levels[i] >= levels[i-1] {
+
+			t.Errorf("level rose from %d to %d while fading down: %v", levels[i-1], levels[i], levels)
+		}
+	}
+
+	if levels[len(levels)-1] != 0 {
+
+		t.Errorf("breath ended at %d, want 0", levels[len(levels)-1])
+	}
+
+	if took := timeline[len(timeline)-1].at.Sub(timeline[0].at); took < 400*time.Millisecond-2*10*time.Millisecond-slack {
+
+		t.Errorf("breath took %s, want about 400ms", took)
+	}
+}
+
+func TestChaseTimeline(t *testing.T) {
+
+	levels := map[string]int{"red": 100, "green": 50, "blue": 100}
+	sims := play(t, catalogPattern{Type: patternChase, StepMs: 40}, levels, 1)
+
+	tests := []struct {
+		name  string
+		want  []int
+		onAt  time.Duration // When the output lights, from when red lit
+		offAt time.Duration // When it goes out again, or 0 if it is the last in the sequence and stays lit
+	}{
+		{"red", []int{100, 0}, 0, 40 * time.Millisecond},
+		{"green", []int{50, 0}, 40 * time.Millisecond, 80 * time.Millisecond},
+		{"blue", []int{100}, 80 * time.Millisecond, 0},
+	}
+
+	start := sims["red"].history()[0].at
+
+	for _, test := range tests {
+
+		timeline := sims[test.name].history()
+
+		if !sameLevels(levelsOf(timeline), test.want) {
+
+			t.Errorf("%s levels %v, want %v", test.name, levelsOf(timeline), test.want)
+			continue
+		}
+
+		if onAt := timeline[0].at.Sub(start); onAt < test.onAt-slack {
+
+			t.Errorf("%s lit after %s, want %s", test.name, onAt, test.onAt)
+		}
+
+		if test.offAt > 0 {
+
+			if offAt := timeline[1].at.Sub(start); offAt < test.offAt-slack {
+
+				t.Errorf("%s went out after %s, want %s", test.name, offAt, test.offAt)
+			}
+		}
+	}
+}
+
+func TestStoppedPatternLeavesOutputsAlone(t *testing.T) {
+
+	sim := newSimOutput("red")
+	pattern := catalogPattern{Type: patternBlink, Rate: 20}
+	player := playPattern(map[string]output{"red": sim}, pattern.steps([]string{"red"}), map[string]int{"red": 100}, 0)
+
+	time.Sleep(60 * time.Millisecond)
+	player.stop()
+
+	recorded := len(sim.history())
+	time.Sleep(60 * time.Millisecond)
+
+	if len(sim.history()) != recorded {
+
+		t.Errorf("output changed after the pattern was stopped: %v", levelsOf(sim.history()))
+	}
+
+	select {
+
+	case <-player.done():
+	case <-time.After(time.Second):
+		t.Error("done is not closed after stop")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// deliveryPlugin delivers the services that name it in the catalog. A plugin is created for
+// each service, so it only ever sees prices of that service.
+type deliveryPlugin interface {
+	// resources returns what a delivery of the price needs exclusively. Deliveries sharing a resource cannot overlap.
+	resources(price *catalogPrice) []string
+	// start begins delivery for the session. It must return once delivery has started, not when it ends.
+	start(s *session, price *catalogPrice) error
+	// stop ends delivery for the session
+	stop(s *session) error
+	// status describes the current state of the plugin's hardware
+	status() string
+}
+
+// meteredPlugin is implemented by plugins which can deliver count units, e.g. blinks or photos.
+// start is given the number of units to deliver in the session rather than a length of time.
+type meteredPlugin interface {
+	deliveryPlugin
+	// consumed returns how many units the session has delivered so far
+	consumed(s *session) int
+	// finished is closed once the session has delivered every unit, or can deliver no more
+	finished(s *session) <-chan struct{}
+}
+
+// pluginEnv is what plugins are given to build themselves
+type pluginEnv struct {
+	outputs     map[string]output
+	gpioEnabled bool
+}
+
+// pluginFactory builds the plugin for a service from its catalog entry and plugin specific config
+type pluginFactory func(env *pluginEnv, svc *catalogService) (deliveryPlugin, error)
+
+// defaultPlugin delivers services which do not name a plugin
+const defaultPlugin = "led"
+
+// plugins holds the available plugins by name. New hardware is added by registering a factory here.
+var plugins = map[string]pluginFactory{
+	"led":   newLEDPlugin,
+	"relay": newRelayPlugin,
+	"exec":  newExecPlugin,
+}
+
+// pluginNames returns the registered plugin names, sorted
+func pluginNames() []string {
+
+	names := make([]string, 0, len(plugins))
+
+	for name := range plugins {
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// newPlugin builds the plugin named by a catalog service
+func newPlugin(env *pluginEnv, svc *catalogService) (deliveryPlugin, error) {
+
+	name := svc.pluginName()
+	factory, ok := plugins[name]
+
+	if !ok {
+
+		return nil, fmt.Errorf("service %d: unknown plugin %q", svc.ID, name)
+	}
+
+	plugin, err := factory(env, svc)
+
+	if err != nil {
+
+		return nil, fmt.Errorf("service %d: %s plugin: %s", svc.ID, name, err.Error())
+	}
+
+	return plugin, nil
+}
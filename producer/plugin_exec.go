@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// execStopGrace is how long a command is given to exit after SIGTERM before it is killed
+const execStopGrace = 5 * time.Second
+
+// execConfig is the catalog config for the exec plugin
+type execConfig struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// execPlugin runs a command for the paid time, or once per unit for count units (e.g. per photo).
+// The command is stopped when delivery ends if it is still running. It is told what was bought
+// through WPW_* environment variables.
+type execPlugin struct {
+	svcID  int
+	config execConfig
+
+	mu      sync.Mutex
+	running int
+}
+
+// execDelivery is the execPlugin state for a session
+type execDelivery struct {
+	mu        sync.Mutex
+	cmd       *exec.Cmd // The run in progress
+	completed int       // Runs which exited successfully
+	stopping  bool
+	done      chan struct{}
+}
+
+func newExecPlugin(env *pluginEnv, svc *catalogService) (deliveryPlugin, error) {
+
+	var config execConfig
+
+	if len(svc.Config) > 0 {
+
+		if err := json.Unmarshal(svc.Config, &config); err != nil {
+
+			return nil, err
+		}
+	}
+
+	if config.Command == "" {
+
+		return nil, errors.New("config with a command is required")
+	}
+
+	return &execPlugin{svcID: svc.ID, config: config}, nil
+}
+
+// resources allows one run of the command at a time
+func (plugin *execPlugin) resources(price *catalogPrice) []string {
+
+	return []string{fmt.Sprintf("exec:%d", plugin.svcID)}
+}
+
+// start runs the command once for time units, or once per unit, one after another, for count units
+func (plugin *execPlugin) start(s *session, price *catalogPrice) error {
+
+	runs := 1
+
+	if s.unit.isCount() {
+
+		runs = s.units
+	}
+
+	d := &execDelivery{done: make(chan struct{})}
+
+	// The first run is started here so that a command which cannot start fails the delivery
+	if err := plugin.run(s, d, 1); err != nil {
+
+		return err
+	}
+
+	s.state = d
+
+	plugin.mu.Lock()
+	plugin.running++
+	plugin.mu.Unlock()
+
+	go func() {
+
+		defer close(d.done)
+
+		// A run still going is killed, the delivery ends as it would if the command had exited. d.mu may be
+		// held by the panic, but only this goroutine replaces d.cmd.
+		defer recoverGoroutine("command "+plugin.config.Command, func() {
+
+			if d.cmd != nil && d.cmd.ProcessState == nil {
+
+				d.cmd.Process.Kill()
+			}
+		})
+
+		defer func() {
+
+			plugin.mu.Lock()
+			plugin.running--
+			plugin.mu.Unlock()
+		}()
+
+		for i := 1; ; i++ {
+
+			err := d.cmd.Wait()
+
+			d.mu.Lock()
+
+			if err != nil {
+
+				fmt.Printf("Command %s exited: %s\n", plugin.config.Command, err.Error())
+			} else {
+
+				d.completed++
+			}
+
+			if d.stopping || i >= runs {
+
+				d.mu.Unlock()
+				return
+			}
+
+			d.mu.Unlock()
+
+			if err := plugin.run(s, d, i+1); err != nil {
+
+				fmt.Printf("Command %s failed to start: %s\n", plugin.config.Command, err.Error())
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// run starts one run of the command
+func (plugin *execPlugin) run(s *session, d *execDelivery, run int) error {
+
+	cmd := exec.Command(plugin.config.Command, plugin.config.Args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"WPW_SERVICE_ID="+strconv.Itoa(s.serviceID),
+		"WPW_PRICE_ID="+strconv.Itoa(s.priceID),
+		"WPW_UNITS="+strconv.Itoa(s.units),
+		"WPW_RUN="+strconv.Itoa(run),
+		"WPW_DURATION_SECONDS="+strconv.Itoa(int(s.duration/time.Second)),
+		"WPW_TOKEN="+s.tokenKey,
+	)
+
+	fmt.Printf("EXEC %s %v\n", plugin.config.Command, plugin.config.Args)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopping {
+
+		return errors.New("delivery stopped")
+	}
+
+	if err := cmd.Start(); err != nil {
+
+		return err
+	}
+
+	d.cmd = cmd
+
+	return nil
+}
+
+func (plugin *execPlugin) stop(s *session) error {
+
+	d, ok := s.state.(*execDelivery)
+
+	if !ok {
+
+		return nil
+	}
+
+	select {
+
+	case <-d.done:
+		return nil
+	default:
+	}
+
+	d.mu.Lock()
+	d.stopping = true
+	process := d.cmd.Process
+	d.mu.Unlock()
+
+	fmt.Printf("Stopping %s\n", plugin.config.Command)
+	process.Signal(syscall.SIGTERM)
+
+	select {
+
+	case <-d.done:
+		return nil
+	case <-time.After(execStopGrace):
+	}
+
+	if err := process.Kill(); err != nil {
+
+		return err
+	}
+
+	<-d.done
+
+	return nil
+}
+
+func (plugin *execPlugin) consumed(s *session) int {
+
+	d, ok := s.state.(*execDelivery)
+
+	if !ok {
+
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.completed
+}
+
+func (plugin *execPlugin) finished(s *session) <-chan struct{} {
+
+	if d, ok := s.state.(*execDelivery); ok {
+
+		return d.done
+	}
+
+	done := make(chan struct{})
+	close(done)
+
+	return done
+}
+
+func (plugin *execPlugin) status() string {
+
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+
+	return fmt.Sprintf("exec %s, %d running", plugin.config.Command, plugin.running)
+}
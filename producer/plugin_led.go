@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ledPlugin lights one or more of the catalog's LED outputs, steadily or with a pattern
+type ledPlugin struct {
+	svc         *catalogService
+	outputs     map[string]output
+	gpioEnabled bool
+}
+
+// ledDelivery is the ledPlugin state for a session
+type ledDelivery struct {
+	levels map[string]int // Brightness percent by output name
+	player *patternPlayer // Set while a pattern is running
+}
+
+func newLEDPlugin(env *pluginEnv, svc *catalogService) (deliveryPlugin, error) {
+
+	for _, name := range svc.outputNames() {
+
+		if _, ok := env.outputs[name]; !ok {
+
+			return nil, fmt.Errorf("no output %q", name)
+		}
+	}
+
+	return &ledPlugin{
+		svc:         svc,
+		outputs:     env.outputs,
+		gpioEnabled: env.gpioEnabled,
+	}, nil
+}
+
+// resources are the names of the LED outputs, so a colour mix conflicts with each of its single LEDs
+func (plugin *ledPlugin) resources(price *catalogPrice) []string {
+
+	names := append([]string(nil), plugin.svc.outputNames()...)
+	sort.Strings(names)
+
+	return names
+}
+
+func (plugin *ledPlugin) start(s *session, price *catalogPrice) error {
+
+	d := &ledDelivery{levels: plugin.svc.levels(price)}
+	s.state = d
+
+	for _, name := range s.resources {
+
+		fmt.Printf("POWER ON %s at %d%% brightness\n", plugin.outputs[name].label(), d.levels[name])
+	}
+
+	if !plugin.gpioEnabled {
+
+		fmt.Println("Raspberry Pi GPIO disabled.")
+	}
+
+	if price.Pattern != nil {
+
+		// Sold by count, each unit is one cycle of the pattern, e.g. one blink
+		limit := 0
+
+		if s.unit.isCount() {
+
+			limit = s.units
+			fmt.Printf("Playing %s pattern %d times\n", price.Pattern.Type, limit)
+		} else {
+
+			fmt.Printf("Playing %s pattern\n", price.Pattern.Type)
+		}
+
+		d.player = playPattern(plugin.outputs, price.Pattern.steps(plugin.svc.outputNames()), d.levels, limit)
+		return nil
+	}
+
+	for _, name := range s.resources {
+
+		if d.levels[name] > 0 {
+
+			plugin.outputs[name].on(d.levels[name])
+		}
+	}
+
+	return nil
+}
+
+func (plugin *ledPlugin) stop(s *session) error {
+
+	if d, ok := s.state.(*ledDelivery); ok && d.player != nil {
+
+		d.player.stop()
+	}
+
+	for _, name := range s.resources {
+
+		fmt.Printf("POWER OFF %s\n", plugin.outputs[name].label())
+		plugin.outputs[name].off()
+	}
+
+	return nil
+}
+
+func (plugin *ledPlugin) consumed(s *session) int {
+
+	if d, ok := s.state.(*ledDelivery); ok && d.player != nil {
+
+		return d.player.completed()
+	}
+
+	return 0
+}
+
+func (plugin *ledPlugin) finished(s *session) <-chan struct{} {
+
+	if d, ok := s.state.(*ledDelivery); ok && d.player != nil {
+
+		return d.player.done()
+	}
+
+	done := make(chan struct{})
+	close(done)
+
+	return done
+}
+
+func (plugin *ledPlugin) status() string {
+
+	backend := "gpio"
+
+	if !plugin.gpioEnabled {
+
+		backend = "simulated"
+	}
+
+	return fmt.Sprintf("%s outputs %s", backend, strings.Join(plugin.svc.outputNames(), ", "))
+}
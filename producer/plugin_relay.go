@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/stianeikeland/go-rpio"
+)
+
+// relayConfig is the catalog config for the relay plugin
+type relayConfig struct {
+	Pin       int  `json:"pin"`
+	ActiveLow bool `json:"activeLow"` // Most relay boards switch on when the input is pulled low
+}
+
+// relayPlugin switches a relay (or buzzer, or anything else on a single digital pin) on for the paid time
+type relayPlugin struct {
+	config      relayConfig
+	gpioEnabled bool
+
+	mu     sync.Mutex
+	active bool
+}
+
+func newRelayPlugin(env *pluginEnv, svc *catalogService) (deliveryPlugin, error) {
+
+	var config relayConfig
+
+	if len(svc.Config) == 0 {
+
+		return nil, errors.New("config with a pin is required")
+	}
+
+	if err := json.Unmarshal(svc.Config, &config); err != nil {
+
+		return nil, err
+	}
+
+	if config.Pin <= 0 {
+
+		return nil, errors.New("config with a pin is required")
+	}
+
+	plugin := &relayPlugin{config: config, gpioEnabled: env.gpioEnabled}
+
+	if plugin.gpioEnabled {
+
+		rpio.Pin(config.Pin).Output()
+	}
+
+	plugin.write(false)
+
+	return plugin, nil
+}
+
+func (plugin *relayPlugin) resources(price *catalogPrice) []string {
+
+	return []string{fmt.Sprintf("relay:%d", plugin.config.Pin)}
+}
+
+func (plugin *relayPlugin) start(s *session, price *catalogPrice) error {
+
+	fmt.Printf("RELAY ON pin %d\n", plugin.config.Pin)
+	plugin.write(true)
+
+	return nil
+}
+
+func (plugin *relayPlugin) stop(s *session) error {
+
+	fmt.Printf("RELAY OFF pin %d\n", plugin.config.Pin)
+	plugin.write(false)
+
+	return nil
+}
+
+func (plugin *relayPlugin) status() string {
+
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+
+	state := "off"
+
+	if plugin.active {
+
+		state = "on"
+	}
+
+	if !plugin.gpioEnabled {
+
+		return fmt.Sprintf("relay pin %d %s (simulated)", plugin.config.Pin, state)
+	}
+
+	return fmt.Sprintf("relay pin %d %s", plugin.config.Pin, state)
+}
+
+func (plugin *relayPlugin) write(on bool) {
+
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+
+	plugin.active = on
+
+	if !plugin.gpioEnabled {
+
+		return
+	}
+
+	pin := rpio.Pin(plugin.config.Pin)
+
+	if on != plugin.config.ActiveLow {
+
+		pin.High()
+	} else {
+
+		pin.Low()
+	}
+}
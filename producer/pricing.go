@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// Pricing rule types
+const (
+	ruleTimeOfDay string = "timeOfDay" // Between from and to each day
+	ruleDemand    string = "demand"    // At least minSessions deliveries in progress
+	ruleVolume    string = "volume"    // At least minUnits bought in one order
+)
+
+// pricingRule adjusts the catalog price by percent, e.g. 20 adds 20% and -10 takes 10% off.
+// For demand and volume only the matching rule with the highest threshold applies, so they
+// can be used as tiers. Volume tiers are sold as prices of their own, see expandVolumeTiers.
+type pricingRule struct {
+	Type        string `json:"type"`
+	Services    []int  `json:"services"` // Services the rule applies to, all when empty
+	MinSessions int    `json:"minSessions"`
+	MinUnits    int    `json:"minUnits"`
+	Percent     int    `json:"percent"`
+
+	clockWindow // timeOfDay only
+}
+
+// pricingEngine works out the price of a service from its catalog price and the rules
+type pricingEngine struct {
+	Rules []pricingRule `json:"rules"`
+}
+
+// loadPricing reads the pricing rules, or returns an engine which leaves prices fixed when path is empty
+func loadPricing(path string) (*pricingEngine, error) {
+
+	engine := &pricingEngine{}
+
+	if path == "" {
+
+		return engine, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, engine); err != nil {
+
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	if err := engine.validate(); err != nil {
+
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return engine, nil
+}
+
+func (engine *pricingEngine) validate() error {
+
+	for i := range engine.Rules {
+
+		rule := &engine.Rules[i]
+
+		if rule.Percent < -100 {
+
+			return fmt.Errorf("rule %d: percent cannot take more than 100%% off", i+1)
+		}
+
+		switch rule.Type {
+
+		case ruleTimeOfDay:
+			if err := rule.clockWindow.parse(); err != nil {
+
+				return fmt.Errorf("rule %d: %s", i+1, err.Error())
+			}
+		case ruleDemand:
+			if rule.MinSessions <= 0 {
+
+				return fmt.Errorf("rule %d: minSessions must be at least 1", i+1)
+			}
+		case ruleVolume:
+			if rule.MinUnits <= 0 {
+
+				return fmt.Errorf("rule %d: minUnits must be at least 1", i+1)
+			}
+		default:
+			return fmt.Errorf("rule %d: unknown type %q", i+1, rule.Type)
+		}
+	}
+
+	return nil
+}
+
+func (rule *pricingRule) appliesTo(serviceID int) bool {
+
+	if len(rule.Services) == 0 {
+
+		return true
+	}
+
+	for _, id := range rule.Services {
+
+		if id == serviceID {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// unitPrice returns the price per unit quoted to consumers, adjusted for the time of day and demand.
+// Volume discounts are already in the amounts of the volume tier prices.
+func (engine *pricingEngine) unitPrice(serviceID int, base int, now time.Time, activeSessions int) int {
+
+	percent := 100
+	demandTier := 0
+	demandPercent := 0
+
+	for i := range engine.Rules {
+
+		rule := &engine.Rules[i]
+
+		if !rule.appliesTo(serviceID) {
+
+			continue
+		}
+
+		switch rule.Type {
+
+		case ruleTimeOfDay:
+			if rule.contains(now) {
+
+				percent = percent * (100 + rule.Percent) / 100
+			}
+		case ruleDemand:
+			if activeSessions >= rule.MinSessions && rule.MinSessions > demandTier {
+
+				demandTier = rule.MinSessions
+				demandPercent = rule.Percent
+			}
+		}
+	}
+
+	return adjust(base, percent*(100+demandPercent)/100)
+}
+
+// volumeTierIDs spaces the IDs of volume tier prices, so tier n of price p has ID p*volumeTierIDs+n
+const volumeTierIDs = 1000
+
+// expandVolumeTiers turns the volume rules into prices of their own, so a volume discount is part of
+// the unit price the SDK quotes rather than something applied to the quote afterwards. Each price gains
+// a copy for every volume tier that applies to its service, with the tier's percent applied to its amount
+// and the units from the tier's minUnits up to the next tier. The price itself keeps the units below the
+// first tier. A tier at or below a price's minimum purchase, or above its maximum, does not apply to it.
+func (engine *pricingEngine) expandVolumeTiers(c *catalog) error {
+
+	if engine == nil {
+
+		return nil
+	}
+
+	for i := range c.Services {
+
+		svc := &c.Services[i]
+		tiers := engine.volumeTiers(svc.ID)
+
+		if len(tiers) == 0 {
+
+			continue
+		}
+
+		ids := make(map[int]bool, 0)
+
+		for _, price := range svc.Prices {
+
+			ids[price.ID] = true
+		}
+
+		var added []catalogPrice
+
+		for j := range svc.Prices {
+
+			base := &svc.Prices[j]
+
+			var applicable []pricingRule
+
+			for _, rule := range tiers {
+
+				if rule.MinUnits > base.MinUnits && (base.MaxUnits == 0 || rule.MinUnits <= base.MaxUnits) {
+
+					applicable = append(applicable, rule)
+				}
+			}
+
+			for n, rule := range applicable {
+
+				tier := *base
+				tier.ID = base.ID*volumeTierIDs + n + 1
+				tier.Amount = adjust(base.Amount, 100+rule.Percent)
+				tier.MinUnits = rule.MinUnits
+
+				if n+1 < len(applicable) {
+
+					tier.MaxUnits = applicable[n+1].MinUnits - 1
+				}
+
+				if ids[tier.ID] {
+
+					return fmt.Errorf("service %d price %d: volume tier %d needs price id %d, which is already used", svc.ID, base.ID, n+1, tier.ID)
+				}
+
+				ids[tier.ID] = true
+				added = append(added, tier)
+			}
+
+			if len(applicable) > 0 {
+
+				base.MaxUnits = applicable[0].MinUnits - 1
+			}
+		}
+
+		svc.Prices = append(svc.Prices, added...)
+	}
+
+	return nil
+}
+
+// volumeTiers returns the volume rules for a service, lowest threshold first. Of two rules with the
+// same threshold the later one is used.
+func (engine *pricingEngine) volumeTiers(serviceID int) []pricingRule {
+
+	byThreshold := make(map[int]pricingRule, 0)
+
+	for _, rule := range engine.Rules {
+
+		if rule.Type == ruleVolume && rule.appliesTo(serviceID) {
+
+			byThreshold[rule.MinUnits] = rule
+		}
+	}
+
+	tiers := make([]pricingRule, 0, len(byThreshold))
+
+	for _, rule := range byThreshold {
+
+		tiers = append(tiers, rule)
+	}
+
+	sort.Slice(tiers, func(i, j int) bool {
+
+		return tiers[i].MinUnits < tiers[j].MinUnits
+	})
+
+	return tiers
+}
+
+// adjust scales amount by percent, rounded to the nearest minor unit
+func adjust(amount int, percent int) int {
+
+	if percent <= 0 {
+
+		return 0
+	}
+
+	return (amount*percent + 50) / 100
+}
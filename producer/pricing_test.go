@@ -0,0 +1,255 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newEngine returns a pricing engine for the rules, validated as loadPricing does
+func newEngine(t *testing.T, rules ...pricingRule) *pricingEngine {
+
+	engine := &pricingEngine{Rules: rules}
+
+	if err := engine.validate(); err != nil {
+
+		t.Fatalf("validate: %s", err.Error())
+	}
+
+	return engine
+}
+
+func at(clock string) time.Time {
+
+	t, err := time.Parse("15:04", clock)
+
+	if err != nil {
+
+		panic(err)
+	}
+
+	return time.Date(2026, 10, 19, t.Hour(), t.Minute(), 0, 0, time.Local)
+}
+
+func TestUnitPriceTimeOfDay(t *testing.T) {
+
+	engine := newEngine(t,
+		pricingRule{Type: ruleTimeOfDay, Percent: 25, clockWindow: clockWindow{From: "17:00", To: "20:00"}},
+		pricingRule{Type: ruleTimeOfDay, Percent: -50, clockWindow: clockWindow{From: "23:00", To: "06:00"}},
+	)
+
+	tests := []struct {
+		name string
+		now  string
+		want int
+	}{
+		{"before the evening window", "16:59", 100},
+		{"start of the evening window", "17:00", 125},
+		{"in the evening window", "19:59", 125},
+		{"end of the evening window", "20:00", 100},
+		{"overnight before midnight", "23:00", 50},
+		{"overnight after midnight", "02:30", 50},
+		{"end of the overnight window", "06:00", 100},
+	}
+
+	for _, test := range tests {
+
+		if got := engine.unitPrice(1, 100, at(test.now), 0); got != test.want {
+
+			t.Errorf("%s (%s): got %d, want %d", test.name, test.now, got, test.want)
+		}
+	}
+}
+
+func TestUnitPriceDemand(t *testing.T) {
+
+	engine := newEngine(t,
+		pricingRule{Type: ruleDemand, MinSessions: 2, Percent: 10},
+		pricingRule{Type: ruleDemand, MinSessions: 4, Percent: 20},
+		pricingRule{Type: ruleDemand, Services: []int{4}, MinSessions: 3, Percent: 50},
+	)
+
+	tests := []struct {
+		serviceID int
+		sessions  int
+		want      int
+	}{
+		{1, 0, 100},
+		{1, 1, 100},
+		{1, 2, 110},
+		{1, 3, 110},
+		{1, 4, 120},
+		{1, 9, 120},
+		{4, 2, 110},
+		{4, 3, 150},
+		{4, 4, 120}, // The highest threshold reached wins, not the biggest percent
+	}
+
+	for _, test := range tests {
+
+		if got := engine.unitPrice(test.serviceID, 100, at("12:00"), test.sessions); got != test.want {
+
+			t.Errorf("service %d with %d sessions: got %d, want %d", test.serviceID, test.sessions, got, test.want)
+		}
+	}
+}
+
+func TestUnitPriceCompounding(t *testing.T) {
+
+	overlapping := []pricingRule{
+		{Type: ruleTimeOfDay, Percent: 25, clockWindow: clockWindow{From: "17:00", To: "20:00"}},
+		{Type: ruleTimeOfDay, Percent: 10, clockWindow: clockWindow{From: "18:00", To: "19:00"}},
+		{Type: ruleDemand, MinSessions: 1, Percent: 10},
+	}
+
+	tests := []struct {
+		name     string
+		rules    []pricingRule
+		base     int
+		now      string
+		sessions int
+		want     int
+	}{
+		{"one window", overlapping, 1000, "17:30", 0, 1250},
+		// 125% then 110% is 137.5%, truncated to 137%
+		{"two windows truncate the percent", overlapping, 1000, "18:30", 0, 1370},
+		// 137% then 110% is 150.7%, truncated to 150%
+		{"windows and demand", overlapping, 1000, "18:30", 1, 1500},
+		{"rounded to the nearest minor unit", overlapping, 15, "12:00", 1, 17},
+		{"free when everything is taken off", []pricingRule{{Type: ruleDemand, MinSessions: 1, Percent: -100}}, 1000, "12:00", 1, 0},
+	}
+
+	for _, test := range tests {
+
+		engine := newEngine(t, test.rules...)
+
+		if got := engine.unitPrice(1, test.base, at(test.now), test.sessions); got != test.want {
+
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExpandVolumeTiers(t *testing.T) {
+
+	tiers := []pricingRule{
+		{Type: ruleVolume, MinUnits: 120, Percent: -15},
+		{Type: ruleVolume, MinUnits: 30, Percent: -5},
+	}
+
+	type price struct {
+		ID       int
+		Amount   int
+		MinUnits int
+		MaxUnits int
+	}
+
+	tests := []struct {
+		name   string
+		rules  []pricingRule
+		prices []catalogPrice
+		want   []price
+	}{
+		{
+			"no volume rules",
+			nil,
+			[]catalogPrice{{ID: 1, Amount: 100}},
+			[]price{{1, 100, 0, 0}},
+		},
+		{
+			"each tier is a price up to the next",
+			tiers,
+			[]catalogPrice{{ID: 1, Amount: 100}},
+			[]price{{1, 100, 0, 29}, {1001, 95, 30, 119}, {1002, 85, 120, 0}},
+		},
+		{
+			"the last tier keeps the price's maximum",
+			tiers,
+			[]catalogPrice{{ID: 2, Amount: 20, MinUnits: 5, MaxUnits: 60}},
+			[]price{{2, 20, 5, 29}, {2001, 19, 30, 60}},
+		},
+		{
+			"tiers outside the price's limits do not apply",
+			tiers,
+			[]catalogPrice{{ID: 3, Amount: 100, MinUnits: 40, MaxUnits: 100}},
+			[]price{{3, 100, 40, 100}},
+		},
+		{
+			"rules for other services do not apply",
+			[]pricingRule{{Type: ruleVolume, Services: []int{2}, MinUnits: 30, Percent: -5}},
+			[]catalogPrice{{ID: 1, Amount: 100}},
+			[]price{{1, 100, 0, 0}},
+		},
+		{
+			"a later rule with the same threshold wins",
+			[]pricingRule{{Type: ruleVolume, MinUnits: 30, Percent: -5}, {Type: ruleVolume, MinUnits: 30, Percent: -10}},
+			[]catalogPrice{{ID: 1, Amount: 100}},
+			[]price{{1, 100, 0, 29}, {1001, 90, 30, 0}},
+		},
+	}
+
+	for _, test := range tests {
+
+		c := &catalog{Services: []catalogService{{ID: 1, Prices: test.prices}}}
+
+		if err := newEngine(t, test.rules...).expandVolumeTiers(c); err != nil {
+
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+
+		var got []price
+
+		for _, p := range c.Services[0].Prices {
+
+			got = append(got, price{p.ID, p.Amount, p.MinUnits, p.MaxUnits})
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExpandVolumeTiersIDClash(t *testing.T) {
+
+	c := &catalog{Services: []catalogService{{ID: 1, Prices: []catalogPrice{{ID: 1, Amount: 100}, {ID: 1001, Amount: 90}}}}}
+	engine := newEngine(t, pricingRule{Type: ruleVolume, MinUnits: 30, Percent: -5})
+
+	if err := engine.expandVolumeTiers(c); err == nil {
+
+		t.Error("expected an error for a tier price ID already in use")
+	}
+}
+
+func TestExampleCatalogWithExamplePricing(t *testing.T) {
+
+	c, err := loadCatalog("catalog.json")
+
+	if err != nil {
+
+		t.Fatalf("loadCatalog: %s", err.Error())
+	}
+
+	engine, err := loadPricing("pricing.example.json")
+
+	if err != nil {
+
+		t.Fatalf("loadPricing: %s", err.Error())
+	}
+
+	if err := engine.expandVolumeTiers(c); err != nil {
+
+		t.Fatalf("expandVolumeTiers: %s", err.Error())
+	}
+
+	// Service 1 price 1 is sold up to 600 seconds, so both tiers apply
+	for _, id := range []int{1001, 1002} {
+
+		if c.price(1, id) == nil {
+
+			t.Errorf("service 1 has no volume tier price %d", id)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stianeikeland/go-rpio"
+)
+
+// defaultPWMFrequency is used when an output does not set pwmFrequency. Fast enough not to flicker.
+const defaultPWMFrequency = 100
+
+// ledOutput drives one LED. Full brightness sets the pin high; lower brightness levels use
+// hardware PWM where the pin supports it and a software PWM goroutine otherwise.
+type ledOutput struct {
+	name        string
+	pin         rpio.Pin
+	hardwarePWM bool
+	frequency   int
+
+	mu      sync.Mutex
+	stopPWM chan struct{}
+	pwmDone chan struct{}
+}
+
+func newLEDOutput(config catalogOutput) *ledOutput {
+
+	return &ledOutput{
+		name:        config.Name,
+		pin:         rpio.Pin(config.Pin),
+		hardwarePWM: config.HardwarePWM,
+		frequency:   config.PWMFrequency,
+	}
+}
+
+// label is used in console output, e.g. RED LED
+func (output *ledOutput) label() string {
+
+	return strings.ToUpper(output.name) + " LED"
+}
+
+// init puts the pin into the right mode with the LED off
+func (output *ledOutput) init() {
+
+	if output.hardwarePWM {
+
+		output.pin.Pwm()
+		// The PWM clock is divided by the cycle length (100) to give the output frequency
+		output.pin.Freq(output.frequency * 100)
+		output.pin.DutyCycle(0, 100)
+		return
+	}
+
+	output.pin.Output()
+	output.pin.Low()
+}
+
+// on lights the LED at a brightness between 1 and 100 percent
+func (output *ledOutput) on(brightness int) {
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+
+	output.stopSoftPWM()
+
+	switch {
+
+	case output.hardwarePWM:
+		output.pin.DutyCycle(uint32(brightness), 100)
+	case brightness >= 100:
+		output.pin.High()
+	default:
+		output.startSoftPWM(brightness)
+	}
+}
+
+// off turns the LED off, stopping any PWM
+func (output *ledOutput) off() {
+
+	output.mu.Lock()
+	defer output.mu.Unlock()
+
+	output.stopSoftPWM()
+
+	if output.hardwarePWM {
+
+		output.pin.DutyCycle(0, 100)
+		return
+	}
+
+	output.pin.Low()
+}
+
+// startSoftPWM toggles the pin from a goroutine. Must be called with mu held.
+func (output *ledOutput) startSoftPWM(brightness int) {
+
+	period := time.Second / time.Duration(output.frequency)
+	onTime := period * time.Duration(brightness) / 100
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	output.stopPWM = stop
+	output.pwmDone = done
+
+	go func() {
+
+		defer close(done)
+
+		// Not off, which would wait for this goroutine with mu held by the caller
+		defer recoverGoroutine("software PWM on "+output.label(), output.pin.Low)
+
+		for {
+
+			select {
+
+			case <-stop:
+				return
+			default:
+			}
+
+			output.pin.High()
+			time.Sleep(onTime)
+			output.pin.Low()
+			time.Sleep(period - onTime)
+		}
+	}()
+}
+
+// stopSoftPWM stops the PWM goroutine if one is running and waits for it to finish. Must be called with mu held.
+func (output *ledOutput) stopSoftPWM() {
+
+	if output.stopPWM == nil {
+
+		return
+	}
+
+	close(output.stopPWM)
+	<-output.pwmDone
+
+	output.stopPWM = nil
+	output.pwmDone = nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recoverCallback stops a panic in an SDK callback from taking down the producer and its broadcast, then
+// runs cleanup, e.g. ending the session the callback acquired or giving back units claimed before it did.
+// The token only labels the log: another delivery on the same token is never touched. Deferred at the top
+// of each callback.
+func (handler *Handler) recoverCallback(callback string, serviceID int, tokenKey string, cleanup ...func()) {
+
+	r := recover()
+
+	if r == nil {
+
+		return
+	}
+
+	stack := debug.Stack()
+	atomic.AddInt64(&handler.panics, 1)
+
+	fmt.Printf("Recovered from panic in %s: %v\n", callback, r)
+	log.WithFields(log.Fields{"callback": callback, "serviceID": serviceID, "token": tokenKey}).Errorf("Panic: %v\n%s", r, stack)
+
+	for _, fn := range cleanup {
+
+		safely(callback+" cleanup", fn)
+	}
+}
+
+// recoverGoroutine stops a panic in one of the producer's own goroutines from taking it down, and runs
+// cleanup, e.g. turning outputs off. Deferred at the top of the goroutine.
+func recoverGoroutine(what string, cleanup func()) {
+
+	r := recover()
+
+	if r == nil {
+
+		return
+	}
+
+	fmt.Printf("Recovered from panic in %s: %v\n", what, r)
+	log.Errorf("Panic in %s: %v\n%s", what, r, debug.Stack())
+
+	if cleanup != nil {
+
+		safely(what+" cleanup", cleanup)
+	}
+}
+
+// abandonSession ends a released session after a panic, turning its outputs off even if the plugin cannot,
+// and records what it delivered and what is owed back
+func (handler *Handler) abandonSession(s *session) {
+
+	if s.plugin != nil {
+
+		safely("stop plugin", func() {
+
+			if err := s.plugin.stop(s); err != nil {
+
+				log.WithField("token", s.tokenKey).Errorf("Failed to stop plugin after panic: %s", err.Error())
+			}
+		})
+	}
+
+	// Resources named after an output are LEDs, turn them off directly in case the plugin could not
+	for _, resource := range s.resources {
+
+		if out, ok := handler.outputs[resource]; ok {
+
+			safely("turn off "+resource, out.off)
+		}
+	}
+
+	reconciled := false
+
+	safely("reconcile", func() {
+
+		handler.reconcile(s, s.plugin, 0)
+		reconciled = true
+	})
+
+	// The plugin cannot say what it delivered, so nothing is counted as delivered
+	if !reconciled {
+
+		handler.deliveries.ended(s.tokenKey, 0, "producer error")
+
+		safely("record refund", func() {
+
+			handler.refundUndelivered(&s.token, s.unit.Description, s.units, "producer error")
+		})
+	}
+
+	fmt.Printf("Ended delivery for token %s after a panic\n", s.tokenKey)
+}
+
+// safely runs fn, logging rather than propagating any panic
+func safely(what string, fn func()) {
+
+	defer func() {
+
+		if r := recover(); r != nil {
+
+			log.Errorf("Panic during %s: %v\n%s", what, r, debug.Stack())
+		}
+	}()
+
+	fn()
+}
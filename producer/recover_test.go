@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReleaseSessionLeavesLaterSession(t *testing.T) {
+
+	manager := newSessionManager()
+	first := &session{tokenKey: "alice", resources: []string{"red"}}
+	later := &session{tokenKey: "alice", resources: []string{"red"}}
+
+	if err := manager.acquire(first); err != nil {
+
+		t.Fatalf("acquire: %s", err.Error())
+	}
+
+	if !manager.releaseSession(first) {
+
+		t.Fatal("the session was not released")
+	}
+
+	if err := manager.acquire(later); err != nil {
+
+		t.Fatalf("acquire after release: %s", err.Error())
+	}
+
+	if manager.releaseSession(first) {
+
+		t.Error("released twice")
+	}
+
+	if sessions := manager.list(); len(sessions) != 1 || sessions[0].ended != later.ended {
+
+		t.Errorf("sessions: got %+v, want the later session", sessions)
+	}
+}
+
+func TestPanicLeavesOtherSessionOnToken(t *testing.T) {
+
+	handler := &Handler{sessions: newSessionManager()}
+	running := &session{tokenKey: "alice", resources: []string{"red"}}
+
+	if err := handler.sessions.acquire(running); err != nil {
+
+		t.Fatalf("acquire: %s", err.Error())
+	}
+
+	// A second BeginServiceDelivery on the token, panicking before it acquires a session of its own
+	func() {
+
+		defer handler.recoverCallback("BeginServiceDelivery", 1, "alice")
+
+		panic("before acquire")
+	}()
+
+	if len(handler.sessions.list()) != 1 {
+
+		t.Error("the running session was released by another callback's panic")
+	}
+
+	if handler.panics != 1 {
+
+		t.Errorf("panics: got %d, want 1", handler.panics)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errRefundUnsupported is returned by refunders which cannot pay refunds back, leaving them to be paid by hand
+var errRefundUnsupported = errors.New("refunds are not supported by the payment service provider")
+
+// refunder pays a refund back to the consumer through the payment service provider
+type refunder interface {
+	refund(entry ledgerEntry) error
+}
+
+// unsupportedRefunder is used while the PSP has no refund path. Refunds stay outstanding.
+type unsupportedRefunder struct{}
+
+func (unsupportedRefunder) refund(entry ledgerEntry) error {
+
+	return errRefundUnsupported
+}
+
+// sweepRefunds creates a refund for the unused units of each expired token that asked for a refund on
+// expiry, and for each paid quote whose token was never presented, then tries to pay every outstanding
+// refund. Tokens still delivering are left until they finish.
+func (handler *Handler) sweepRefunds(now time.Time) error {
+
+	delivering := make(map[string]bool, 0)
+
+	for _, s := range handler.sessions.list() {
+
+		delivering[s.tokenKey] = true
+	}
+
+	for _, token := range handler.tokens.dueForRefund(now, delivering) {
+
+		units := token.remaining()
+
+		entry := ledgerEntry{
+			Time:           now,
+			Type:           ledgerRefundPending,
+			TokenKey:       token.Key,
+			ServiceID:      token.ServiceID,
+			PriceID:        token.PriceID,
+			UnitsPaid:      token.UnitsPaid,
+			UnitsDelivered: token.UnitsDelivered,
+			Amount:         token.value(units),
+			Currency:       token.Currency,
+			Reason:         fmt.Sprintf("token expired with %d of %d units unused", units, token.UnitsPaid),
+		}
+
+		// Recorded on the token first, so a failure cannot create the refund twice
+		if err := handler.tokens.refundCreated(token.Key, units, now); err != nil {
+
+			return err
+		}
+
+		if err := handler.ledger.append(entry); err != nil {
+
+			if undo := handler.tokens.refundCreated(token.Key, 0, time.Time{}); undo != nil {
+
+				log.WithField("token", token.Key).Errorf("Failed to undo refund: %s", undo.Error())
+			}
+
+			return err
+		}
+
+		fmt.Printf("Refund of %d %s created for expired token %s (%s)\n", entry.Amount, entry.Currency, token.Key, entry.Reason)
+		log.WithFields(log.Fields{"token": token.Key, "amount": entry.Amount, "currency": entry.Currency}).Info("Refund created")
+	}
+
+	for _, q := range handler.tokens.unclaimed(now) {
+
+		entry := ledgerEntry{
+			Time:      now,
+			Type:      ledgerRefundPending,
+			ServiceID: q.ServiceID,
+			PriceID:   q.PriceID,
+			UnitsPaid: q.Units,
+			Amount:    q.Total,
+			Currency:  q.Currency,
+			Reference: q.Reference,
+			Reason:    fmt.Sprintf("no delivery token presented within %s of payment", unclaimedLifetime),
+		}
+
+		removed, err := handler.tokens.removeQuote(q.Reference)
+
+		if err != nil {
+
+			return err
+		}
+
+		if err := handler.ledger.append(entry); err != nil {
+
+			if undo := handler.tokens.restoreQuote(removed); undo != nil {
+
+				log.WithField("reference", q.Reference).Errorf("Failed to undo refund: %s", undo.Error())
+			}
+
+			return err
+		}
+
+		fmt.Printf("Refund of %d %s created for payment %s (%s)\n", entry.Amount, entry.Currency, q.Reference, entry.Reason)
+		log.WithFields(log.Fields{"reference": q.Reference, "amount": entry.Amount, "currency": entry.Currency}).Info("Refund created")
+	}
+
+	outstanding, err := handler.outstandingRefunds()
+
+	if err != nil {
+
+		return err
+	}
+
+	for _, entry := range outstanding {
+
+		err := handler.refunder.refund(entry)
+
+		if err == errRefundUnsupported {
+
+			continue
+		} else if err != nil {
+
+			log.WithFields(log.Fields{"token": entry.TokenKey, "reference": entry.Reference}).Errorf("Refund failed, will retry: %s", err.Error())
+			continue
+		}
+
+		refunded := entry
+		refunded.Time = time.Now()
+		refunded.Type = ledgerRefunded
+
+		if err := handler.ledger.append(refunded); err != nil {
+
+			return err
+		}
+
+		fmt.Printf("Refunded %d %s for %s\n", entry.Amount, entry.Currency, refundKey(entry))
+	}
+
+	return nil
+}
+
+// refundKey names who a refund is owed to: the token, or the payment reference when no token claimed it
+func refundKey(entry ledgerEntry) string {
+
+	if entry.TokenKey != "" {
+
+		return "token " + entry.TokenKey
+	}
+
+	return "payment " + entry.Reference
+}
+
+// outstandingRefunds returns the refunds owed, refund-due and refund-pending, which have not been paid
+// back, oldest first. A token can be owed several refunds, and each refunded entry pays the oldest.
+func (handler *Handler) outstandingRefunds() ([]ledgerEntry, error) {
+
+	entries, err := handler.ledger.entries()
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	refunded := make(map[string]int, 0)
+
+	for _, entry := range entries {
+
+		if entry.Type == ledgerRefunded {
+
+			refunded[refundKey(entry)]++
+		}
+	}
+
+	outstanding := make([]ledgerEntry, 0)
+
+	for _, entry := range entries {
+
+		// Nothing is owed back for free units
+		if (entry.Type != ledgerRefundDue && entry.Type != ledgerRefundPending) || entry.Amount <= 0 {
+
+			continue
+		}
+
+		if key := refundKey(entry); refunded[key] > 0 {
+
+			refunded[key]--
+			continue
+		}
+
+		outstanding = append(outstanding, entry)
+	}
+
+	return outstanding, nil
+}
+
+// runRefundSweeper sweeps for refunds every interval, for as long as the producer runs. An interval of 0
+// or less turns the sweeper off, leaving refunds to be created and paid by hand.
+func (handler *Handler) runRefundSweeper(interval time.Duration) {
+
+	if interval <= 0 {
+
+		return
+	}
+
+	for {
+
+		safely("refund sweep", func() {
+
+			if err := handler.sweepRefunds(time.Now()); err != nil {
+
+				fmt.Printf("Refund sweep failed: %s\n", err.Error())
+				log.Errorf("Refund sweep failed: %s", err.Error())
+			}
+		})
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// mockRefunder records the refunds paid, failing while down and for the refund named by failing
+type mockRefunder struct {
+	down     bool
+	failing  string // refundKey of a refund the PSP rejects
+	refunded []ledgerEntry
+}
+
+func (m *mockRefunder) refund(entry ledgerEntry) error {
+
+	if m.down {
+
+		return errors.New("PSP down")
+	}
+
+	if m.failing != "" && refundKey(entry) == m.failing {
+
+		return errors.New("refund rejected")
+	}
+
+	m.refunded = append(m.refunded, entry)
+
+	return nil
+}
+
+func newRefundHandler(t *testing.T, registry *tokenRegistry, m *mockRefunder) *Handler {
+
+	return &Handler{
+		tokens:   registry,
+		ledger:   newLedger(filepath.Join(t.TempDir(), "ledger.jsonl")),
+		sessions: newSessionManager(),
+		refunder: m,
+	}
+}
+
+func sweep(t *testing.T, handler *Handler, now time.Time) {
+
+	if err := handler.sweepRefunds(now); err != nil {
+
+		t.Fatalf("sweepRefunds: %s", err.Error())
+	}
+}
+
+func TestRefundExpiredToken(t *testing.T) {
+
+	registry := newRegistry(t)
+	now := time.Now()
+
+	quote(t, registry, "a", "alice", now)
+	pay(t, registry, "a", "alice", now)
+
+	token := deliveryToken("alice", now)
+	token.RefundOnExpiry = true
+
+	if _, err := registry.claim(token, 1, 1, 4, now); err != nil {
+
+		t.Fatalf("claim: %s", err.Error())
+	}
+
+	m := &mockRefunder{down: true}
+	handler := newRefundHandler(t, registry, m)
+
+	sweep(t, handler, now)
+
+	if outstanding, _ := handler.outstandingRefunds(); len(outstanding) != 0 {
+
+		t.Fatalf("refund created before the token expired: %+v", outstanding)
+	}
+
+	// Swept twice while the PSP is down, the refund is created once and stays outstanding
+	sweep(t, handler, now.Add(2*time.Hour))
+	sweep(t, handler, now.Add(3*time.Hour))
+
+	outstanding, _ := handler.outstandingRefunds()
+
+	if len(outstanding) != 1 || outstanding[0].Amount != 30 {
+
+		t.Fatalf("outstanding: got %+v, want one refund of 30 for 6 unused units", outstanding)
+	}
+
+	m.down = false
+	sweep(t, handler, now.Add(4*time.Hour))
+	sweep(t, handler, now.Add(5*time.Hour))
+
+	if len(m.refunded) != 1 || m.refunded[0].Amount != 30 {
+
+		t.Errorf("refunded: got %+v, want one refund of 30", m.refunded)
+	}
+
+	if outstanding, _ := handler.outstandingRefunds(); len(outstanding) != 0 {
+
+		t.Errorf("still outstanding after refunding: %+v", outstanding)
+	}
+}
+
+func TestRefundAtExpiry(t *testing.T) {
+
+	now := time.Now()
+	expiry := now.Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		at         time.Time
+		delivering bool
+		refunded   bool
+	}{
+		{"before expiry", expiry.Add(-time.Nanosecond), false, false},
+		{"at expiry", expiry, false, true},
+		{"after expiry", expiry.Add(time.Nanosecond), false, true},
+		{"delivering at expiry", expiry, true, false},
+	}
+
+	for _, test := range tests {
+
+		registry := newRegistry(t)
+		quote(t, registry, "a", "alice", now)
+		pay(t, registry, "a", "alice", now)
+
+		token := deliveryToken("alice", now)
+		token.RefundOnExpiry = true
+
+		if _, err := registry.claim(token, 1, 1, 4, now); err != nil {
+
+			t.Fatalf("%s: claim: %s", test.name, err.Error())
+		}
+
+		m := &mockRefunder{}
+		handler := newRefundHandler(t, registry, m)
+
+		if test.delivering {
+
+			handler.sessions.acquire(&session{tokenKey: "alice"})
+		}
+
+		sweep(t, handler, test.at)
+
+		if refunded := len(m.refunded) == 1; refunded != test.refunded {
+
+			t.Errorf("%s: got refunds %+v, want refunded %t", test.name, m.refunded, test.refunded)
+		}
+	}
+}
+
+func TestRefundFailsPartWay(t *testing.T) {
+
+	m := &mockRefunder{failing: "token bob"}
+	handler := newRefundHandler(t, newRegistry(t), m)
+	now := time.Now()
+
+	for _, key := range []string{"alice", "bob", "carol"} {
+
+		handler.ledger.append(ledgerEntry{Time: now, Type: ledgerRefundDue, TokenKey: key, Amount: 10, Currency: "GBP"})
+	}
+
+	// The refunds either side of the rejected one are still paid
+	sweep(t, handler, now)
+
+	if len(m.refunded) != 2 || m.refunded[0].TokenKey != "alice" || m.refunded[1].TokenKey != "carol" {
+
+		t.Fatalf("refunded: got %+v, want alice and carol", m.refunded)
+	}
+
+	if outstanding, _ := handler.outstandingRefunds(); len(outstanding) != 1 || outstanding[0].TokenKey != "bob" {
+
+		t.Fatalf("outstanding: got %+v, want bob's refund", outstanding)
+	}
+
+	// Retried on the next sweep, and nothing is paid twice
+	m.failing = ""
+	sweep(t, handler, now.Add(time.Minute))
+	sweep(t, handler, now.Add(2*time.Minute))
+
+	if len(m.refunded) != 3 || m.refunded[2].TokenKey != "bob" {
+
+		t.Errorf("refunded: got %+v, want bob's refund paid once more", m.refunded)
+	}
+}
+
+func TestNoRefundForUsedToken(t *testing.T) {
+
+	registry := newRegistry(t)
+	now := time.Now()
+
+	quote(t, registry, "a", "alice", now)
+	pay(t, registry, "a", "alice", now)
+
+	token := deliveryToken("alice", now)
+	token.RefundOnExpiry = true
+	registry.claim(token, 1, 1, 10, now)
+
+	m := &mockRefunder{}
+	sweep(t, newRefundHandler(t, registry, m), now.Add(2*time.Hour))
+
+	if len(m.refunded) != 0 {
+
+		t.Errorf("refunded a token with every unit used: %+v", m.refunded)
+	}
+}
+
+func TestRefundUnclaimedPayment(t *testing.T) {
+
+	registry := newRegistry(t)
+	now := time.Now()
+
+	quote(t, registry, "a", "alice", now)
+	pay(t, registry, "a", "alice", now)
+
+	// A refused quote paid for is owed back when paid, not by the sweep
+	registry.quoted(1, types.TotalPriceResponse{PaymentReferenceID: "r", ClientID: "rita", PriceID: 1, UnitsToSupply: 10, TotalPrice: 50, CurrencyCode: "GBP"}, "closed", now)
+	pay(t, registry, "r", "rita", now)
+
+	m := &mockRefunder{}
+	handler := newRefundHandler(t, registry, m)
+
+	sweep(t, handler, now.Add(unclaimedLifetime-time.Minute))
+
+	if len(m.refunded) != 0 {
+
+		t.Fatalf("refunded a payment before its token could be presented: %+v", m.refunded)
+	}
+
+	sweep(t, handler, now.Add(unclaimedLifetime))
+	sweep(t, handler, now.Add(unclaimedLifetime+time.Hour))
+
+	if len(m.refunded) != 1 || m.refunded[0].Reference != "a" || m.refunded[0].Amount != 50 {
+
+		t.Errorf("refunded: got %+v, want payment a refunded once", m.refunded)
+	}
+
+	if _, ok := registry.quote("a"); ok {
+
+		t.Error("the refunded quote can still be claimed")
+	}
+}
+
+func TestRefundsOwed(t *testing.T) {
+
+	m := &mockRefunder{}
+	handler := newRefundHandler(t, newRegistry(t), m)
+	now := time.Now()
+
+	entries := []ledgerEntry{
+		{Time: now, Type: ledgerRefundDue, TokenKey: "alice", Amount: 10, Currency: "GBP"},
+		{Time: now, Type: ledgerRefundDue, TokenKey: "alice", Amount: 20, Currency: "GBP"},
+		{Time: now, Type: ledgerRefunded, TokenKey: "alice", Amount: 10, Currency: "GBP"},
+		{Time: now, Type: ledgerRefundDue, TokenKey: "demo", Amount: 0},
+		{Time: now, Type: ledgerRefundDue, Reference: "b", Amount: 50, Currency: "GBP"},
+		{Time: now, Type: ledgerDelivery, TokenKey: "bob", Amount: 50, Currency: "GBP"},
+	}
+
+	for _, entry := range entries {
+
+		handler.ledger.append(entry)
+	}
+
+	outstanding, err := handler.outstandingRefunds()
+
+	if err != nil {
+
+		t.Fatalf("outstandingRefunds: %s", err.Error())
+	}
+
+	if len(outstanding) != 2 || outstanding[0].Amount != 20 || outstanding[1].Reference != "b" {
+
+		t.Fatalf("outstanding: got %+v, want alice's second refund and payment b", outstanding)
+	}
+
+	sweep(t, handler, now)
+
+	if len(m.refunded) != 2 {
+
+		t.Errorf("refunded: got %+v, want both", m.refunded)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// reloadResult lists the service IDs changed by a catalog reload
+type reloadResult struct {
+	Added   []int `json:"added"`
+	Removed []int `json:"removed"`
+	Updated []int `json:"updated"`
+}
+
+// reloadMu serialises reloads, which can be triggered by the file watcher, SIGHUP and the admin API at once
+var reloadMu sync.Mutex
+
+// reloadCatalog reads the catalog file again and applies it to the running producer. Services and prices
+// are added, removed and updated in place, so the broadcast carries on. Active deliveries are left alone
+// and finish with the settings they started with. Everything is built and checked before anything is
+// changed, and a failure part way through updating the SDK is rolled back, so a failed reload leaves the
+// current catalog in place.
+func reloadCatalog(path string, reason string) (*reloadResult, error) {
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fmt.Printf("Reloading catalog %s (%s)\n", path, reason)
+
+	c, err := loadCatalog(path)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	if err := pricing.expandVolumeTiers(c); err != nil {
+
+		return nil, err
+	}
+
+	plugins, err := wpwHandler.catalogPlugins(c)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	changes, err := planServices(serviceCatalog, c)
+
+	if err != nil {
+
+		return nil, err
+	}
+
+	if err := changes.apply(); err != nil {
+
+		return nil, err
+	}
+
+	wpwHandler.setCatalog(c, plugins)
+	serviceCatalog = c
+	wpwHandler.refreshAvailability()
+	wpwHandler.repriceAll()
+
+	result := changes.result()
+
+	fmt.Printf("Catalog reloaded: added %v, removed %v, updated %v\n", result.Added, result.Removed, result.Updated)
+	log.WithFields(log.Fields{"added": result.Added, "removed": result.Removed, "updated": result.Updated, "reason": reason}).Info("Catalog reloaded")
+
+	return result, nil
+}
+
+// serviceUpdate is a new name, description and prices for a service the SDK already offers
+type serviceUpdate struct {
+	svc         *types.Service
+	name        string
+	description string
+	prices      map[int]types.Price
+}
+
+// serviceChanges are the changes to the SDK's services needed to offer a new catalog
+type serviceChanges struct {
+	add    []*types.Service
+	remove []*types.Service
+	update []serviceUpdate
+}
+
+// planServices builds every service the new catalog changes, without touching the SDK
+func planServices(old *catalog, c *catalog) (*serviceChanges, error) {
+
+	sdkMu.RLock()
+	defer sdkMu.RUnlock()
+
+	changes := &serviceChanges{}
+	offered := wpw.GetDevice().Services
+
+	var removed []int
+
+	for id := range offered {
+
+		// Services of faulty outputs stay out of the broadcast until the fault is cleared
+		if svc := c.service(id); svc == nil || wpwHandler.faults.affects(svc) != "" {
+
+			removed = append(removed, id)
+		}
+	}
+
+	sort.Ints(removed)
+
+	for _, id := range removed {
+
+		changes.remove = append(changes.remove, offered[id])
+	}
+
+	for _, catalogSvc := range c.Services {
+
+		svc, err := newService(c, catalogSvc)
+
+		if err != nil {
+
+			return nil, fmt.Errorf("new service %d: %s", catalogSvc.ID, err.Error())
+		}
+
+		existing, ok := offered[catalogSvc.ID]
+
+		if !ok {
+
+			if wpwHandler.faults.affects(&catalogSvc) == "" {
+
+				changes.add = append(changes.add, svc)
+			}
+
+			continue
+		}
+
+		if wpwHandler.faults.affects(&catalogSvc) != "" {
+
+			continue
+		}
+
+		if reflect.DeepEqual(old.service(catalogSvc.ID), &catalogSvc) && reflect.DeepEqual(unitsOf(old, catalogSvc), unitsOf(c, catalogSvc)) {
+
+			continue
+		}
+
+		changes.update = append(changes.update, serviceUpdate{svc: existing, name: svc.Name, description: svc.Description, prices: svc.Prices})
+	}
+
+	return changes, nil
+}
+
+// apply makes the changes to the SDK's services. If the SDK refuses one, those already made are undone.
+// Updated services are changed in place, as the SDK holds them by pointer, by replacing whole values.
+func (changes *serviceChanges) apply() error {
+
+	sdkMu.Lock()
+	defer sdkMu.Unlock()
+
+	var removed, added []*types.Service
+	var err error
+
+	for _, svc := range changes.remove {
+
+		if err = wpw.RemoveService(svc); err != nil {
+
+			err = fmt.Errorf("remove service %d: %s", svc.ID, err.Error())
+			break
+		}
+
+		removed = append(removed, svc)
+	}
+
+	for i := 0; err == nil && i < len(changes.add); i++ {
+
+		if err = wpw.AddService(changes.add[i]); err != nil {
+
+			err = fmt.Errorf("add service %d: %s", changes.add[i].ID, err.Error())
+			break
+		}
+
+		added = append(added, changes.add[i])
+	}
+
+	if err != nil {
+
+		undoServices(removed, added)
+		return err
+	}
+
+	for _, update := range changes.update {
+
+		update.svc.Name = update.name
+		update.svc.Description = update.description
+		update.svc.Prices = update.prices
+	}
+
+	return nil
+}
+
+// undoServices puts back services removed and takes out services added by a failed reload
+func undoServices(removed []*types.Service, added []*types.Service) {
+
+	for _, svc := range added {
+
+		if err := wpw.RemoveService(svc); err != nil {
+
+			log.WithField("serviceID", svc.ID).Errorf("Failed to roll back adding service: %s", err.Error())
+		}
+	}
+
+	for _, svc := range removed {
+
+		if err := wpw.AddService(svc); err != nil {
+
+			log.WithField("serviceID", svc.ID).Errorf("Failed to roll back removing service: %s", err.Error())
+		}
+	}
+}
+
+// result lists the service IDs changed, for the admin API and the log
+func (changes *serviceChanges) result() *reloadResult {
+
+	result := &reloadResult{}
+
+	for _, svc := range changes.add {
+
+		result.Added = append(result.Added, svc.ID)
+	}
+
+	for _, svc := range changes.remove {
+
+		result.Removed = append(result.Removed, svc.ID)
+	}
+
+	for _, update := range changes.update {
+
+		result.Updated = append(result.Updated, update.svc.ID)
+	}
+
+	return result
+}
+
+// unitsOf returns the units used by a service's prices, so a changed unit counts as a changed service
+func unitsOf(c *catalog, catalogSvc catalogService) []catalogUnit {
+
+	var units []catalogUnit
+
+	for _, price := range catalogSvc.Prices {
+
+		if unit := c.unit(price.UnitID); unit != nil {
+
+			units = append(units, *unit)
+		}
+	}
+
+	return units
+}
+
+// catalogPlugins builds the plugins for a reloaded catalog. A service keeps its plugin when its delivery
+// settings are unchanged; otherwise a new plugin is built, which is refused while the service is delivering.
+func (handler *Handler) catalogPlugins(c *catalog) (map[int]deliveryPlugin, error) {
+
+	old, oldPlugins := handler.current()
+
+	if !reflect.DeepEqual(old.Outputs, c.Outputs) {
+
+		return nil, errors.New("outputs cannot be changed without restarting the producer")
+	}
+
+	if !reflect.DeepEqual(old.Inputs, c.Inputs) {
+
+		return nil, errors.New("inputs cannot be changed without restarting the producer")
+	}
+
+	delivering := make(map[int]bool, 0)
+
+	for _, s := range handler.sessions.list() {
+
+		delivering[s.serviceID] = true
+	}
+
+	env := &pluginEnv{outputs: handler.outputs, gpioEnabled: handler.rpioenabled}
+	plugins := make(map[int]deliveryPlugin, 0)
+
+	for i := range c.Services {
+
+		svc := &c.Services[i]
+		oldSvc := old.service(svc.ID)
+
+		if oldSvc != nil && samePlugin(oldSvc, svc) {
+
+			plugins[svc.ID] = oldPlugins[svc.ID]
+			continue
+		}
+
+		if oldSvc != nil && delivering[svc.ID] {
+
+			return nil, fmt.Errorf("service %d is delivering, its plugin settings cannot change until delivery ends", svc.ID)
+		}
+
+		plugin, err := newPlugin(env, svc)
+
+		if err != nil {
+
+			return nil, err
+		}
+
+		plugins[svc.ID] = plugin
+	}
+
+	return plugins, nil
+}
+
+// setCatalog switches the handler to a reloaded catalog and its plugins
+func (handler *Handler) setCatalog(c *catalog, plugins map[int]deliveryPlugin) {
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+
+	handler.catalog = c
+	handler.plugins = plugins
+}
+
+// samePlugin reports whether two versions of a service are delivered in the same way
+func samePlugin(a *catalogService, b *catalogService) bool {
+
+	return a.pluginName() == b.pluginName() &&
+		bytes.Equal(bytes.TrimSpace(a.Config), bytes.TrimSpace(b.Config)) &&
+		reflect.DeepEqual(a.outputNames(), b.outputNames())
+}
+
+// watchCatalog reloads the catalog when the file changes or the producer receives SIGHUP
+func watchCatalog(path string, interval time.Duration) {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	var modified time.Time
+
+	if info, err := os.Stat(path); err == nil {
+
+		modified = info.ModTime()
+	}
+
+	var tick <-chan time.Time
+
+	if interval > 0 {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+
+		reason := "SIGHUP"
+
+		select {
+		case <-hangup:
+		case <-tick:
+			info, err := os.Stat(path)
+
+			if err != nil || !info.ModTime().After(modified) {
+
+				continue
+			}
+
+			// Only try each change once, a broken file is reported and left until it changes again
+			modified = info.ModTime()
+			reason = "file changed"
+		}
+
+		if _, err := reloadCatalog(path, reason); err != nil {
+
+			fmt.Printf("Catalog reload failed, keeping the current catalog: %s\n", err.Error())
+			log.WithField("reason", reason).Errorf("Catalog reload failed: %s", err.Error())
+		}
+	}
+}
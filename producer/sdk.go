@@ -0,0 +1,31 @@
+package main
+
+import "sync"
+
+// The Worldpay Within SDK keeps the *types.Service values given to AddService and reads them, and
+// their price maps, from its own goroutines when consumers ask for services, prices and quotes. It
+// takes no lock to do so. Event handlers such as ServicePricesEvent and ServiceTotalPriceEvent are
+// told about a request, but nothing says whether the SDK has already answered it or waits for them.
+//
+// So the producer:
+//   - never writes into a price map or PricePerUnit the SDK may be reading. A change builds new
+//     values and assigns them to the service in one statement, e.g. a whole new Prices map.
+//   - holds sdkMu for writing while it changes an offered service, and for reading while it looks
+//     one up. The SDK's own reads cannot take the lock, so these assignments are still unsynchronised
+//     with the SDK; they are kept to whole values so that the SDK sees the old or new one.
+//   - changes prices ahead of consumers asking, never in an event handler, since the SDK may already
+//     have quoted from the old ones. See repriceAll.
+//   - never changes a quote in an event handler. What the SDK quotes is what is paid, the token
+//     registry records it, and refunds are worked out from what was paid.
+var sdkMu sync.RWMutex
+
+// The SDK's services and prices have no field for anything but their names, descriptions and amounts.
+// What consumers need to know before asking for a quote is added to the end of a description as a
+// marker, and the consumer (consumer/markers.go) strips and reads it:
+//   - "Turn on the red LED [unavailable: closed, open 08:00-18:00]" on a service which cannot be bought
+//     right now, see refreshAvailability
+//   - "Turn on the red LED [units: 1-600]" or "[units: 5+]" on a price with purchase limits, see unitLimits
+const (
+	unavailableMarker = " [unavailable: "
+	unitsMarker       = " [units: "
+)
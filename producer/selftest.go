@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stianeikeland/go-rpio"
+)
+
+// errNoOperator is returned by prompt at the end of input, when nobody is left to answer
+var errNoOperator = errors.New("end of input, no operator to answer")
+
+// calibrationLevels are the brightness steps shown when calibrating, so dimmed levels can be checked by eye
+var calibrationLevels = []int{25, 50, 75, 100}
+
+// pinReader is an output whose pin level can be read back, to check the pin actually changes
+type pinReader interface {
+	read() bool
+}
+
+// read returns whether the pin is high
+func (output *ledOutput) read() bool {
+
+	return output.pin.Read() == rpio.High
+}
+
+// read returns whether the simulated output is on
+func (output *simOutput) read() bool {
+
+	return output.current() > 0
+}
+
+// selfTestResult is what was found for one output
+type selfTestResult struct {
+	output   catalogOutput
+	seen     bool     // The operator saw the output light
+	problems []string // Pin readback failures and the operator's answers
+}
+
+// outputsSelfTest lights each output in turn, asking the operator whether it lit, and with -readback
+// checks the pin went high and back low. Any output which failed is reported and the exit status is 1.
+// Without an operator to answer, at the end of input, the self-test is aborted with every output off.
+func outputsSelfTest(args []string) {
+
+	c, err := loadCatalog(flagCatalog)
+	errCheck(err, "loadCatalog()")
+
+	outputs, rpioenabled, err := openOutputs(c, flagIgnoreGPIO)
+	errCheck(err, "open outputs")
+
+	if !rpioenabled {
+
+		fmt.Println("GPIO is not available, testing simulated outputs")
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	var failed []selfTestResult
+
+	for _, config := range c.Outputs {
+
+		result, err := selfTestOutput(in, config, outputs[config.Name])
+
+		if err != nil {
+
+			for _, out := range outputs {
+
+				out.off()
+			}
+
+			fmt.Printf("\nSelf-test aborted at %s: %s\n", config.Name, err.Error())
+			os.Exit(1)
+		}
+
+		if len(result.problems) > 0 {
+
+			failed = append(failed, result)
+		}
+	}
+
+	fmt.Println()
+
+	if len(failed) == 0 {
+
+		fmt.Printf("All %d outputs passed\n", len(c.Outputs))
+		return
+	}
+
+	fmt.Printf("%d of %d outputs failed:\n", len(failed), len(c.Outputs))
+
+	for _, result := range failed {
+
+		fmt.Printf("\t%s (GPIO %d): %s\n", result.output.Name, result.output.Pin, strings.Join(result.problems, "; "))
+	}
+
+	os.Exit(1)
+}
+
+func selfTestOutput(in *bufio.Reader, config catalogOutput, out output) (selfTestResult, error) {
+
+	result := selfTestResult{output: config}
+	reader, canRead := out.(pinReader)
+	readback := flagReadback && canRead
+
+	fmt.Printf("\n%s on GPIO %d. Press Enter to light it.", out.label(), config.Pin)
+
+	if _, err := prompt(in); err != nil {
+
+		return result, err
+	}
+
+	if readback && reader.read() {
+
+		result.problems = append(result.problems, "pin was already high before it was lit")
+	}
+
+	out.on(100)
+
+	// Give the pin time to settle before reading it
+	time.Sleep(10 * time.Millisecond)
+
+	if readback && !reader.read() {
+
+		result.problems = append(result.problems, "pin did not go high when lit")
+	}
+
+	fmt.Printf("Is %s lit? [Y/n] ", out.label())
+	answer, err := prompt(in)
+
+	if err != nil {
+
+		out.off()
+		return result, err
+	}
+
+	result.seen = yes(answer)
+
+	if !result.seen {
+
+		result.problems = append(result.problems, "not seen to light")
+	}
+
+	if flagCalibrate && result.seen {
+
+		for _, level := range calibrationLevels {
+
+			out.on(level)
+			fmt.Printf("%s at %d%% brightness. Press Enter for the next level.", out.label(), level)
+
+			if _, err := prompt(in); err != nil {
+
+				out.off()
+				return result, err
+			}
+		}
+	}
+
+	out.off()
+	time.Sleep(10 * time.Millisecond)
+
+	if readback && reader.read() {
+
+		result.problems = append(result.problems, "pin did not go low when turned off")
+	}
+
+	if len(result.problems) == 0 {
+
+		fmt.Printf("%s passed\n", out.label())
+	} else {
+
+		fmt.Printf("%s FAILED: %s\n", out.label(), strings.Join(result.problems, "; "))
+	}
+
+	return result, nil
+}
+
+// prompt reads a line from the operator. A last line without a newline is still an answer, but the end
+// of input is errNoOperator rather than Enter, so an unanswered question never passes an output.
+func prompt(in *bufio.Reader) (string, error) {
+
+	line, err := in.ReadString('\n')
+
+	if err == io.EOF && line == "" {
+
+		fmt.Println()
+		return "", errNoOperator
+	} else if err != nil && err != io.EOF {
+
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+func yes(answer string) bool {
+
+	return answer == "" || strings.HasPrefix(strings.ToLower(answer), "y")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestPrompt(t *testing.T) {
+
+	tests := []struct {
+		input   string
+		answers []string
+	}{
+		{"y\n", []string{"y"}},
+		{" n \n", []string{"n"}},
+		{"n", []string{"n"}}, // The last line need not end with a newline
+		{"\n", []string{""}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+
+		in := bufio.NewReader(strings.NewReader(test.input))
+
+		for _, want := range test.answers {
+
+			if got, err := prompt(in); err != nil || got != want {
+
+				t.Errorf("%q: got %q %v, want %q", test.input, got, err, want)
+			}
+		}
+
+		if _, err := prompt(in); err != errNoOperator {
+
+			t.Errorf("%q: at the end of input got %v, want errNoOperator", test.input, err)
+		}
+	}
+}
+
+func TestSelfTestWithoutOperator(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"no input", ""},
+		{"lit, then no answer", "\n"},
+	}
+
+	for _, test := range tests {
+
+		out := newSimOutput("red")
+		in := bufio.NewReader(strings.NewReader(test.input))
+
+		result, err := selfTestOutput(in, catalogOutput{Name: "red"}, out)
+
+		if err != errNoOperator {
+
+			t.Errorf("%s: got %+v %v, want errNoOperator", test.name, result, err)
+		}
+
+		if result.seen {
+
+			t.Errorf("%s: output passed without an answer", test.name)
+		}
+
+		if out.current() != 0 {
+
+			t.Errorf("%s: output left on", test.name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// session is an active delivery. It holds its resources (outputs, relay pins, commands) exclusively.
+type session struct {
+	tokenKey  string
+	serviceID int
+	priceID   int
+	units     int
+	resources []string
+	plugin    deliveryPlugin // Delivers the session, even if the catalog is reloaded before it ends
+	unit      catalogUnit
+	price     catalogPrice
+	token     registeredToken // As claimed, for what the consumer paid per unit
+	started   time.Time
+	duration  time.Duration // Paid time, or for count units the most time allowed
+	state     interface{}   // Owned by the delivery plugin
+	ended     chan struct{} // Closed when the session is released, however it ends
+}
+
+// delivered returns the units delivered by the end of the session. Count units are reported by the
+// plugin; time units are worked out from how long the session ran, to the nearest unit.
+func (s *session) delivered(plugin deliveryPlugin, ended time.Time) int {
+
+	if s.unit.isCount() {
+
+		if metered, ok := plugin.(meteredPlugin); ok {
+
+			return metered.consumed(s)
+		}
+
+		return 0
+	}
+
+	unitLength := time.Duration(s.unit.Seconds) * time.Second
+	units := int((ended.Sub(s.started) + unitLength/2) / unitLength)
+
+	if units > s.units {
+
+		return s.units
+	}
+
+	return units
+}
+
+// sessionManager tracks which resources are in use so that two deliveries never drive the same output
+type sessionManager struct {
+	mu         sync.Mutex
+	byResource map[string]*session
+	byToken    map[string]*session
+}
+
+func newSessionManager() *sessionManager {
+
+	return &sessionManager{
+		byResource: make(map[string]*session, 0),
+		byToken:    make(map[string]*session, 0),
+	}
+}
+
+// acquire reserves every resource the session needs, or none of them if any is already in use
+func (manager *sessionManager) acquire(s *session) error {
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if _, ok := manager.byToken[s.tokenKey]; ok {
+
+		return fmt.Errorf("token %s already has an active session", s.tokenKey)
+	}
+
+	var busy []string
+
+	for _, resource := range s.resources {
+
+		if active, ok := manager.byResource[resource]; ok {
+
+			busy = append(busy, fmt.Sprintf("%s (service %d, until %s)", resource, active.serviceID, active.started.Add(active.duration).Format(time.Kitchen)))
+		}
+	}
+
+	if len(busy) > 0 {
+
+		return fmt.Errorf("in use by another session: %s", strings.Join(busy, ", "))
+	}
+
+	for _, resource := range s.resources {
+
+		manager.byResource[resource] = s
+	}
+
+	manager.byToken[s.tokenKey] = s
+	s.ended = make(chan struct{})
+
+	return nil
+}
+
+// errSessionEnded is returned by start when the session was released before its delivery started
+var errSessionEnded = errors.New("session ended before delivery started")
+
+// start runs fn, the plugin's start, while holding the manager's lock. A release for the session
+// then either comes first, and the delivery is never started, or sees everything fn set up,
+// such as a pattern player, so that stopping the plugin turns it off.
+func (manager *sessionManager) start(s *session, fn func() error) error {
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.byToken[s.tokenKey] != s {
+
+		return errSessionEnded
+	}
+
+	return fn()
+}
+
+// release frees the resources held by the session for a token, returning the session or nil if there is none
+func (manager *sessionManager) release(tokenKey string) *session {
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	s, ok := manager.byToken[tokenKey]
+
+	if !ok {
+
+		return nil
+	}
+
+	manager.remove(s)
+
+	return s
+}
+
+// releaseSession frees the resources held by the session, returning false if it was already released.
+// Unlike release, it never frees a later session on the same token.
+func (manager *sessionManager) releaseSession(s *session) bool {
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.byToken[s.tokenKey] != s {
+
+		return false
+	}
+
+	manager.remove(s)
+
+	return true
+}
+
+// remove takes the session out of the manager, which must be locked
+func (manager *sessionManager) remove(s *session) {
+
+	delete(manager.byToken, s.tokenKey)
+
+	for _, resource := range s.resources {
+
+		if manager.byResource[resource] == s {
+
+			delete(manager.byResource, resource)
+		}
+	}
+
+	close(s.ended)
+}
+
+// list returns a snapshot of the active sessions, oldest first
+func (manager *sessionManager) list() []session {
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	sessions := make([]session, 0, len(manager.byToken))
+
+	for _, s := range manager.byToken {
+
+		sessions = append(sessions, *s)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+
+		return sessions[i].started.Before(sessions[j].started)
+	})
+
+	return sessions
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+// quoteLifetime is how long an unpaid quote is kept waiting for its payment
+const quoteLifetime = time.Hour
+
+// unclaimedLifetime is how long a paid quote waits for its token to be presented before it is refunded
+const unclaimedLifetime = 24 * time.Hour
+
+// paidQuote is a quote sent to a consumer, and whether it has been paid for. The SDK's payment event
+// names the quote by its payment reference and gives the delivery token issued for the payment, which
+// then claims the quote when it is first presented.
+type paidQuote struct {
+	Reference string    `json:"reference"`
+	ClientID  string    `json:"clientId"`
+	ServiceID int       `json:"serviceId"`
+	PriceID   int       `json:"priceId"`
+	Units     int       `json:"units"`
+	Total     int       `json:"total"`
+	Currency  string    `json:"currency"`
+	Quoted    time.Time `json:"quoted"`
+	Paid      time.Time `json:"paid,omitempty"`
+	Refused   string    `json:"refused,omitempty"`  // Why the quote cannot be bought, e.g. the service is closed
+	TokenKey  string    `json:"tokenKey,omitempty"` // The delivery token the SDK issued for the payment
+}
+
+// registeredToken is a delivery token the producer has accepted, with the units paid for and used
+type registeredToken struct {
+	Key            string    `json:"key"`
+	Reference      string    `json:"reference"`
+	ServiceID      int       `json:"serviceId"`
+	PriceID        int       `json:"priceId"`
+	UnitsPaid      int       `json:"unitsPaid"`
+	UnitsClaimed   int       `json:"unitsClaimed"`   // Units deliveries have been started for
+	UnitsDelivered int       `json:"unitsDelivered"` // Units actually delivered, once deliveries end
+	Total          int       `json:"total"`
+	Currency       string    `json:"currency"`
+	Issued         time.Time `json:"issued"`
+	Expiry         time.Time `json:"expiry"`
+	RefundOnExpiry bool      `json:"refundOnExpiry"`
+	LastUsed       time.Time `json:"lastUsed,omitempty"`
+	UnitsRefunded  int       `json:"unitsRefunded"`           // Unused units refunded when the token expired
+	RefundCreated  time.Time `json:"refundCreated,omitempty"` // Set once the token's expiry has been dealt with
+}
+
+func (token *registeredToken) remaining() int {
+
+	return token.UnitsPaid - token.UnitsClaimed - token.UnitsRefunded
+}
+
+// value returns what the consumer paid for units of the token, rounded down. Volume discounts and
+// repricing since the quote are already in the total, and free tokens are worth nothing. Worked out
+// exactly, as units times the total can overflow for large quotes.
+func (token *registeredToken) value(units int) int {
+
+	if token.UnitsPaid <= 0 {
+
+		return 0
+	}
+
+	value := new(big.Int).Mul(big.NewInt(int64(units)), big.NewInt(int64(token.Total)))
+
+	return int(value.Quo(value, big.NewInt(int64(token.UnitsPaid))).Int64())
+}
+
+func (token *registeredToken) expired(now time.Time) bool {
+
+	return !token.Expiry.IsZero() && !now.Before(token.Expiry)
+}
+
+// tokenRegistry is the JSON file of the quotes paid for and the delivery tokens presented, used to
+// refuse deliveries for expired, replayed or over-quantity tokens
+type tokenRegistry struct {
+	path   string
+	mu     sync.Mutex
+	Quotes []*paidQuote       `json:"quotes"` // Paid quotes not yet claimed by a token, and unpaid quotes
+	Tokens []*registeredToken `json:"tokens"`
+}
+
+func loadTokenRegistry(path string) (*tokenRegistry, error) {
+
+	registry := &tokenRegistry{path: path}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+
+		return registry, nil
+	} else if err != nil {
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, registry); err != nil {
+
+		return nil, fmt.Errorf("parse %s: %s", path, err.Error())
+	}
+
+	return registry, nil
+}
+
+func (registry *tokenRegistry) save() error {
+
+	data, err := json.MarshalIndent(registry, "", "\t")
+
+	if err != nil {
+
+		return err
+	}
+
+	tmp := registry.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+
+		return err
+	}
+
+	return os.Rename(tmp, registry.path)
+}
+
+// quoted records a quote sent to a consumer, and the reason it is refused if it cannot be bought,
+// dropping unpaid quotes that have gone stale
+func (registry *tokenRegistry) quoted(serviceID int, quote types.TotalPriceResponse, refused string, now time.Time) error {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	var quotes []*paidQuote
+
+	for _, q := range registry.Quotes {
+
+		if !q.Paid.IsZero() || now.Sub(q.Quoted) < quoteLifetime {
+
+			quotes = append(quotes, q)
+		}
+	}
+
+	registry.Quotes = append(quotes, &paidQuote{
+		Reference: quote.PaymentReferenceID,
+		ClientID:  quote.ClientID,
+		ServiceID: serviceID,
+		PriceID:   quote.PriceID,
+		Units:     quote.UnitsToSupply,
+		Total:     quote.TotalPrice,
+		Currency:  quote.CurrencyCode,
+		Quoted:    now,
+		Refused:   refused,
+	})
+
+	return registry.save()
+}
+
+// paid marks the quote whose payment reference is in the order description as paid for, by the delivery
+// token the SDK issued. The payment must be for the quote's amount, and a token can only pay for one quote.
+func (registry *tokenRegistry) paid(total int, currency string, orderDescription string, tokenKey string, now time.Time) (*paidQuote, error) {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if tokenKey == "" {
+
+		return nil, errors.New("payment names no delivery token")
+	}
+
+	if total < 0 {
+
+		return nil, fmt.Errorf("payment of %d %s is negative", total, currency)
+	}
+
+	if registry.find(tokenKey) != nil || registry.quotePaidBy(tokenKey) >= 0 {
+
+		return nil, fmt.Errorf("token %s has already paid for a quote", tokenKey)
+	}
+
+	var quote *paidQuote
+
+	for _, q := range registry.Quotes {
+
+		if names(orderDescription, q.Reference) {
+
+			quote = q
+			break
+		}
+	}
+
+	if quote == nil {
+
+		return nil, fmt.Errorf("no quote with a payment reference in %q", orderDescription)
+	}
+
+	if !quote.Paid.IsZero() {
+
+		return nil, fmt.Errorf("quote %s has already been paid for", quote.Reference)
+	}
+
+	if quote.Total != total || !strings.EqualFold(quote.Currency, currency) {
+
+		return nil, fmt.Errorf("payment of %d %s does not match quote %s for %d %s", total, currency, quote.Reference, quote.Total, quote.Currency)
+	}
+
+	quote.Paid, quote.TokenKey = now, tokenKey
+
+	if err := registry.save(); err != nil {
+
+		quote.Paid, quote.TokenKey = time.Time{}, ""
+		return nil, err
+	}
+
+	return quote, nil
+}
+
+// claim checks a token may deliver units of the service and price, and reserves them. A token seen for
+// the first time takes the quote it paid for, and is only registered if it is accepted. The reason a
+// token is refused is returned as the error.
+func (registry *tokenRegistry) claim(deliveryToken types.ServiceDeliveryToken, serviceID int, priceID int, units int, now time.Time) (*registeredToken, error) {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if deliveryToken.Key == "" {
+
+		return nil, errors.New("token has no key")
+	}
+
+	if units <= 0 {
+
+		return nil, fmt.Errorf("%d units requested", units)
+	}
+
+	token := registry.find(deliveryToken.Key)
+	quote := -1
+
+	if token == nil {
+
+		quote = registry.quotePaidBy(deliveryToken.Key)
+
+		if quote < 0 {
+
+			return nil, errors.New("no payment made with the token")
+		}
+
+		q := registry.Quotes[quote]
+
+		if q.Units <= 0 {
+
+			return nil, fmt.Errorf("quote %s paid for by the token is for %d units", q.Reference, q.Units)
+		}
+
+		if q.Refused != "" {
+
+			return nil, fmt.Errorf("quote %s paid for by the token was refused: %s", q.Reference, q.Refused)
+		}
+
+		token = &registeredToken{
+			Key:            deliveryToken.Key,
+			Reference:      q.Reference,
+			ServiceID:      q.ServiceID,
+			PriceID:        q.PriceID,
+			UnitsPaid:      q.Units,
+			Total:          q.Total,
+			Currency:       q.Currency,
+			Issued:         deliveryToken.Issued,
+			Expiry:         deliveryToken.Expiry,
+			RefundOnExpiry: deliveryToken.RefundOnExpiry,
+		}
+	}
+
+	if token.ServiceID != serviceID || token.PriceID != priceID {
+
+		return nil, fmt.Errorf("token was paid for service %d price %d, not service %d price %d", token.ServiceID, token.PriceID, serviceID, priceID)
+	}
+
+	if token.expired(now) {
+
+		return nil, fmt.Errorf("token expired at %s", token.Expiry.Format(time.RFC3339))
+	}
+
+	if token.remaining() <= 0 {
+
+		return nil, fmt.Errorf("token replayed, all %d paid units have already been used", token.UnitsPaid)
+	}
+
+	if units > token.remaining() {
+
+		return nil, fmt.Errorf("%d units requested but only %d of %d paid units remain", units, token.remaining(), token.UnitsPaid)
+	}
+
+	tokens, quotes := registry.Tokens, registry.Quotes
+
+	// The quote becomes the token, and neither is saved unless the token is accepted
+	if quote >= 0 {
+
+		registry.Tokens = append(registry.Tokens, token)
+		registry.Quotes = append(append([]*paidQuote(nil), quotes[:quote]...), quotes[quote+1:]...)
+	}
+
+	token.UnitsClaimed += units
+	token.LastUsed = now
+
+	if err := registry.save(); err != nil {
+
+		token.UnitsClaimed -= units
+		registry.Tokens, registry.Quotes = tokens, quotes
+		return nil, err
+	}
+
+	claimed := *token
+
+	return &claimed, nil
+}
+
+// grant registers a token for units given away free, e.g. by the demo button
+func (registry *tokenRegistry) grant(key string, serviceID int, priceID int, units int, now time.Time) error {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if registry.find(key) != nil {
+
+		return fmt.Errorf("token %s already registered", key)
+	}
+
+	registry.Tokens = append(registry.Tokens, &registeredToken{
+		Key:       key,
+		Reference: "free",
+		ServiceID: serviceID,
+		PriceID:   priceID,
+		UnitsPaid: units,
+		Issued:    now,
+	})
+
+	return registry.save()
+}
+
+// unclaim gives back units reserved for a delivery which did not start
+func (registry *tokenRegistry) unclaim(key string, units int) error {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	token := registry.find(key)
+
+	if token == nil {
+
+		return fmt.Errorf("unknown token %s", key)
+	}
+
+	token.UnitsClaimed -= units
+
+	return registry.save()
+}
+
+// delivered records the units a delivery actually delivered
+func (registry *tokenRegistry) delivered(key string, units int) error {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	token := registry.find(key)
+
+	if token == nil {
+
+		return fmt.Errorf("unknown token %s", key)
+	}
+
+	token.UnitsDelivered += units
+
+	return registry.save()
+}
+
+// dueForRefund returns copies of the expired tokens with unused units and a refund on expiry not yet
+// created, other than those still delivering
+func (registry *tokenRegistry) dueForRefund(now time.Time, delivering map[string]bool) []registeredToken {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	var due []registeredToken
+
+	for _, token := range registry.Tokens {
+
+		if !token.RefundOnExpiry || !token.expired(now) || !token.RefundCreated.IsZero() || delivering[token.Key] || token.remaining() <= 0 {
+
+			continue
+		}
+
+		due = append(due, *token)
+	}
+
+	return due
+}
+
+// refundCreated records that the unused units of an expired token are being refunded. Recording no
+// units at the zero time undoes it, when the refund could not be written to the ledger.
+func (registry *tokenRegistry) refundCreated(key string, units int, now time.Time) error {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	token := registry.find(key)
+
+	if token == nil {
+
+		return fmt.Errorf("unknown token %s", key)
+	}
+
+	previousUnits, previous := token.UnitsRefunded, token.RefundCreated
+	token.UnitsRefunded = units
+	token.RefundCreated = now
+
+	if err := registry.save(); err != nil {
+
+		token.UnitsRefunded, token.RefundCreated = previousUnits, previous
+		return err
+	}
+
+	return nil
+}
+
+// unclaimed returns copies of the paid quotes, which were not refused, whose token has not been presented
+// within unclaimedLifetime of the payment
+func (registry *tokenRegistry) unclaimed(now time.Time) []paidQuote {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	var quotes []paidQuote
+
+	for _, q := range registry.Quotes {
+
+		if !q.Paid.IsZero() && q.Refused == "" && now.Sub(q.Paid) >= unclaimedLifetime {
+
+			quotes = append(quotes, *q)
+		}
+	}
+
+	return quotes
+}
+
+// removeQuote takes the quote with the payment reference out of the registry, e.g. once it is refunded
+func (registry *tokenRegistry) removeQuote(reference string) (*paidQuote, error) {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	for i, q := range registry.Quotes {
+
+		if q.Reference != reference {
+
+			continue
+		}
+
+		quotes := registry.Quotes
+		registry.Quotes = append(append([]*paidQuote(nil), quotes[:i]...), quotes[i+1:]...)
+
+		if err := registry.save(); err != nil {
+
+			registry.Quotes = quotes
+			return nil, err
+		}
+
+		return q, nil
+	}
+
+	return nil, fmt.Errorf("no quote with reference %s", reference)
+}
+
+// restoreQuote puts back a quote taken out by removeQuote
+func (registry *tokenRegistry) restoreQuote(q *paidQuote) error {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.Quotes = append(registry.Quotes, q)
+
+	return registry.save()
+}
+
+func (registry *tokenRegistry) find(key string) *registeredToken {
+
+	for _, token := range registry.Tokens {
+
+		if token.Key == key {
+
+			return token
+		}
+	}
+
+	return nil
+}
+
+// quote returns a copy of the quote with the payment reference
+func (registry *tokenRegistry) quote(reference string) (paidQuote, bool) {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	for _, q := range registry.Quotes {
+
+		if q.Reference == reference {
+
+			return *q, true
+		}
+	}
+
+	return paidQuote{}, false
+}
+
+// names reports whether the order description has the payment reference as one of its words
+func names(orderDescription string, reference string) bool {
+
+	for _, word := range strings.Fields(orderDescription) {
+
+		if reference != "" && strings.Trim(word, ".,;:()[]'\"") == reference {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// quotePaidBy returns the index of the quote the token paid for, or -1
+func (registry *tokenRegistry) quotePaidBy(key string) int {
+
+	for i, q := range registry.Quotes {
+
+		if q.TokenKey == key {
+
+			return i
+		}
+	}
+
+	return -1
+}
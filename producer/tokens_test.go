@@ -0,0 +1,188 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wptechinnovation/wpw-sdk-go/wpwithin/types"
+)
+
+func newRegistry(t *testing.T) *tokenRegistry {
+
+	registry, err := loadTokenRegistry(filepath.Join(t.TempDir(), "tokens.json"))
+
+	if err != nil {
+
+		t.Fatalf("loadTokenRegistry: %s", err.Error())
+	}
+
+	return registry
+}
+
+// quote records a quote of 10 units of service 1 price 1 for 50 GBP to the client
+func quote(t *testing.T, registry *tokenRegistry, reference string, clientID string, now time.Time) {
+
+	q := types.TotalPriceResponse{PaymentReferenceID: reference, ClientID: clientID, PriceID: 1, UnitsToSupply: 10, TotalPrice: 50, CurrencyCode: "GBP"}
+
+	if err := registry.quoted(1, q, "", now); err != nil {
+
+		t.Fatalf("quoted: %s", err.Error())
+	}
+}
+
+// pay records the payment for the quote, made with the delivery token
+func pay(t *testing.T, registry *tokenRegistry, reference string, key string, now time.Time) {
+
+	if _, err := registry.paid(50, "GBP", "Payment for "+reference+".", key, now); err != nil {
+
+		t.Fatalf("paid: %s", err.Error())
+	}
+}
+
+func deliveryToken(key string, now time.Time) types.ServiceDeliveryToken {
+
+	return types.ServiceDeliveryToken{Key: key, Issued: now, Expiry: now.Add(time.Hour)}
+}
+
+func TestPaymentMatchesQuote(t *testing.T) {
+
+	registry := newRegistry(t)
+	now := time.Now()
+
+	quote(t, registry, "a", "alice", now)
+	quote(t, registry, "b", "bob", now)
+
+	q, err := registry.paid(50, "gbp", "Payment for b", "bob", now)
+
+	if err != nil || q.Reference != "b" || q.TokenKey != "bob" {
+
+		t.Fatalf("bob's payment: got %+v %v, want quote b paid by token bob", q, err)
+	}
+
+	tests := []struct {
+		name        string
+		total       int
+		description string
+		key         string
+	}{
+		{"no reference", 50, "Payment for c", "carol"},
+		{"wrong amount", 40, "Payment for a", "alice"},
+		{"paid twice", 50, "Payment for b", "bob2"},
+		{"token reused", 50, "Payment for a", "bob"},
+		{"no token", 50, "Payment for a", ""},
+	}
+
+	for _, test := range tests {
+
+		if _, err := registry.paid(test.total, "GBP", test.description, test.key, now); err == nil {
+
+			t.Errorf("%s: payment recorded", test.name)
+		}
+	}
+
+	if a, _ := registry.quote("a"); !a.Paid.IsZero() || a.TokenKey != "" {
+
+		t.Errorf("quote a was paid by a refused payment: %+v", a)
+	}
+}
+
+func TestClaimNeedsPayment(t *testing.T) {
+
+	registry := newRegistry(t)
+	now := time.Now()
+
+	quote(t, registry, "a", "alice", now)
+	quote(t, registry, "b", "bob", now)
+	pay(t, registry, "a", "alice", now)
+
+	// Mallory holds a token of her own, which paid for nothing
+	if _, err := registry.claim(deliveryToken("mallory", now), 1, 1, 10, now); err == nil {
+
+		t.Fatal("a token which paid for nothing took a paid quote")
+	}
+
+	token, err := registry.claim(deliveryToken("alice", now), 1, 1, 4, now)
+
+	if err != nil || token.Reference != "a" {
+
+		t.Fatalf("alice's claim: got %+v %v, want quote a", token, err)
+	}
+
+	if _, ok := registry.quote("b"); !ok {
+
+		t.Error("bob's quote was taken")
+	}
+}
+
+func TestRefusedClaimIsNotRegistered(t *testing.T) {
+
+	registry := newRegistry(t)
+	now := time.Now()
+
+	quote(t, registry, "a", "alice", now)
+	pay(t, registry, "a", "alice", now)
+
+	tests := []struct {
+		name      string
+		serviceID int
+		units     int
+		now       time.Time
+	}{
+		{"wrong service", 2, 4, now},
+		{"too many units", 1, 11, now},
+		{"expired", 1, 4, now.Add(2 * time.Hour)},
+	}
+
+	for _, test := range tests {
+
+		if _, err := registry.claim(deliveryToken("alice", now), test.serviceID, 1, test.units, test.now); err == nil {
+
+			t.Errorf("%s: claim accepted", test.name)
+		}
+
+		if registry.find("alice") != nil || registry.quotePaidBy("alice") < 0 {
+
+			t.Fatalf("%s: the refused claim registered the token", test.name)
+		}
+	}
+
+	if _, err := registry.claim(deliveryToken("alice", now), 1, 1, 4, now); err != nil {
+
+		t.Fatalf("claim after refusals: %s", err.Error())
+	}
+}
+
+func TestClaimReservesUnits(t *testing.T) {
+
+	registry := newRegistry(t)
+	now := time.Now()
+
+	quote(t, registry, "a", "alice", now)
+	pay(t, registry, "a", "alice", now)
+
+	tests := []struct {
+		units int
+		ok    bool
+	}{
+		{4, true},
+		{7, false},
+		{6, true},
+		{1, false}, // Replayed
+	}
+
+	for _, test := range tests {
+
+		if _, err := registry.claim(deliveryToken("alice", now), 1, 1, test.units, now); (err == nil) != test.ok {
+
+			t.Errorf("%d units: got %v, want ok %t", test.units, err, test.ok)
+		}
+	}
+
+	reloaded, err := loadTokenRegistry(registry.path)
+
+	if err != nil || len(reloaded.Tokens) != 1 || reloaded.Tokens[0].UnitsClaimed != 10 || len(reloaded.Quotes) != 0 {
+
+		t.Errorf("reloaded registry: got %+v %v", reloaded, err)
+	}
+}
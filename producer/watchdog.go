@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sdNotify sends a state, e.g. READY=1, to systemd over the socket named by NOTIFY_SOCKET.
+// It does nothing when the producer is not run by systemd.
+func sdNotify(state string) error {
+
+	socket := os.Getenv("NOTIFY_SOCKET")
+
+	if socket == "" {
+
+		return nil
+	}
+
+	// A leading @ is an abstract socket, which Go dials the same way
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+	if err != nil {
+
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, half WATCHDOG_USEC, or zero
+// when the watchdog is not enabled for this process
+func watchdogInterval() (time.Duration, error) {
+
+	usec := os.Getenv("WATCHDOG_USEC")
+
+	if usec == "" {
+
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+
+	if err != nil || n <= 0 {
+
+		return 0, errors.New("invalid WATCHDOG_USEC " + usec)
+	}
+
+	return time.Duration(n) * time.Microsecond / 2, nil
+}
+
+// runWatchdog pings the systemd watchdog while the producer is healthy enough to serve. A producer whose
+// session manager has hung, or whose broadcast has not started, stops pinging and is restarted by systemd.
+// Whether the broadcast is still heard is only reported by the health check: listening for it fails on a
+// healthy producer when another process holds the discovery port or loopback is filtered. An unreachable
+// PSP does not stop the pings either, restarting would not fix the network.
+func (handler *Handler) runWatchdog(interval time.Duration) {
+
+	for {
+
+		// A check which panics skips the ping, as an unhealthy one does
+		safely("watchdog", func() {
+
+			started := broadcast.startedAt()
+			sessions := handler.sessionManagerHealth()
+
+			if !started.IsZero() && sessions.OK {
+
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+
+					log.Errorf("Watchdog ping failed: %s", err.Error())
+				}
+			} else {
+
+				log.WithFields(log.Fields{"broadcastStarted": !started.IsZero(), "sessionManager": sessions.Detail}).Error("Unhealthy, not pinging the watchdog")
+			}
+		})
+
+		time.Sleep(interval)
+	}
+}